@@ -4,7 +4,10 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"net/url"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/by-cx/lobby/server"
 	"github.com/go-resty/resty/v2"
@@ -12,10 +15,11 @@ import (
 
 // Encapsulation of Lobby's client code
 type LobbyClient struct {
-	Proto string
-	Host  string
-	Port  uint
-	Token string
+	Proto     string
+	Host      string
+	Port      uint
+	Token     string
+	Namespace string // if not empty, only discoveries from this namespace (or comma separated namespaces) are returned
 }
 
 func (l *LobbyClient) init() {
@@ -40,6 +44,10 @@ func (l *LobbyClient) call(method, path, body string) (uint, string, error) {
 		client = client.SetHeader("Authorization", fmt.Sprintf("Token %s", l.Token))
 	}
 
+	if len(l.Namespace) != 0 {
+		client = client.SetQueryParam("namespace", l.Namespace)
+	}
+
 	if strings.ToUpper(method) == "GET" {
 		resp, err := client.Get(fmt.Sprintf("%s://%s:%d%s", l.Proto, l.Host, l.Port, path))
 		if err != nil {
@@ -89,6 +97,33 @@ func (l *LobbyClient) GetDiscovery() (server.Discovery, error) {
 	return discovery, nil
 }
 
+// GetLabelSources returns labels of the local machine with information where they come from
+func (l *LobbyClient) GetLabelSources() ([]server.SourcedLabel, error) {
+	l.init()
+
+	path := "/v1/discovery?verbose=1"
+	method := "GET"
+
+	var response struct {
+		LabelSources []server.SourcedLabel `json:"label_sources"`
+	}
+
+	status, body, err := l.call(method, path, "")
+	if err != nil {
+		return response.LabelSources, err
+	}
+	if status != 200 {
+		return response.LabelSources, fmt.Errorf("non-200 response: %s", body)
+	}
+
+	err = json.Unmarshal([]byte(body), &response)
+	if err != nil {
+		return response.LabelSources, fmt.Errorf("response parsing error: %v", err)
+	}
+
+	return response.LabelSources, nil
+}
+
 // Returns all registered discovery packets
 func (l *LobbyClient) GetDiscoveries() ([]server.Discovery, error) {
 	l.init()
@@ -164,6 +199,56 @@ func (l *LobbyClient) FindByLabels(labels server.Labels) ([]server.Discovery, er
 	return discoveries, nil
 }
 
+// Find discoveries matching the label selector query, see server.Query for the syntax
+func (l *LobbyClient) FindByQuery(query string) ([]server.Discovery, error) {
+	l.init()
+
+	path := fmt.Sprintf("/v1/discoveries?q=%s", url.QueryEscape(query))
+	method := "GET"
+
+	var discoveries []server.Discovery
+
+	status, body, err := l.call(method, path, "")
+	if err != nil {
+		return discoveries, err
+	}
+	if status != 200 {
+		return discoveries, fmt.Errorf("non-200 response: %s", body)
+	}
+
+	err = json.Unmarshal([]byte(body), &discoveries)
+	if err != nil {
+		return discoveries, fmt.Errorf("response parsing error: %v", err)
+	}
+
+	return discoveries, nil
+}
+
+// ResolveQuery returns list of hostnames matching the label selector query
+func (l *LobbyClient) ResolveQuery(query string) ([]string, error) {
+	l.init()
+
+	path := fmt.Sprintf("/v1/resolve?q=%s", url.QueryEscape(query))
+	method := "GET"
+
+	var hostnames []string
+
+	status, body, err := l.call(method, path, "")
+	if err != nil {
+		return hostnames, err
+	}
+	if status != 200 {
+		return hostnames, fmt.Errorf("non-200 response: %s", body)
+	}
+
+	err = json.Unmarshal([]byte(body), &hostnames)
+	if err != nil {
+		return hostnames, fmt.Errorf("response parsing error: %v", err)
+	}
+
+	return hostnames, nil
+}
+
 // Find discoveries by label prefixes
 func (l *LobbyClient) FindByPrefixes(prefixes []string) ([]server.Discovery, error) {
 	l.init()
@@ -189,6 +274,46 @@ func (l *LobbyClient) FindByPrefixes(prefixes []string) ([]server.Discovery, err
 	return discoveries, nil
 }
 
+// History returns membership events (joined, updated, left, expired) from the oldest to the newest.
+// Empty hostname and query and zero times are ignored.
+func (l *LobbyClient) History(hostname string, since, until time.Time, query string) ([]server.Event, error) {
+	l.init()
+
+	params := url.Values{}
+	if len(hostname) > 0 {
+		params.Set("hostname", hostname)
+	}
+	if !since.IsZero() {
+		params.Set("since", since.Format(time.RFC3339))
+	}
+	if !until.IsZero() {
+		params.Set("until", until.Format(time.RFC3339))
+	}
+	if len(query) > 0 {
+		params.Set("q", query)
+	}
+
+	path := "/v1/history?" + params.Encode()
+	method := "GET"
+
+	var events []server.Event
+
+	status, body, err := l.call(method, path, "")
+	if err != nil {
+		return events, err
+	}
+	if status != 200 {
+		return events, fmt.Errorf("non-200 response: %s", body)
+	}
+
+	err = json.Unmarshal([]byte(body), &events)
+	if err != nil {
+		return events, fmt.Errorf("response parsing error: %v", err)
+	}
+
+	return events, nil
+}
+
 // Adds runtime labels for the local machine
 func (l *LobbyClient) AddLabels(labels server.Labels) error {
 	l.init()
@@ -224,3 +349,175 @@ func (l *LobbyClient) DeleteLabels(labels server.Labels) error {
 
 	return nil
 }
+
+// callLease calls the backend API and returns the lease from the response. 404 response is returned
+// as *server.LeaseNotFoundError.
+func (l *LobbyClient) callLease(method, path, body, id string) (server.Lease, error) {
+	var lease server.Lease
+
+	status, responseBody, err := l.call(method, path, body)
+	if err != nil {
+		return lease, err
+	}
+	if status == 404 && len(id) > 0 {
+		return lease, &server.LeaseNotFoundError{ID: id}
+	}
+	if status != 200 {
+		return lease, fmt.Errorf("non-200 response: %s", responseBody)
+	}
+
+	err = json.Unmarshal([]byte(responseBody), &lease)
+	if err != nil {
+		return lease, fmt.Errorf("response parsing error: %v", err)
+	}
+
+	return lease, nil
+}
+
+// GrantLease creates a new lease with given TTL and labels. The labels are removed when the lease expires
+// or when it's revoked. TTL is rounded to seconds.
+func (l *LobbyClient) GrantLease(ttl time.Duration, labels server.Labels) (server.Lease, error) {
+	l.init()
+
+	path := fmt.Sprintf("/v1/leases?ttl=%d", uint(ttl.Round(time.Second)/time.Second))
+	method := "POST"
+
+	return l.callLease(method, path, strings.Join(labels.StringSlice(), "\n"), "")
+}
+
+// AttachLabels adds runtime labels to an existing lease
+func (l *LobbyClient) AttachLabels(id string, labels server.Labels) (server.Lease, error) {
+	l.init()
+
+	path := fmt.Sprintf("/v1/labels?lease=%s", url.QueryEscape(id))
+	method := "POST"
+
+	return l.callLease(method, path, strings.Join(labels.StringSlice(), "\n"), id)
+}
+
+// KeepAliveLease extends the lease by its TTL
+func (l *LobbyClient) KeepAliveLease(id string) (server.Lease, error) {
+	l.init()
+
+	path := fmt.Sprintf("/v1/leases/%s/keepalive", url.PathEscape(id))
+	method := "POST"
+
+	return l.callLease(method, path, "", id)
+}
+
+// RevokeLease removes the lease and its labels right away
+func (l *LobbyClient) RevokeLease(id string) error {
+	l.init()
+
+	path := fmt.Sprintf("/v1/leases/%s", url.PathEscape(id))
+	method := "DELETE"
+
+	_, err := l.callLease(method, path, "", id)
+	return err
+}
+
+// Leases returns all active leases of the local machine
+func (l *LobbyClient) Leases() ([]server.Lease, error) {
+	l.init()
+
+	path := "/v1/leases"
+	method := "GET"
+
+	var leases []server.Lease
+
+	status, body, err := l.call(method, path, "")
+	if err != nil {
+		return leases, err
+	}
+	if status != 200 {
+		return leases, fmt.Errorf("non-200 response: %s", body)
+	}
+
+	err = json.Unmarshal([]byte(body), &leases)
+	if err != nil {
+		return leases, fmt.Errorf("response parsing error: %v", err)
+	}
+
+	return leases, nil
+}
+
+// LeaseKeeper keeps a lease alive in background, see LobbyClient.KeepLeaseAlive
+type LeaseKeeper struct {
+	client *LobbyClient
+	lock   sync.Mutex
+	lease  server.Lease
+	done   chan struct{}
+	once   sync.Once
+}
+
+// KeepLeaseAlive keeps the lease alive in background until Stop is called. The lease is refreshed three times
+// per its TTL. If the lease is lost, e.g. because the daemon was restarted, a new one with the same TTL
+// and labels is granted. Errors are sent into errors channel if it's not nil.
+func (l *LobbyClient) KeepLeaseAlive(lease server.Lease, errors chan<- error) *LeaseKeeper {
+	keeper := &LeaseKeeper{
+		client: l,
+		lease:  lease,
+		done:   make(chan struct{}),
+	}
+
+	interval := time.Duration(lease.TTL) * time.Second / 3
+	if interval < 100*time.Millisecond {
+		interval = 100 * time.Millisecond
+	}
+
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+			case <-keeper.done:
+				return
+			}
+
+			err := keeper.keepAlive()
+			if err != nil && errors != nil {
+				errors <- err
+			}
+		}
+	}()
+
+	return keeper
+}
+
+// keepAlive refreshes the lease or grants a new one if it doesn't exist anymore
+func (k *LeaseKeeper) keepAlive() error {
+	current := k.Lease()
+
+	lease, err := k.client.KeepAliveLease(current.ID)
+	if _, ok := err.(*server.LeaseNotFoundError); ok {
+		lease, err = k.client.GrantLease(time.Duration(current.TTL)*time.Second, current.Labels)
+	}
+	if err != nil {
+		return fmt.Errorf("lease %s keep alive error: %v", current.ID, err)
+	}
+
+	k.lock.Lock()
+	k.lease = lease
+	k.lock.Unlock()
+
+	return nil
+}
+
+// Lease returns the lease as it was returned by the last keep alive
+func (k *LeaseKeeper) Lease() server.Lease {
+	k.lock.Lock()
+	defer k.lock.Unlock()
+
+	return k.lease
+}
+
+// Stop stops refreshing the lease and revokes it so its labels are removed right away
+func (k *LeaseKeeper) Stop() error {
+	k.once.Do(func() {
+		close(k.done)
+	})
+
+	return k.client.RevokeLease(k.Lease().ID)
+}
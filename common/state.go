@@ -0,0 +1,57 @@
+package common
+
+import "sync"
+
+// StateTracker keeps connection state of a driver and passes its changes to the listener.
+// Zero value is ready to use and its state is StateDown.
+type StateTracker struct {
+	lock     sync.Mutex
+	state    ConnectionState
+	listener StateListener
+}
+
+// Get returns the current state
+func (t *StateTracker) Get() ConnectionState {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	if t.state == "" {
+		return StateDown
+	}
+	return t.state
+}
+
+// Register sets the function called when the state changes
+func (t *StateTracker) Register(listener StateListener) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	t.listener = listener
+}
+
+// Set changes the state and calls the listener if it's different from the previous one.
+// The listener is called with the lock held so the changes are reported in order.
+func (t *StateTracker) Set(state ConnectionState) {
+	t.set(state, false)
+}
+
+// Restored reports StateConnected to the listener even if the state didn't change, it's used
+// when a part of the connection is restored, e.g. one of multiple drivers.
+func (t *StateTracker) Restored() {
+	t.set(StateConnected, true)
+}
+
+func (t *StateTracker) set(state ConnectionState, force bool) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	previous := t.state
+	if previous == "" {
+		previous = StateDown
+	}
+	t.state = state
+
+	if (previous != state || force) && t.listener != nil {
+		t.listener(state)
+	}
+}
@@ -2,15 +2,42 @@ package common
 
 import "github.com/by-cx/lobby/server"
 
+// Reasons used by drivers when they drop incoming packet, validation errors use server.ValidationReason* values
+const (
+	RejectReasonDecode  = "decode"  // packet couldn't be decoded
+	RejectReasonMessage = "message" // unknown message type in the envelope
+)
+
+// ConnectionState describes connection of the driver to its bus
+type ConnectionState string
+
+const (
+	StateConnected    ConnectionState = "connected"    // packets are sent and received
+	StateReconnecting ConnectionState = "reconnecting" // connection was lost and the driver is restoring it
+	StateDown         ConnectionState = "down"         // driver is not connected and doesn't try to connect
+)
+
 // Listener is a function that returns received discovery
 type Listener func(server.Discovery)
 
+// RejectListener is a function that is called when driver drops an incoming packet.
+// Reason is short machine readable description of the problem.
+type RejectListener func(reason string, err error)
+
+// StateListener is a function that is called when connection state of the driver changes.
+// StateConnected is reported also when a part of the connection is restored while the driver
+// was connected, in both cases the packets sent during the outage might be lost.
+type StateListener func(state ConnectionState)
+
 // Driver interface describes exported methods that have to be implemented in each driver
 type Driver interface {
 	Init() error
 	Close() error
+	State() ConnectionState
 	RegisterSubscribeFunction(listener Listener)
 	RegisterUnsubscribeFunction(listener Listener)
+	RegisterRejectFunction(listener RejectListener)
+	RegisterStateFunction(listener StateListener)
 	SendDiscoveryPacket(discovery server.Discovery) error
 	SendGoodbyePacket(discovery server.Discovery) error
 }
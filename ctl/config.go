@@ -13,6 +13,8 @@ type Config struct {
 	Proto string `envconfig:"PROTOCOL" required:"false" default:"http"`  // selected http or https protocols, default is http
 	Host  string `envconfig:"HOST" required:"false" default:"127.0.0.1"` // IP address or hostname where lobbyd is listening
 	Port  uint   `envconfig:"PORT" required:"false" default:"1313"`      // Same thing but the port part
+
+	Namespace string `envconfig:"NAMESPACE" required:"false" default:""` // Show only discoveries from this namespace, empty means all namespaces the daemon watches
 }
 
 // GetConfig return configuration created based on environment variables
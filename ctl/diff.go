@@ -0,0 +1,166 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/by-cx/lobby/client"
+	"github.com/by-cx/lobby/server"
+	"github.com/fatih/color"
+)
+
+// snapshotDiff is a change of a single server between two snapshots
+type snapshotDiff struct {
+	Type string `json:"type"` // joined, left or updated
+	server.Diff
+}
+
+// findDiscovery returns discovery of the hostname, hostname can be prefixed by namespace and slash
+func findDiscovery(discoveries []server.Discovery, hostname string) (server.Discovery, error) {
+	for _, discovery := range discoveries {
+		if discovery.Name() == hostname || discovery.Hostname == hostname {
+			return discovery, nil
+		}
+	}
+	return server.Discovery{}, fmt.Errorf("server %s not found", hostname)
+}
+
+// diffHosts returns changes between two servers registered in lobby
+func diffHosts(lobbyClient client.LobbyClient, hostnameA, hostnameB string) (server.Diff, error) {
+	discoveries, err := lobbyClient.GetDiscoveries()
+	if err != nil {
+		return server.Diff{}, err
+	}
+
+	discoveryA, err := findDiscovery(discoveries, hostnameA)
+	if err != nil {
+		return server.Diff{}, err
+	}
+	discoveryB, err := findDiscovery(discoveries, hostnameB)
+	if err != nil {
+		return server.Diff{}, err
+	}
+
+	return server.DiffDiscoveries(discoveryA, discoveryB), nil
+}
+
+// loadSnapshot reads discoveries from a file. It can be output of "lobbyctl -json discoveries",
+// "lobbyctl -json discovery" or the daemon's state file.
+func loadSnapshot(filename string) ([]server.Discovery, error) {
+	content, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, fmt.Errorf("reading snapshot error: %v", err)
+	}
+
+	discoveries := []server.Discovery{}
+	if err = json.Unmarshal(content, &discoveries); err == nil {
+		return discoveries, nil
+	}
+
+	state := struct {
+		Discoveries []server.Discovery `json:"discoveries"`
+	}{}
+	if err = json.Unmarshal(content, &state); err == nil && state.Discoveries != nil {
+		return state.Discoveries, nil
+	}
+
+	discovery := server.Discovery{}
+	err = json.Unmarshal(content, &discovery)
+	if err != nil || len(discovery.Hostname) == 0 {
+		return nil, fmt.Errorf("%s is not a list of discoveries, a discovery or a state file", filename)
+	}
+	return []server.Discovery{discovery}, nil
+}
+
+// diffSnapshots returns changes of servers between two snapshots. When both snapshots contain a single
+// server, they are compared even if their hostnames differ.
+func diffSnapshots(discoveriesA, discoveriesB []server.Discovery) []snapshotDiff {
+	if len(discoveriesA) == 1 && len(discoveriesB) == 1 {
+		return []snapshotDiff{{Type: "updated", Diff: server.DiffDiscoveries(discoveriesA[0], discoveriesB[0])}}
+	}
+
+	indexA := make(map[string]server.Discovery)
+	for _, discovery := range discoveriesA {
+		indexA[discovery.Name()] = discovery
+	}
+	indexB := make(map[string]server.Discovery)
+	for _, discovery := range discoveriesB {
+		indexB[discovery.Name()] = discovery
+	}
+
+	names := []string{}
+	for name := range indexA {
+		names = append(names, name)
+	}
+	for name := range indexB {
+		if _, ok := indexA[name]; !ok {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	diffs := []snapshotDiff{}
+	for _, name := range names {
+		discoveryA, inA := indexA[name]
+		discoveryB, inB := indexB[name]
+
+		switch {
+		case !inA:
+			diffs = append(diffs, snapshotDiff{Type: "joined", Diff: server.DiffDiscoveries(server.Discovery{Namespace: discoveryB.Namespace, Hostname: discoveryB.Hostname}, discoveryB)})
+		case !inB:
+			diffs = append(diffs, snapshotDiff{Type: "left", Diff: server.DiffDiscoveries(discoveryA, server.Discovery{Namespace: discoveryA.Namespace, Hostname: discoveryA.Hostname})})
+		default:
+			diff := server.DiffDiscoveries(discoveryA, discoveryB)
+			if !diff.Empty() {
+				diffs = append(diffs, snapshotDiff{Type: "updated", Diff: diff})
+			}
+		}
+	}
+
+	return diffs
+}
+
+func printDiff(diff server.Diff) {
+	if len(diff.OldNamespace) > 0 {
+		fmt.Printf("    namespace: %s -> %s\n", diff.OldNamespace, diff.Namespace)
+	}
+	if len(diff.OldHostname) > 0 {
+		fmt.Printf("    hostname: %s -> %s\n", color.YellowString(diff.OldHostname), color.YellowString(diff.Hostname))
+	}
+	for _, change := range diff.Changed {
+		fmt.Printf("    ~ %s: %s -> %s\n", color.GreenString(change.Key), color.MagentaString(strings.Join(change.Old, ",")), color.MagentaString(strings.Join(change.New, ",")))
+	}
+	for _, label := range diff.Added {
+		fmt.Printf("    + %s\n", colorLabel(label))
+	}
+	for _, label := range diff.Removed {
+		fmt.Printf("    - %s\n", colorLabel(label))
+	}
+}
+
+func printSnapshotDiffs(diffs []snapshotDiff) {
+	for _, diff := range diffs {
+		name := diff.Hostname
+		if diff.Namespace != server.DefaultNamespace {
+			name = diff.Namespace + "/" + diff.Hostname
+		}
+
+		changeType := diff.Type
+		switch diff.Type {
+		case "joined":
+			changeType = color.GreenString(changeType)
+		case "updated":
+			changeType = color.CyanString(changeType)
+		default:
+			changeType = color.RedString(changeType)
+		}
+
+		fmt.Printf("%s  %s\n", color.YellowString(name), changeType)
+		if diff.Type == "updated" {
+			printDiff(diff.Diff)
+		}
+	}
+}
@@ -6,6 +6,7 @@ import (
 	"os"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/by-cx/lobby/server"
 	"github.com/fatih/color"
@@ -13,6 +14,7 @@ import (
 
 func printDiscovery(discovery server.Discovery) {
 	color.Yellow("Hostname:\n  %s\n", discovery.Hostname)
+	fmt.Printf("Namespace:\n  %s\n", server.NormalizeNamespace(discovery.Namespace))
 
 	if len(discovery.Labels) > 0 {
 		fmt.Printf("Labels:\n")
@@ -23,28 +25,27 @@ func printDiscovery(discovery server.Discovery) {
 }
 
 func colorLabel(label server.Label) string {
-	parts := strings.Split(label.String(), ":")
-	if len(parts) == 1 {
-		return color.GreenString(parts[0])
+	if !label.HasValue() {
+		return color.GreenString(label.Key())
 	}
 
-	return color.GreenString(parts[0]) + ":" + color.MagentaString((strings.Join(parts[1:], ":")))
+	return color.GreenString(label.Key()) + ":" + color.MagentaString(label.Value())
 }
 
 func printDiscoveries(discoveries []server.Discovery) {
 	maxHostnameWidth := 0
 	for _, discovery := range discoveries {
-		if len(discovery.Hostname) > maxHostnameWidth {
-			maxHostnameWidth = len(discovery.Hostname)
+		if len(discovery.Name()) > maxHostnameWidth {
+			maxHostnameWidth = len(discovery.Name())
 		}
 	}
 
 	for _, discovery := range discoveries {
 		if len(discovery.Labels) == 0 {
 			// fmt.Println(discovery.Hostname)
-			color.Yellow(discovery.Hostname)
+			color.Yellow(discovery.Name())
 		} else {
-			hostname := fmt.Sprintf("%"+strconv.Itoa(maxHostnameWidth)+"s", discovery.Hostname)
+			hostname := fmt.Sprintf("%"+strconv.Itoa(maxHostnameWidth)+"s", discovery.Name())
 
 			fmt.Printf("%s    %s\n", color.YellowString(hostname), colorLabel(discovery.Labels[0]))
 
@@ -67,3 +68,63 @@ func printJSON(data interface{}) {
 
 	fmt.Println(string(body))
 }
+
+func printHistory(events []server.Event) {
+	for _, event := range events {
+		eventType := string(event.Type)
+		switch event.Type {
+		case server.EventJoined:
+			eventType = color.GreenString(eventType)
+		case server.EventUpdated:
+			eventType = color.CyanString(eventType)
+		default:
+			eventType = color.RedString(eventType)
+		}
+
+		discovery := event.Discovery()
+		fmt.Printf("%s  %s  %s\n", event.Time.Local().Format("2006-01-02 15:04:05"), color.YellowString(discovery.Name()), eventType)
+
+		if event.Type == server.EventUpdated {
+			for _, label := range event.Added {
+				fmt.Printf("    + %s\n", colorLabel(label))
+			}
+			for _, label := range event.Removed {
+				fmt.Printf("    - %s\n", colorLabel(label))
+			}
+		} else {
+			for _, label := range discovery.Labels {
+				fmt.Printf("      %s\n", colorLabel(label))
+			}
+		}
+	}
+}
+
+func printLabelSources(labels []server.SourcedLabel, sources bool) {
+	maxLabelWidth := 0
+	for _, label := range labels {
+		if len(label.Label) > maxLabelWidth {
+			maxLabelWidth = len(label.Label)
+		}
+	}
+
+	for _, label := range labels {
+		if !sources {
+			fmt.Println(colorLabel(label.Label))
+			continue
+		}
+
+		// Padding is calculated from the label without colors
+		padding := strings.Repeat(" ", maxLabelWidth-len(label.Label))
+		fmt.Printf("%s%s    %s\n", colorLabel(label.Label), padding, label.SourcesString())
+	}
+}
+
+func printLeases(leases []server.Lease) {
+	for _, lease := range leases {
+		expires := time.Unix(lease.Expires, 0)
+		fmt.Printf("%s  ttl %ds  expires %s (in %s)\n", color.YellowString(lease.ID), lease.TTL, expires.Local().Format("2006-01-02 15:04:05"), time.Until(expires).Round(time.Second))
+		for _, label := range lease.Labels {
+			fmt.Printf("    %s\n", colorLabel(label))
+		}
+	}
+}
@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"os"
 	"strings"
+	"time"
 
 	"github.com/by-cx/lobby/client"
 	"github.com/by-cx/lobby/server"
@@ -15,12 +16,23 @@ func Usage() {
 	fmt.Println("")
 	fmt.Println("Commands:")
 	fmt.Println("  resolve label                    returns list of hostnames with given label")
+	fmt.Println("  resolve query QUERY              returns list of hostnames matching the label selector query")
 	fmt.Println("  discovery                        returns discovery packet of the server where the client is connected to")
 	fmt.Println("  discoveries                      returns list of all registered discovery packets")
 	fmt.Println("  discoveries labels [LABEL] ...   returns list of all registered discovery packets with given labels (OR)")
 	fmt.Println("  discoveries search [LABEL] ...   returns list of all registered discovery packets with given label prefixes (OR)")
+	fmt.Println("  discoveries query QUERY          returns list of all registered discovery packets matching the label selector query")
+	fmt.Println("  history [FLAGS]                  returns history of joined, updated, left and expired servers, see history -h")
+	fmt.Println("  diff HOSTNAME HOSTNAME           compares labels of two servers")
+	fmt.Println("  diff -snapshots FILE FILE        compares two snapshots saved by -json discoveries or discovery command")
+	fmt.Println("  labels list [--sources]          returns labels of the server where the client is connected to, optionally with their sources")
 	fmt.Println("  labels add LABEL [LABEL] ...     adds new runtime labels")
+	fmt.Println("  labels add --ttl 30s LABEL ...   adds runtime labels with a new lease and prints its ID, see leases")
+	fmt.Println("  labels add --lease ID LABEL ...  adds runtime labels to an existing lease")
 	fmt.Println("  labels del LABEL [LABEL] ...     deletes runtime labels")
+	fmt.Println("  leases [list]                    returns leases of runtime labels with their expiration")
+	fmt.Println("  leases keepalive ID              extends the lease by its TTL")
+	fmt.Println("  leases revoke ID                 removes the lease and its labels")
 }
 
 func main() {
@@ -32,6 +44,7 @@ func main() {
 	port := flag.Uint("port", 0, "Port of lobby daemon")
 	token := flag.String("token", "", "Token needed to communicate lobby daemon, if empty auth is disabled")
 	jsonOutput := flag.Bool("json", false, "set output to JSON, error will be still in plain text")
+	namespace := flag.String("namespace", "", "Show only discoveries from this namespace (or comma separated namespaces)")
 
 	flag.Parse()
 
@@ -48,6 +61,9 @@ func main() {
 	if *token == "" {
 		token = &config.Token
 	}
+	if *namespace == "" {
+		namespace = &config.Namespace
+	}
 
 	// Validation
 	if *proto != "http" && *proto != "https" {
@@ -60,6 +76,8 @@ func main() {
 		Host:  *host,
 		Port:  *port,
 		Token: *token,
+
+		Namespace: *namespace,
 	}
 
 	// Process rest of the arguments
@@ -70,8 +88,15 @@ func main() {
 
 	switch flag.Args()[0] {
 	case "resolve":
-		if len(flag.Args()) == 2 {
-			hostnames, err := client.Resolve(server.Label(flag.Arg(1)))
+		if len(flag.Args()) == 2 || (len(flag.Args()) > 2 && flag.Arg(1) == "query") {
+			var hostnames []string
+			var err error
+
+			if flag.Arg(1) == "query" {
+				hostnames, err = client.ResolveQuery(strings.Join(flag.Args()[2:], " "))
+			} else {
+				hostnames, err = client.Resolve(server.Label(flag.Arg(1)))
+			}
 			if err != nil {
 				fmt.Println(err)
 				os.Exit(1)
@@ -104,6 +129,12 @@ func main() {
 					fmt.Println(err)
 					os.Exit(1)
 				}
+			} else if flag.Arg(1) == "query" {
+				discoveries, err = client.FindByQuery(strings.Join(flag.Args()[2:], " "))
+				if err != nil {
+					fmt.Println(err)
+					os.Exit(1)
+				}
 			} else if flag.Arg(1) == "search" {
 				discoveries, err = client.FindByPrefixes(flag.Args()[2:])
 				if err != nil {
@@ -140,7 +171,99 @@ func main() {
 		} else {
 			printDiscovery(discovery)
 		}
+	case "history":
+		historyFlags := flag.NewFlagSet("history", flag.ExitOnError)
+		hostname := historyFlags.String("hostname", "", "show only events of this server")
+		since := historyFlags.String("since", "", "show only events after this time, RFC 3339 time or duration like 2h meaning two hours ago")
+		until := historyFlags.String("until", "", "show only events before this time, RFC 3339 time or duration like 2h meaning two hours ago")
+		query := historyFlags.String("q", "", "show only events of servers matching the label selector query")
+		historyFlags.Parse(flag.Args()[1:])
+
+		sinceTime, err := parseTimeArg(*since)
+		if err != nil {
+			fmt.Printf("ERROR: since: %v\n", err)
+			os.Exit(2)
+		}
+		untilTime, err := parseTimeArg(*until)
+		if err != nil {
+			fmt.Printf("ERROR: until: %v\n", err)
+			os.Exit(2)
+		}
+
+		events, err := client.History(*hostname, sinceTime, untilTime, *query)
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+
+		if *jsonOutput {
+			printJSON(events)
+		} else {
+			printHistory(events)
+		}
+	case "diff":
+		diffFlags := flag.NewFlagSet("diff", flag.ExitOnError)
+		snapshots := diffFlags.Bool("snapshots", false, "compare two snapshot files instead of two servers")
+		diffFlags.Parse(flag.Args()[1:])
+
+		if diffFlags.NArg() != 2 {
+			fmt.Println("ERROR: diff needs exactly two arguments")
+			fmt.Println("")
+			Usage()
+			os.Exit(2)
+		}
+
+		if *snapshots {
+			discoveriesA, err := loadSnapshot(diffFlags.Arg(0))
+			if err != nil {
+				fmt.Printf("ERROR: %v\n", err)
+				os.Exit(2)
+			}
+			discoveriesB, err := loadSnapshot(diffFlags.Arg(1))
+			if err != nil {
+				fmt.Printf("ERROR: %v\n", err)
+				os.Exit(2)
+			}
+
+			diffs := diffSnapshots(discoveriesA, discoveriesB)
+			if *jsonOutput {
+				printJSON(diffs)
+			} else {
+				printSnapshotDiffs(diffs)
+			}
+		} else {
+			diff, err := diffHosts(client, diffFlags.Arg(0), diffFlags.Arg(1))
+			if err != nil {
+				fmt.Println(err)
+				os.Exit(1)
+			}
+
+			if *jsonOutput {
+				printJSON(diff)
+			} else {
+				printDiff(diff)
+			}
+		}
 	case "labels":
+		if len(flag.Args()) >= 2 && flag.Args()[1] == "list" {
+			listFlags := flag.NewFlagSet("labels list", flag.ExitOnError)
+			sources := listFlags.Bool("sources", false, "show where the labels come from")
+			listFlags.Parse(flag.Args()[2:])
+
+			labels, err := client.GetLabelSources()
+			if err != nil {
+				fmt.Println(err)
+				os.Exit(1)
+			}
+
+			if *jsonOutput {
+				printJSON(labels)
+			} else {
+				printLabelSources(labels, *sources)
+			}
+			break
+		}
+
 		if len(flag.Args()) < 3 {
 			fmt.Println("ERROR: not enough arguments for labels command")
 			fmt.Println("")
@@ -148,13 +271,47 @@ func main() {
 			os.Exit(0)
 		}
 
-		labels := server.Labels{}
+		addFlags := flag.NewFlagSet("labels add", flag.ExitOnError)
+		ttl := addFlags.Duration("ttl", 0, "labels are removed after this time unless their lease is kept alive, prints ID of the new lease")
+		leaseID := addFlags.String("lease", "", "attach the labels to an existing lease")
 		labelsString := flag.Args()[2:]
+		if flag.Args()[1] == "add" {
+			addFlags.Parse(flag.Args()[2:])
+			labelsString = addFlags.Args()
+		}
+		if len(labelsString) == 0 {
+			fmt.Println("ERROR: no labels given")
+			os.Exit(2)
+		}
+
+		labels := server.Labels{}
 		for _, labelString := range labelsString {
 			labels = append(labels, server.Label(labelString))
 		}
 
-		if flag.Args()[1] == "add" {
+		if flag.Args()[1] == "add" && (*ttl != 0 || len(*leaseID) > 0) {
+			var lease server.Lease
+			var err error
+
+			if *ttl != 0 && len(*leaseID) > 0 {
+				fmt.Println("ERROR: --ttl and --lease can't be used together")
+				os.Exit(2)
+			} else if *ttl != 0 {
+				lease, err = client.GrantLease(*ttl, labels)
+			} else {
+				lease, err = client.AttachLabels(*leaseID, labels)
+			}
+			if err != nil {
+				fmt.Printf("ERROR: %v\n", err)
+				os.Exit(2)
+			}
+
+			if *jsonOutput {
+				printJSON(lease)
+			} else {
+				fmt.Println(lease.ID)
+			}
+		} else if flag.Args()[1] == "add" {
 			err := client.AddLabels(labels)
 			if err != nil {
 				fmt.Printf("ERROR: %v\n", err)
@@ -172,9 +329,64 @@ func main() {
 			os.Exit(2)
 		}
 
+	case "leases":
+		if len(flag.Args()) == 1 || flag.Arg(1) == "list" {
+			leases, err := client.Leases()
+			if err != nil {
+				fmt.Println(err)
+				os.Exit(1)
+			}
+
+			if *jsonOutput {
+				printJSON(leases)
+			} else {
+				printLeases(leases)
+			}
+			break
+		}
+
+		if len(flag.Args()) != 3 {
+			fmt.Println("ERROR: leases command needs lease ID")
+			fmt.Println("")
+			Usage()
+			os.Exit(2)
+		}
+
+		var err error
+		if flag.Arg(1) == "keepalive" {
+			_, err = client.KeepAliveLease(flag.Arg(2))
+		} else if flag.Arg(1) == "revoke" {
+			err = client.RevokeLease(flag.Arg(2))
+		} else {
+			fmt.Printf("ERROR: wrong leases subcommand\n\n")
+			Usage()
+			os.Exit(2)
+		}
+		if err != nil {
+			fmt.Printf("ERROR: %v\n", err)
+			os.Exit(2)
+		}
+
 	default:
 		Usage()
 		os.Exit(0)
 	}
 
 }
+
+// parseTimeArg returns time parsed from RFC 3339 format or time in the past if value is a duration, empty value returns zero time
+func parseTimeArg(value string) (time.Time, error) {
+	if len(value) == 0 {
+		return time.Time{}, nil
+	}
+
+	if duration, err := time.ParseDuration(value); err == nil {
+		return time.Now().Add(-duration), nil
+	}
+
+	parsed, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		return parsed, fmt.Errorf("time has to be in RFC 3339 format or a duration")
+	}
+	return parsed, nil
+}
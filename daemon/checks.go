@@ -0,0 +1,104 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"strings"
+
+	"github.com/by-cx/lobby/server"
+)
+
+// checks contains all health checks gating local labels
+var checks []*server.HealthCheck
+
+// loadChecks creates health checks from environment variables. Every check has one of CHECK_<NAME>_TCP,
+// CHECK_<NAME>_HTTP or CHECK_<NAME>_EXEC variables with its target, CHECK_<NAME>_LABELS and/or CHECK_<NAME>_FILES
+// with comma separated labels and label files it gates and optional CHECK_<NAME>_OPTIONS, e.g.
+// "interval=10s timeout=2s rise=2 fall=3 status=200 code=0".
+func loadChecks() ([]*server.HealthCheck, error) {
+	checks := []*server.HealthCheck{}
+
+	environment := environmentMap()
+	types := []string{server.CheckTCP, server.CheckHTTP, server.CheckExec}
+	suffixes := []string{}
+	for _, checkType := range types {
+		suffixes = append(suffixes, "_"+strings.ToUpper(checkType))
+	}
+
+	for _, name := range environmentNames(environment, "CHECK_", suffixes...) {
+		prefix := "CHECK_" + name + "_"
+		check := &server.HealthCheck{
+			Name:     strings.ToLower(name),
+			OnChange: onProviderChange,
+		}
+
+		for _, checkType := range types {
+			target, ok := environment[prefix+strings.ToUpper(checkType)]
+			if !ok {
+				continue
+			}
+			if len(check.Type) > 0 {
+				return checks, fmt.Errorf("check %s has more than one type", check.Name)
+			}
+			check.Type = checkType
+			check.Target = strings.TrimSpace(target)
+		}
+		if len(check.Target) == 0 {
+			return checks, fmt.Errorf("%s%s is empty", prefix, strings.ToUpper(check.Type))
+		}
+		if check.Type == server.CheckExec {
+			_, err := server.ParseCommand(check.Target)
+			if err != nil {
+				return checks, fmt.Errorf("%s%s: %v", prefix, strings.ToUpper(check.Type), err)
+			}
+		}
+
+		for _, label := range strings.Split(environment[prefix+"LABELS"], ",") {
+			label = strings.TrimSpace(label)
+			if len(label) > 0 {
+				check.Labels = append(check.Labels, server.Label(label))
+			}
+		}
+		for _, file := range strings.Split(environment[prefix+"FILES"], ",") {
+			file = strings.TrimSpace(file)
+			if len(file) > 0 {
+				check.Files = append(check.Files, file)
+			}
+		}
+		if len(check.Labels) == 0 && len(check.Files) == 0 {
+			return checks, fmt.Errorf("check %s doesn't gate any labels, set %sLABELS or %sFILES", check.Name, prefix, prefix)
+		}
+
+		err := check.SetOptions(environment[prefix+"OPTIONS"])
+		if err != nil {
+			return checks, fmt.Errorf("%sOPTIONS: %v", prefix, err)
+		}
+
+		checks = append(checks, check)
+	}
+
+	return checks, nil
+}
+
+// startChecks runs all health checks in background, their failures are logged
+func startChecks() {
+	errors := make(chan error)
+	go func() {
+		for err := range errors {
+			log.Println(err)
+		}
+	}()
+
+	for _, check := range checks {
+		check.Start(errors)
+	}
+}
+
+// checksStatus returns state of all health checks
+func checksStatus() []server.CheckStatus {
+	statuses := []server.CheckStatus{}
+	for _, check := range checks {
+		statuses = append(statuses, check.Status())
+	}
+	return statuses
+}
@@ -2,6 +2,7 @@ package main
 
 import (
 	"log"
+	"strings"
 
 	"github.com/by-cx/lobby/server"
 	"github.com/kelseyhightower/envconfig"
@@ -13,26 +14,48 @@ type Config struct {
 	Host                  string        `envconfig:"HOST" required:"false" default:"127.0.0.1"`                         // IP address used for the REST server to listen
 	Port                  uint16        `envconfig:"PORT" required:"false" default:"1313"`                              // Port related to the address above
 	DisableAPI            bool          `envconfig:"DISABLE_API" required:"false" default:"false"`                      // If true API interface won't start
-	Driver                string        `envconfig:"DRIVER" required:"false" default:"NATS"`                            // Select driver to use to communicate with the group of nodes. The possible values are NATS and Redis
+	Drivers               []string      `envconfig:"DRIVER" required:"false" default:"NATS"`                            // Select drivers to use to communicate with the group of nodes. The possible values are NATS, NATS-KV and Redis, more drivers can be separated by comma
 	NATSURL               string        `envconfig:"NATS_URL" required:"false"`                                         // NATS URL used to connect to the NATS server
 	NATSDiscoveryChannel  string        `envconfig:"NATS_DISCOVERY_CHANNEL" required:"false" default:"lobby.discovery"` // Channel where the kepp alive packets are sent
+	NATSKVBucket          string        `envconfig:"NATS_KV_BUCKET" required:"false" default:"lobby"`                   // JetStream key-value bucket where NATS-KV driver stores the discovery packets
 	RedisHost             string        `envconfig:"REDIS_HOST" required:"false" default:"127.0.0.1"`                   // Redis host
 	RedisPort             uint16        `envconfig:"REDIS_PORT" required:"false" default:"6379"`                        // Redis port
 	RedisDB               uint          `envconfig:"REDIS_DB" required:"false" default:"0"`                             // Redis DB
 	RedisChannel          string        `envconfig:"REDIS_CHANNEL" required:"false" default:"lobby:discovery"`          // Redis channel
 	RedisPassword         string        `envconfig:"REDIS_PASSWORD" required:"false" default:""`                        // Redis password
-	Labels                server.Labels `envconfig:"LABELS" required:"false" default:""`                                // List of labels
+	Labels                server.Labels `envconfig:"LABELS" required:"false" default:""`                                // List of labels separated by comma, a label can be quoted by double quotes, see server.ParseLabelsList
 	LabelsPath            string        `envconfig:"LABELS_PATH" required:"false" default:"/etc/lobby/labels"`          // Path where filesystem based labels are located
-	RuntimeLabelsFilename string        `envconfig:"RUNTIME_LABELS_FILENAME" required:"false" default:"_runtime"`       // Filename for file created in LabelsPath where runtime labels will be added
+	LabelsFiles           []string      `envconfig:"LABELS_FILES" required:"false" default:""`                          // Patterns of files in LabelsPath that are loaded, e.g. *.labels,*.yaml, empty means all files
+	WatchLabels           bool          `envconfig:"WATCH_LABELS" required:"false" default:"true"`                      // If true changes in LabelsPath are detected via inotify and sent to other nodes immediately
+	WatchLabelsDebounce   uint          `envconfig:"WATCH_LABELS_DEBOUNCE" required:"false" default:"200"`              // How long to wait for more changes in LabelsPath before the discovery packet is sent [ms]
+	SystemFacts           []string      `envconfig:"SYSTEM_FACTS" required:"false" default:""`                          // Which system facts are published as sys: labels, "all" means all of them
+	CloudMetadata         string        `envconfig:"CLOUD_METADATA" required:"false" default:""`                        // Publish cloud instance metadata as cloud: labels, possible values are auto, aws, gcp and openstack, empty disables it
+	CloudMetadataURL      string        `envconfig:"CLOUD_METADATA_URL" required:"false" default:""`                    // Base URL of the metadata service, default is http://169.254.169.254
+	CloudMetadataInterval uint          `envconfig:"CLOUD_METADATA_INTERVAL" required:"false" default:"300"`            // How often the cloud metadata are refreshed [secs]
+	ProvidersPath         string        `envconfig:"PROVIDERS_PATH" required:"false" default:"/etc/lobby/providers.d"`  // Directory with executables that print labels, one per line
+	RuntimeLabelsFilename string        `envconfig:"RUNTIME_LABELS_FILENAME" required:"false" default:"_runtime"`       // Filename in LabelsPath where older versions stored runtime labels, it's migrated into StatePath on start
+	StatePath             string        `envconfig:"STATE_PATH" required:"false" default:"/var/lib/lobby"`              // Directory where runtime labels are stored
 	HostName              string        `envconfig:"HOSTNAME" required:"false"`                                         // Overrise local machine's hostname
+	Namespace             string        `envconfig:"NAMESPACE" required:"false" default:"default"`                      // Namespace (environment) this node belongs to, e.g. prod or staging
+	InstanceID            string        `envconfig:"INSTANCE_ID" required:"false" default:""`                           // Persistent ID of this node, if empty it's read from /etc/machine-id or from INSTANCE_ID_FILE
+	InstanceIDFile        string        `envconfig:"INSTANCE_ID_FILE" required:"false" default:""`                      // File where generated instance ID is stored when /etc/machine-id doesn't exist, default is /var/lib/lobby/instance_id
+	WatchNamespaces       []string      `envconfig:"WATCH_NAMESPACES" required:"false" default:""`                      // Namespaces this node accepts discovery packets from, empty means only its own namespace and * means all of them
 	CleanEvery            uint          `envconfig:"CLEAN_EVERY" required:"false" default:"15"`                         // How often to clean the list of servers to get rid of the not alive ones
 	KeepAlive             uint          `envconfig:"KEEP_ALIVE" required:"false" default:"5"`                           // how often to send the keepalive message with all availabel information [secs]
-	TTL                   uint          `envconfig:"TTL" required:"false" default:"30"`                                 // After how many secs is discovery record considered as invalid
+	TTL                   uint          `envconfig:"TTL" required:"false" default:"30"`                                 // After how many secs is discovery record considered as invalid, it's advertised to other nodes and used for nodes that don't advertise their own TTL
+	MinTTL                uint          `envconfig:"MIN_TTL" required:"false" default:"10"`                             // Lower bound for TTL advertised by other nodes
+	MaxTTL                uint          `envconfig:"MAX_TTL" required:"false" default:"600"`                            // Upper bound for TTL advertised by other nodes
+	DisconnectedGrace     uint          `envconfig:"DISCONNECTED_GRACE" required:"false" default:"0"`                   // How long other servers don't expire while this node is disconnected from the bus [secs], 0 means until it's connected again
 	NodeExporterPort      uint          `envconfig:"NODE_EXPORTER_PORT" required:"false" default:"9100"`                // Default port where node_exporter listens on all registered servers
 	Register              bool          `envconfig:"REGISTER" required:"false" default:"true"`                          // If true (default) then local instance is registered with other instance (discovery packet is sent regularly)
 	Callback              string        `envconfig:"CALLBACK" required:"false" default:""`                              // path to a script that runs when the is a change in the labels database
 	CallbackCooldown      uint          `envconfig:"CALLBACK_COOLDOWN" required:"false" default:"15"`                   // cooldown that prevents to run the config change script too many times in row
+	CallbackFormat        string        `envconfig:"CALLBACK_FORMAT" required:"false" default:"discoveries"`            // What the callback gets on stdin, "discoveries" is list of all discoveries, "changes" adds also the changes since the last run
 	CallbackFirstRunDelay uint          `envconfig:"CALLBACK_FIRST_RUN_DELAY" required:"false" default:"30"`            // Wait for this amount of seconds before callback is run for first time after fresh start of the daemon
+	StateFile             string        `envconfig:"STATE_FILE" required:"false" default:""`                            // File where discovered servers are saved so they are available right after restart, if empty the state is not saved
+	StateSaveEvery        uint          `envconfig:"STATE_SAVE_EVERY" required:"false" default:"30"`                    // How often to save the state file [secs]
+	HistorySize           int           `envconfig:"HISTORY_SIZE" required:"false" default:"1000"`                      // How many membership events are kept in the history
+	HistoryFile           string        `envconfig:"HISTORY_FILE" required:"false" default:""`                          // File where the history is stored so it survives restarts, if empty the history is kept only in memory
 }
 
 // GetConfig return configuration created based on environment variables
@@ -44,12 +67,56 @@ func GetConfig() *Config {
 		log.Fatal(err.Error())
 	}
 
-	if config.Driver != "Redis" && config.Driver != "NATS" {
-		log.Fatal("ERROR: the only supported drivers are Redis and NATS (default)")
+	usedDrivers := make(map[string]bool)
+	for _, driver := range config.Drivers {
+		if driver != "Redis" && driver != "NATS" && driver != "NATS-KV" {
+			log.Fatal("ERROR: the only supported drivers are Redis, NATS (default) and NATS-KV")
+		}
+		if usedDrivers[driver] {
+			log.Fatalf("ERROR: driver %s is used more than once", driver)
+		}
+		usedDrivers[driver] = true
+	}
+	if len(config.Drivers) == 0 {
+		log.Fatal("ERROR: at least one driver has to be set")
+	}
+
+	if (usedDrivers["NATS"] || usedDrivers["NATS-KV"]) && len(config.NATSURL) == 0 {
+		log.Fatal("ERROR: NATS_URL cannot be empty when driver is set to NATS or NATS-KV")
+	}
+	if usedDrivers["NATS-KV"] && config.MaxTTL == 0 {
+		log.Fatal("ERROR: MAX_TTL has to be set when driver is set to NATS-KV, it's used as TTL of the bucket")
+	}
+
+	if config.CallbackFormat != "discoveries" && config.CallbackFormat != "changes" {
+		log.Fatal("ERROR: CALLBACK_FORMAT can be only discoveries or changes")
+	}
+
+	if len(config.SystemFacts) == 1 && config.SystemFacts[0] == "all" {
+		config.SystemFacts = server.SystemFactNames
+	}
+	for _, fact := range config.SystemFacts {
+		if !server.IsValidSystemFact(fact) {
+			log.Fatalf("ERROR: unknown system fact %s in SYSTEM_FACTS, supported facts are: %s", fact, strings.Join(server.SystemFactNames, ", "))
+		}
+	}
+
+	if len(config.CloudMetadata) > 0 && !server.IsValidCloud(config.CloudMetadata) {
+		log.Fatal("ERROR: CLOUD_METADATA can be only auto, aws, gcp or openstack")
+	}
+
+	for _, label := range config.Labels {
+		if err := label.ReservedPrefixError(); err != nil {
+			log.Fatalf("ERROR: label %s in LABELS can't be used, %v", label, err)
+		}
+	}
+
+	if !server.IsValidNamespace(config.Namespace) {
+		log.Fatal("ERROR: NAMESPACE can contain only lowercase letters, digits, dashes and underscores")
 	}
 
-	if config.Driver == "NATS" && len(config.NATSURL) == 0 {
-		log.Fatal("ERROR: NATS_URL cannot be empty when driver is set to NATS")
+	if config.TTL <= config.KeepAlive {
+		log.Println("WARNING: TTL should be higher than KEEP_ALIVE otherwise other nodes will consider this one dead between keep alive packets")
 	}
 
 	return &config
@@ -4,19 +4,81 @@ import (
 	"fmt"
 	"io/ioutil"
 	"net/http"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/by-cx/lobby/server"
 	"github.com/labstack/echo"
 )
 
+// discoveryResponse is the discovery packet how it's returned by the API
+type discoveryResponse struct {
+	server.Discovery
+	LabelsMap map[string][]string `json:"labels_map,omitempty"` // labels grouped by their keys, only when labels_map query parameter is true
+	ExpiresAt int64               `json:"expires_at,omitempty"` // unix timestamp when the server will be considered dead without another keep alive packet
+
+	ConflictingInstances []string `json:"conflicting_instances,omitempty"` // instance IDs announcing the same hostname, only when there is a conflict
+
+	LabelSources []server.SourcedLabel   `json:"label_sources,omitempty"` // where the local labels come from, only for local discovery with verbose query parameter
+	Providers    []server.ProviderStatus `json:"providers,omitempty"`     // status of the label providers, only for local discovery with verbose query parameter
+	Checks       []server.CheckStatus    `json:"checks,omitempty"`        // state of the health checks gating local labels, only for local discovery
+}
+
+// newDiscoveryResponse prepares discovery for the output based on query parameters of the request
+func newDiscoveryResponse(c echo.Context, discovery server.Discovery) discoveryResponse {
+	response := discoveryResponse{
+		Discovery: discovery,
+	}
+
+	// Local discovery packet doesn't have last check
+	if discovery.LastCheck > 0 {
+		response.ExpiresAt = discoveryStorage.ExpiresAt(discovery)
+		response.ConflictingInstances = discoveryStorage.ConflictingInstances(discovery.Namespace, discovery.Hostname)
+	}
+
+	if isTrue(c.QueryParam("labels_map")) {
+		response.LabelsMap = discovery.Labels.Map()
+	}
+
+	return response
+}
+
+// newDiscoveryResponses is the same as newDiscoveryResponse but for multiple discoveries
+func newDiscoveryResponses(c echo.Context, discoveries []server.Discovery) []discoveryResponse {
+	responses := []discoveryResponse{}
+
+	for _, discovery := range discoveries {
+		responses = append(responses, newDiscoveryResponse(c, discovery))
+	}
+
+	return responses
+}
+
+// isTrue returns true if query parameter value means true
+func isTrue(value string) bool {
+	parsed, err := strconv.ParseBool(value)
+	return err == nil && parsed
+}
+
 func listHandler(c echo.Context) error {
+	query := c.QueryParam("q")
 	labels := c.QueryParam("labels")
 	prefixes := c.QueryParam("prefixes")
 
 	var discoveries []server.Discovery
 
-	if len(labels) > 0 {
+	if countNonEmpty(query, labels, prefixes) > 1 {
+		return c.String(http.StatusBadRequest, "only one of q, labels and prefixes parameters can be used\n")
+	}
+
+	if len(query) > 0 {
+		parsedQuery, err := server.ParseQuery(query)
+		if err != nil {
+			return c.String(http.StatusBadRequest, fmt.Sprintf("query error: %v\n", err))
+		}
+		discoveries = discoveryStorage.FilterQuery(parsedQuery)
+	} else if len(labels) > 0 {
 		labelsFilterSlice := strings.Split(labels, ",")
 		discoveries = discoveryStorage.Filter(labelsFilterSlice)
 	} else if len(prefixes) > 0 {
@@ -25,38 +87,148 @@ func listHandler(c echo.Context) error {
 		discoveries = discoveryStorage.GetAll()
 	}
 
-	return c.JSONPretty(200, discoveries, "  ")
+	discoveries = filterNamespaces(c, discoveries)
+
+	return c.JSONPretty(200, newDiscoveryResponses(c, discoveries), "  ")
 }
 
-// resolveHandler returns hostname(s) based on another label
+// resolveHandler returns hostname(s) based on another label or a query
 func resolveHandler(c echo.Context) error {
 	label := c.QueryParam("label") // This is label we will use to filter discovery packets
+	query := c.QueryParam("q")
 
 	output := []string{}
 
-	discoveries := discoveryStorage.Filter([]string{label})
-	for _, discovery := range discoveries {
+	if countNonEmpty(query, label) > 1 {
+		return c.String(http.StatusBadRequest, "only one of q and label parameters can be used\n")
+	}
+
+	var discoveries []server.Discovery
+	if len(query) > 0 {
+		parsedQuery, err := server.ParseQuery(query)
+		if err != nil {
+			return c.String(http.StatusBadRequest, fmt.Sprintf("query error: %v\n", err))
+		}
+		discoveries = discoveryStorage.FilterQuery(parsedQuery)
+	} else {
+		discoveries = discoveryStorage.Filter([]string{label})
+	}
+
+	for _, discovery := range filterNamespaces(c, discoveries) {
 		output = append(output, discovery.Hostname)
 	}
 
 	return c.JSONPretty(http.StatusOK, output, "  ")
 }
 
+// filterNamespaces returns only discoveries from namespaces in namespace query parameter (comma separated), all of them if it's empty
+func filterNamespaces(c echo.Context, discoveries []server.Discovery) []server.Discovery {
+	namespaces := c.QueryParam("namespace")
+	if len(namespaces) == 0 {
+		return discoveries
+	}
+
+	return server.InNamespaces(discoveries, strings.Split(namespaces, ","))
+}
+
+// countNonEmpty returns number of non-empty parameters
+func countNonEmpty(params ...string) int {
+	count := 0
+	for _, param := range params {
+		if len(param) > 0 {
+			count++
+		}
+	}
+	return count
+}
+
 func prometheusHandler(c echo.Context) error {
 	name := c.Param("name")
 
-	services := preparePrometheusOutput(name, discoveryStorage.GetAll())
+	services := preparePrometheusOutput(name, filterNamespaces(c, discoveryStorage.GetAll()))
 
 	return c.JSONPretty(http.StatusOK, services, "  ")
 }
 
+// historyHandler returns membership events filtered by hostname, time range and label selector query
+func historyHandler(c echo.Context) error {
+	filter := server.HistoryFilter{
+		Namespace: c.QueryParam("namespace"),
+		Hostname:  c.QueryParam("hostname"),
+	}
+
+	var err error
+
+	if since := c.QueryParam("since"); len(since) > 0 {
+		filter.Since, err = parseTime(since)
+		if err != nil {
+			return c.String(http.StatusBadRequest, fmt.Sprintf("since parameter error: %v\n", err))
+		}
+	}
+
+	if until := c.QueryParam("until"); len(until) > 0 {
+		filter.Until, err = parseTime(until)
+		if err != nil {
+			return c.String(http.StatusBadRequest, fmt.Sprintf("until parameter error: %v\n", err))
+		}
+	}
+
+	if query := c.QueryParam("q"); len(query) > 0 {
+		filter.Query, err = server.ParseQuery(query)
+		if err != nil {
+			return c.String(http.StatusBadRequest, fmt.Sprintf("query error: %v\n", err))
+		}
+	}
+
+	return c.JSONPretty(http.StatusOK, history.Find(filter), "  ")
+}
+
+// parseTime returns time from unix timestamp or RFC 3339 formatted string
+func parseTime(value string) (time.Time, error) {
+	if timestamp, err := strconv.ParseInt(value, 10, 64); err == nil {
+		return time.Unix(timestamp, 0), nil
+	}
+
+	parsed, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		return parsed, fmt.Errorf("time has to be unix timestamp or in RFC 3339 format")
+	}
+	return parsed, nil
+}
+
+// conflictsHandler returns hostnames announced by more than one instance
+func conflictsHandler(c echo.Context) error {
+	conflicts := []server.Conflict{}
+
+	namespaces := c.QueryParam("namespace")
+	for _, conflict := range discoveryStorage.Conflicts() {
+		if len(namespaces) == 0 || server.InNamespace(conflict.Namespace, strings.Split(namespaces, ",")) {
+			conflicts = append(conflicts, conflict)
+		}
+	}
+
+	return c.JSONPretty(http.StatusOK, conflicts, "  ")
+}
+
 func getIdentificationHandler(c echo.Context) error {
 	discovery, err := localHost.GetIdentification()
 	if err != nil {
 		return c.String(http.StatusInternalServerError, fmt.Sprintf("gathering identification info error: %v\n", err))
 	}
 
-	return c.JSONPretty(http.StatusOK, discovery, "  ")
+	response := newDiscoveryResponse(c, discovery)
+	if len(checks) > 0 {
+		response.Checks = checksStatus()
+	}
+	if isTrue(c.QueryParam("verbose")) {
+		response.LabelSources, err = localHost.LabelSources()
+		if err != nil {
+			return c.String(http.StatusInternalServerError, fmt.Sprintf("gathering label sources error: %v\n", err))
+		}
+		response.Providers = providersStatus()
+	}
+
+	return c.JSONPretty(http.StatusOK, response, "  ")
 }
 
 func addLabelsHandler(c echo.Context) error {
@@ -65,10 +237,33 @@ func addLabelsHandler(c echo.Context) error {
 		return c.String(http.StatusBadRequest, fmt.Sprintf("reading request body error: %v\n", err))
 	}
 
-	labels := server.Labels{}
+	labels, err := parseLabelsBody(body)
+	if err != nil {
+		return c.String(http.StatusBadRequest, err.Error())
+	}
 
-	for _, label := range strings.Split(string(body), "\n") {
-		labels = append(labels, server.Label(label))
+	// Labels with ttl get their own lease, labels with lease are attached to an existing one
+	ttl, err := parseTTLParam(c)
+	if err != nil {
+		return c.String(http.StatusBadRequest, err.Error()+"\n")
+	}
+	if ttl > 0 && len(c.QueryParam("lease")) > 0 {
+		return c.String(http.StatusBadRequest, "ttl and lease query parameters can't be used together\n")
+	}
+	if ttl > 0 || len(c.QueryParam("lease")) > 0 {
+		var lease server.Lease
+		if ttl > 0 {
+			lease, err = localHost.GrantLease(ttl, labels)
+		} else {
+			lease, err = localHost.AttachLabels(c.QueryParam("lease"), labels)
+		}
+		if err != nil {
+			return leaseErrorResponse(c, err)
+		}
+
+		onLeaseChange(lease)
+
+		return c.JSONPretty(http.StatusOK, lease, "  ")
 	}
 
 	err = localHost.AddLabels(labels)
@@ -89,14 +284,16 @@ func deleteLabelsHandler(c echo.Context) error {
 		return c.String(http.StatusBadRequest, fmt.Sprintf("reading request body error: %v\n", err))
 	}
 
-	labels := server.Labels{}
-
-	for _, label := range strings.Split(string(body), "\n") {
-		labels = append(labels, server.Label(label))
+	labels, err := parseLabelsBody(body)
+	if err != nil {
+		return c.String(http.StatusBadRequest, err.Error())
 	}
 
 	err = localHost.DeleteLabels(labels)
 
+	if _, ok := err.(*server.NotRuntimeLabelsError); ok {
+		return c.String(http.StatusConflict, err.Error()+"\n")
+	}
 	if err != nil {
 		return c.String(http.StatusBadRequest, err.Error())
 	}
@@ -106,3 +303,24 @@ func deleteLabelsHandler(c echo.Context) error {
 
 	return c.String(http.StatusOK, "OK")
 }
+
+// parseLabelsBody returns labels from request body, one label per line. Empty lines are skipped.
+func parseLabelsBody(body []byte) (server.Labels, error) {
+	labels := server.Labels{}
+
+	for _, line := range strings.Split(string(body), "\n") {
+		label := server.Label(strings.TrimSpace(line))
+		if len(label) == 0 {
+			continue
+		}
+
+		err := label.Validate()
+		if err != nil {
+			return labels, err
+		}
+
+		labels = append(labels, label)
+	}
+
+	return labels, nil
+}
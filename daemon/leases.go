@@ -0,0 +1,111 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/by-cx/lobby/server"
+	"github.com/labstack/echo"
+)
+
+// expireLeasesLoop removes expired leases and sends the discovery packet without their labels
+func expireLeasesLoop() {
+	for !shuttingDown {
+		time.Sleep(time.Second)
+
+		expired := localHost.ExpireLeases()
+		for _, lease := range expired {
+			log.Printf("Lease %s has expired, withdrawing labels %v\n", lease.ID, lease.Labels.StringSlice())
+		}
+		if len(expired) > 0 {
+			onProviderChange()
+		}
+	}
+}
+
+// onLeaseChange sends the discovery packet right away when a lease adds or withdraws labels.
+// Standalone node doesn't send any packets so nothing would receive the trigger.
+func onLeaseChange(lease server.Lease) {
+	if len(lease.Labels) > 0 && config.Register && !shuttingDown {
+		sendDiscoveryPacket()
+	}
+}
+
+// parseTTLParam returns the ttl query parameter in seconds as a duration, zero if it's not set
+func parseTTLParam(c echo.Context) (time.Duration, error) {
+	value := c.QueryParam("ttl")
+	if len(value) == 0 {
+		return 0, nil
+	}
+
+	ttl, err := strconv.ParseUint(value, 10, 32)
+	if err != nil || ttl == 0 {
+		return 0, fmt.Errorf("ttl has to be a positive number of seconds")
+	}
+	return time.Duration(ttl) * time.Second, nil
+}
+
+// leaseErrorResponse returns 404 if the lease doesn't exist and 400 for other errors
+func leaseErrorResponse(c echo.Context, err error) error {
+	if _, ok := err.(*server.LeaseNotFoundError); ok {
+		return c.String(http.StatusNotFound, err.Error()+"\n")
+	}
+	return c.String(http.StatusBadRequest, err.Error()+"\n")
+}
+
+func listLeasesHandler(c echo.Context) error {
+	return c.JSONPretty(http.StatusOK, localHost.Leases(), "  ")
+}
+
+func grantLeaseHandler(c echo.Context) error {
+	ttl, err := parseTTLParam(c)
+	if err != nil {
+		return c.String(http.StatusBadRequest, err.Error()+"\n")
+	}
+	if ttl == 0 {
+		return c.String(http.StatusBadRequest, "ttl query parameter is required\n")
+	}
+
+	body, err := ioutil.ReadAll(c.Request().Body)
+	if err != nil {
+		return c.String(http.StatusBadRequest, fmt.Sprintf("reading request body error: %v\n", err))
+	}
+
+	labels, err := parseLabelsBody(body)
+	if err != nil {
+		return c.String(http.StatusBadRequest, err.Error())
+	}
+
+	lease, err := localHost.GrantLease(ttl, labels)
+	if err != nil {
+		return leaseErrorResponse(c, err)
+	}
+
+	onLeaseChange(lease)
+
+	return c.JSONPretty(http.StatusOK, lease, "  ")
+}
+
+func keepAliveLeaseHandler(c echo.Context) error {
+	lease, err := localHost.KeepAliveLease(c.Param("id"))
+	if err != nil {
+		return leaseErrorResponse(c, err)
+	}
+
+	return c.JSONPretty(http.StatusOK, lease, "  ")
+}
+
+func revokeLeaseHandler(c echo.Context) error {
+	lease, err := localHost.RevokeLease(c.Param("id"))
+	if err != nil {
+		return leaseErrorResponse(c, err)
+	}
+
+	onLeaseChange(lease)
+
+	return c.JSONPretty(http.StatusOK, lease, "  ")
+}
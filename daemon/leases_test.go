@@ -0,0 +1,41 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/labstack/echo"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLeaseHandlersStandalone(t *testing.T) {
+	originalRegister := config.Register
+	defer func() {
+		config.Register = originalRegister
+	}()
+	config.Register = false
+
+	// Nothing reads the packet trigger in standalone mode, the handler must not wait for it
+	done := make(chan *httptest.ResponseRecorder)
+	go func() {
+		request := httptest.NewRequest(http.MethodPost, "/v1/leases?ttl=30", strings.NewReader("lease:test\n"))
+		recorder := httptest.NewRecorder()
+		grantLeaseHandler(echo.New().NewContext(request, recorder))
+		done <- recorder
+	}()
+
+	select {
+	case recorder := <-done:
+		assert.Equal(t, http.StatusOK, recorder.Code)
+	case <-time.After(5 * time.Second):
+		t.Fatal("lease handler is blocked")
+	}
+
+	for _, lease := range localHost.Leases() {
+		_, err := localHost.RevokeLease(lease.ID)
+		assert.Nil(t, err)
+	}
+}
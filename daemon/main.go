@@ -10,7 +10,9 @@ import (
 	"time"
 
 	"github.com/by-cx/lobby/common"
+	"github.com/by-cx/lobby/multi_driver"
 	"github.com/by-cx/lobby/nats_driver"
+	"github.com/by-cx/lobby/nats_kv_driver"
 	"github.com/by-cx/lobby/redis_driver"
 	"github.com/by-cx/lobby/server"
 	"github.com/labstack/echo"
@@ -18,13 +20,17 @@ import (
 )
 
 var discoveryStorage server.Discoveries = server.Discoveries{}
+var history server.History
 var driver common.Driver
 var localHost server.LocalHost
 var lastLocalHostname string
 
 var config Config
 
+const defaultInstanceIDFile = "/var/lib/lobby/instance_id"
+
 var shuttingDown bool
+var driverWasConnected bool
 var sendDiscoveryPacketTrigger chan bool = make(chan bool)
 
 func init() {
@@ -34,35 +40,126 @@ func init() {
 	// Setup discovery storage
 	discoveryStorage.LogChannel = make(chan string)
 	discoveryStorage.TTL = config.TTL
+	discoveryStorage.MinTTL = config.MinTTL
+	discoveryStorage.MaxTTL = config.MaxTTL
+	discoveryStorage.DisconnectedGrace = config.DisconnectedGrace
+	if len(config.WatchNamespaces) == 0 {
+		discoveryStorage.Namespaces = []string{config.Namespace}
+	} else if !(len(config.WatchNamespaces) == 1 && config.WatchNamespaces[0] == "*") {
+		discoveryStorage.Namespaces = config.WatchNamespaces
+	}
+
+	// Setup history of the discovery storage
+	history.Size = config.HistorySize
+	history.Filename = config.HistoryFile
+
+	// Stable identity of this node so other nodes can detect two servers with the same hostname
+	var err error
+	instanceID := config.InstanceID
+	if len(instanceID) == 0 {
+		instanceIDFile := config.InstanceIDFile
+		if len(instanceIDFile) == 0 {
+			instanceIDFile = defaultInstanceIDFile
+		}
+		instanceID, err = server.LoadInstanceID(server.MachineIDFile, instanceIDFile)
+		if err != nil {
+			log.Printf("instance ID error, hostname conflicts won't be detected for this node: %v\n", err)
+		}
+	}
+
+	providers, err = loadProviders()
+	if err != nil {
+		log.Fatalf("label providers error: %v\n", err)
+	}
+	checks, err = loadChecks()
+	if err != nil {
+		log.Fatalf("health checks error: %v\n", err)
+	}
+
+	labelProviders := []server.LabelProvider{}
+	if len(config.SystemFacts) > 0 {
+		labelProviders = append(labelProviders, &server.SystemFacts{Facts: config.SystemFacts, LogChannel: discoveryStorage.LogChannel})
+	}
+	for _, provider := range providers {
+		labelProviders = append(labelProviders, provider)
+	}
 
 	// localhost initiation
 	localHost = server.LocalHost{
+		Providers:             labelProviders,
+		Checks:                checks,
 		LabelsPath:            config.LabelsPath,
 		HostnameOverride:      config.HostName,
+		Namespace:             config.Namespace,
+		InstanceID:            instanceID,
 		InitialLabels:         config.Labels,
 		RuntimeLabelsFilename: config.RuntimeLabelsFilename,
+		StatePath:             config.StatePath,
+		LabelsFilesPatterns:   config.LabelsFiles,
+		TTL:                   config.TTL,
+		KeepAlive:             config.KeepAlive,
+
+		LogChannel: discoveryStorage.LogChannel,
+	}
+
+	// Runtime labels used to be stored in LabelsPath. The old file is ignored when labels are loaded, so
+	// lobbyd can't run without the migration, its runtime labels would silently disappear otherwise.
+	migrated, err := localHost.MigrateRuntimeLabels()
+	if err != nil {
+		log.Fatalf("ERROR: runtime labels migration from %s into %s error: %v", config.RuntimeLabelsFilename, config.StatePath, err)
+	} else if migrated > 0 {
+		log.Printf("%d runtime labels migrated from %s into %s\n", migrated, config.RuntimeLabelsFilename, config.StatePath)
 	}
 
-	// Setup driver
-	if config.Driver == "NATS" {
-		driver = &nats_driver.Driver{
-			NATSUrl:              config.NATSURL,
-			NATSDiscoveryChannel: config.NATSDiscoveryChannel,
+	// Broken labels file is only skipped later, so a mistake made before the start is reported right away
+	err = localHost.CheckLabelsFiles()
+	if err != nil {
+		log.Fatalf("ERROR: %v", err)
+	}
 
-			LogChannel: discoveryStorage.LogChannel,
+	// Setup drivers, with more of them every packet is sent via all of them
+	drivers := []common.Driver{}
+	for _, driverName := range config.Drivers {
+		if driverName == "NATS" {
+			drivers = append(drivers, &nats_driver.Driver{
+				NATSUrl:              config.NATSURL,
+				NATSDiscoveryChannel: config.NATSDiscoveryChannel,
+
+				LogChannel: discoveryStorage.LogChannel,
+			})
+		} else if driverName == "NATS-KV" {
+			drivers = append(drivers, &nats_kv_driver.Driver{
+				NATSUrl: config.NATSURL,
+				Bucket:  config.NATSKVBucket,
+				// Bucket has a single TTL for all packets so it has to fit the longest TTL accepted from other nodes
+				TTL: time.Duration(config.MaxTTL) * time.Second,
+				// Packets of dead nodes still stored in the bucket are not restored as alive
+				EffectiveTTL: discoveryStorage.EffectiveTTL,
+
+				LogChannel: discoveryStorage.LogChannel,
+			})
+		} else if driverName == "Redis" {
+			drivers = append(drivers, &redis_driver.Driver{
+				Host:     config.RedisHost,
+				Port:     uint(config.RedisPort),
+				Password: config.RedisPassword,
+				Channel:  config.RedisChannel,
+				DB:       uint(config.RedisDB),
+
+				LogChannel: discoveryStorage.LogChannel,
+			})
+		} else {
+			log.Fatalf("unsupported driver %s", driverName)
 		}
-	} else if config.Driver == "Redis" {
-		driver = &redis_driver.Driver{
-			Host:     config.RedisHost,
-			Port:     uint(config.RedisPort),
-			Password: config.RedisPassword,
-			Channel:  config.RedisChannel,
-			DB:       uint(config.RedisDB),
+	}
+	if len(drivers) == 1 {
+		driver = drivers[0]
+	} else {
+		driver = &multi_driver.Driver{
+			Drivers: drivers,
 
 			LogChannel: discoveryStorage.LogChannel,
 		}
-	} else {
-		log.Fatalf("unsupported driver %s", config.Driver)
 	}
 
 }
@@ -76,6 +173,26 @@ func cleanDiscoveryPool() {
 
 }
 
+// saveState saves the discovery storage into the state file if it's configured
+func saveState() {
+	if len(config.StateFile) == 0 {
+		return
+	}
+
+	err := discoveryStorage.SaveState(config.StateFile)
+	if err != nil {
+		log.Printf("saving state error: %v\n", err)
+	}
+}
+
+// saveStateLoop saves the discovery storage regularly so it can be restored after restart
+func saveStateLoop() {
+	for {
+		time.Sleep(time.Duration(config.StateSaveEvery) * time.Second)
+		saveState()
+	}
+}
+
 // sendGoodbyePacket is almost same as sendDiscoveryPacket but it's not running in loop
 // and it adds goodbye message so other nodes know this node is gonna die.
 func sendGoodbyePacket() {
@@ -110,6 +227,13 @@ func sendDiscoveryPacketTask(trigger chan bool) {
 				log.Printf("sending discovery identification error: %v\n", err)
 			}
 
+			// Other nodes would drop invalid packet anyway
+			err = discovery.Validate()
+			if err != nil {
+				log.Printf("local discovery packet is invalid, not sending it: %v\n", err)
+				continue
+			}
+
 			err = driver.SendDiscoveryPacket(discovery)
 			if err != nil {
 				log.Println(err.Error())
@@ -119,7 +243,9 @@ func sendDiscoveryPacketTask(trigger chan bool) {
 			if discovery.Hostname != lastLocalHostname && lastLocalHostname != "" {
 				log.Println("Hostname change detected, deregistering the old one")
 				err = driver.SendGoodbyePacket(server.Discovery{
-					Hostname: lastLocalHostname,
+					Namespace:  discovery.Namespace,
+					Hostname:   lastLocalHostname,
+					InstanceID: discovery.InstanceID,
 				})
 				if err != nil {
 					log.Println(err)
@@ -133,6 +259,23 @@ func sendDiscoveryPacketTask(trigger chan bool) {
 	}
 }
 
+// onDriverStateChange logs the connection state of the driver. While the driver is disconnected the discovery storage
+// is marked as stale so other servers don't expire. After reconnect the full discovery packet is sent right away
+// because other nodes could have missed the packets sent during the outage.
+func onDriverStateChange(state common.ConnectionState) {
+	log.Printf("driver is %s\n", state)
+	discoveryStorage.SetConnected(state == common.StateConnected)
+
+	if state != common.StateConnected {
+		return
+	}
+	if driverWasConnected && config.Register && !shuttingDown {
+		// The driver may call this during its Init before the sending task is running
+		go sendDiscoveryPacket()
+	}
+	driverWasConnected = true
+}
+
 // Print logs acquired from disovery storage
 func printDiscoveryLogs() {
 	for {
@@ -154,44 +297,48 @@ func main() {
 
 	// Setup callback function to register and unregister discovery packets from other servers
 	driver.RegisterSubscribeFunction(func(d server.Discovery) {
-		// Check if the local version and the new version are somehowe changed
-		localVersion := discoveryStorage.Get(d.Hostname)
-		exists := discoveryStorage.Exist(d.Hostname)
-		changed := server.Compare(localVersion, d)
-
 		discoveryStorage.Add(d)
-
-		if changed {
-			// Print this only if the server is already registered
-			if exists {
-				log.Printf("%s has been updated", d.Hostname)
-			}
-
-			go func() {
-				err = discoveryChange(d)
-				if err != nil {
-					log.Printf("discovery changed error: %v", err)
-				}
-			}()
-		}
-
 	})
 	driver.RegisterUnsubscribeFunction(func(d server.Discovery) {
-		discoveryStorage.Delete(d.Hostname)
-		go func() {
-			err = discoveryChange(d)
-			if err != nil {
-				log.Printf("discovery changed error: %v", err)
-			}
-		}()
+		discoveryStorage.Goodbye(d)
 	})
+	driver.RegisterRejectFunction(func(reason string, err error) {
+		rejectedPackets.Inc(reason)
+	})
+	driver.RegisterStateFunction(onDriverStateChange)
+
+	// Changes in the storage are processed in background, subscription has to exist before first packet arrives
+	events, cancelEvents := discoveryStorage.Subscribe()
+	defer cancelEvents()
+	go processDiscoveryEvents(events)
+
+	err = history.Load()
+	if err != nil {
+		log.Printf("loading history error: %v\n", err)
+	}
+	defer history.Close()
+	historyEvents, cancelHistoryEvents := discoveryStorage.Subscribe()
+	defer cancelHistoryEvents()
+	go recordHistory(historyEvents)
+
+	go printDiscoveryLogs()
+
+	// Servers from the last run that are still alive are available immediately
+	if len(config.StateFile) > 0 {
+		restored, err := discoveryStorage.LoadState(config.StateFile)
+		if err != nil {
+			log.Printf("loading state error: %v\n", err)
+		} else {
+			log.Printf("%d servers restored from the state file\n", restored)
+		}
+		go saveStateLoop()
+	}
 
 	err = driver.Init()
 	if err != nil {
 		log.Fatalln(err)
 	}
 
-	go printDiscoveryLogs()
 	go cleanDiscoveryPool()
 
 	if len(config.Callback) > 0 {
@@ -204,11 +351,27 @@ func main() {
 	if err != nil {
 		log.Printf("discovery changed error: %v", err)
 	}
+
+	startProviders()
+	startChecks()
+	go expireLeasesLoop()
+
 	// If config.Register is false this instance won't be registered with other nodes
 	if config.Register {
 		// This is background process that sends the message
 		go sendDiscoveryPacketTask(sendDiscoveryPacketTrigger)
 
+		// Changes in the labels directory are sent right away without waiting for the keep alive
+		if config.WatchLabels {
+			_, err = localHost.WatchLabels(time.Duration(config.WatchLabelsDebounce)*time.Millisecond, func() {
+				log.Println("Labels directory has changed, sending discovery packet")
+				sendDiscoveryPacket()
+			})
+			if err != nil {
+				log.Printf("labels directory won't be watched: %v\n", err)
+			}
+		}
+
 		// This triggers the process
 		go func() {
 			for {
@@ -233,6 +396,7 @@ func main() {
 	if len(config.Token) > 0 {
 		e.Use(TokenMiddleware)
 	}
+	e.Use(StaleMiddleware)
 	e.Use(middleware.Logger())
 	e.Use(middleware.Recover())
 	// Routes
@@ -243,7 +407,14 @@ func main() {
 		e.GET("/v1/discoveries", listHandler)
 		e.POST("/v1/labels", addLabelsHandler)
 		e.DELETE("/v1/labels", deleteLabelsHandler)
+		e.GET("/v1/leases", listLeasesHandler)
+		e.POST("/v1/leases", grantLeaseHandler)
+		e.POST("/v1/leases/:id/keepalive", keepAliveLeaseHandler)
+		e.DELETE("/v1/leases/:id", revokeLeaseHandler)
 		e.GET("/v1/prometheus/:name", prometheusHandler)
+		e.GET("/v1/metrics", metricsHandler)
+		e.GET("/v1/history", historyHandler)
+		e.GET("/v1/conflicts", conflictsHandler)
 	}
 
 	// ------------------------------
@@ -262,6 +433,7 @@ func main() {
 		} else {
 			log.Printf("%s signal received", sig.String())
 		}
+		saveState()
 		e.Shutdown(context.TODO())
 	}(e, config)
 	// Start server
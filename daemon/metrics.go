@@ -0,0 +1,138 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/by-cx/lobby/common"
+	"github.com/labstack/echo"
+)
+
+// Internal metrics of the daemon exported in Prometheus text format.
+
+// Metric is anything that can write itself in Prometheus text format
+type Metric interface {
+	Write(w io.Writer)
+}
+
+// GaugeFunc is a gauge with value calculated when the metrics are collected
+type GaugeFunc struct {
+	Name  string
+	Help  string
+	Value func() float64
+}
+
+// Write writes the gauge into w in Prometheus text format
+func (g *GaugeFunc) Write(w io.Writer) {
+	fmt.Fprintf(w, "# HELP %s %s\n", g.Name, g.Help)
+	fmt.Fprintf(w, "# TYPE %s gauge\n", g.Name)
+	fmt.Fprintf(w, "%s %g\n", g.Name, g.Value())
+}
+
+// CounterVec is a set of counters with the same name distinguished by value of a single label
+type CounterVec struct {
+	Name  string
+	Help  string
+	Label string
+
+	lock   sync.Mutex
+	values map[string]uint64
+}
+
+// Inc increases counter identified by the label value by one
+func (c *CounterVec) Inc(labelValue string) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if c.values == nil {
+		c.values = make(map[string]uint64)
+	}
+	c.values[labelValue]++
+}
+
+// Get returns current value of the counter identified by the label value
+func (c *CounterVec) Get(labelValue string) uint64 {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	return c.values[labelValue]
+}
+
+// Write writes the counters into w in Prometheus text format
+func (c *CounterVec) Write(w io.Writer) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	keys := []string{}
+	for key := range c.values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	fmt.Fprintf(w, "# HELP %s %s\n", c.Name, c.Help)
+	fmt.Fprintf(w, "# TYPE %s counter\n", c.Name)
+	for _, key := range keys {
+		fmt.Fprintf(w, "%s{%s=%q} %d\n", c.Name, c.Label, key, c.values[key])
+	}
+}
+
+var rejectedPackets = &CounterVec{
+	Name:  "lobby_rejected_packets_total",
+	Help:  "Number of incoming discovery packets dropped by the driver.",
+	Label: "reason",
+}
+
+var discoveryEvents = &CounterVec{
+	Name:  "lobby_discovery_events_total",
+	Help:  "Number of changes in the discovery storage by type of the event.",
+	Label: "type",
+}
+
+var hostnameConflicts = &CounterVec{
+	Name:  "lobby_hostname_conflicts_total",
+	Help:  "Number of detected hostnames announced by more than one instance.",
+	Label: "namespace",
+}
+
+var activeHostnameConflicts = &GaugeFunc{
+	Name: "lobby_hostname_conflicts",
+	Help: "Number of hostnames currently announced by more than one instance.",
+	Value: func() float64 {
+		return float64(len(discoveryStorage.Conflicts()))
+	},
+}
+
+var driverConnected = &GaugeFunc{
+	Name: "lobby_driver_connected",
+	Help: "1 if the driver is connected to the bus, 0 otherwise.",
+	Value: func() float64 {
+		if driver.State() == common.StateConnected {
+			return 1
+		}
+		return 0
+	},
+}
+
+// metrics contains all metrics exported by metricsHandler
+var metrics = []Metric{
+	rejectedPackets,
+	discoveryEvents,
+	hostnameConflicts,
+	activeHostnameConflicts,
+	driverConnected,
+}
+
+// metricsHandler returns internal metrics of the daemon in Prometheus text format
+func metricsHandler(c echo.Context) error {
+	output := &strings.Builder{}
+
+	for _, metric := range metrics {
+		metric.Write(output)
+	}
+
+	return c.Blob(http.StatusOK, "text/plain; version=0.0.4", []byte(output.String()))
+}
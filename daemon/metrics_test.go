@@ -0,0 +1,31 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCounterVec(t *testing.T) {
+	counter := CounterVec{
+		Name:  "lobby_test_total",
+		Help:  "Test counter.",
+		Label: "reason",
+	}
+
+	counter.Inc("hostname")
+	counter.Inc("hostname")
+	counter.Inc("decode")
+
+	assert.Equal(t, uint64(2), counter.Get("hostname"))
+	assert.Equal(t, uint64(0), counter.Get("label"))
+
+	output := &strings.Builder{}
+	counter.Write(output)
+	assert.Equal(t, `# HELP lobby_test_total Test counter.
+# TYPE lobby_test_total counter
+lobby_test_total{reason="decode"} 1
+lobby_test_total{reason="hostname"} 2
+`, output.String())
+}
@@ -6,6 +6,9 @@ import (
 	"github.com/labstack/echo"
 )
 
+// staleHeader is set to true in responses while the discovery storage is stale
+const staleHeader = "X-Lobby-Stale"
+
 func TokenMiddleware(next echo.HandlerFunc) echo.HandlerFunc {
 	return func(c echo.Context) error {
 		// Skip selected paths
@@ -24,3 +27,14 @@ func TokenMiddleware(next echo.HandlerFunc) echo.HandlerFunc {
 		return nil
 	}
 }
+
+// StaleMiddleware adds X-Lobby-Stale header to the responses while the daemon is disconnected from
+// the other nodes and its list of servers may be outdated
+func StaleMiddleware(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		if discoveryStorage.Stale() {
+			c.Response().Header().Set(staleHeader, "true")
+		}
+		return next(c)
+	}
+}
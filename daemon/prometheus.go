@@ -39,16 +39,14 @@ func preparePrometheusOutput(name string, discoveries []server.Discovery) Promet
 
 		labels := map[string]string{} // These are prometheus labels, not Lobby's labels
 
-		for _, label := range discovery.FindLabelsByPrefix("prometheus:" + name + ":") {
-			trimmed := strings.TrimPrefix(label.String(), "prometheus:"+name+":")
-			parts := strings.SplitN(trimmed, ":", 2)
-			if len(parts) == 2 {
-				if parts[0] == "port" {
-					port = parts[1]
-				} else if parts[0] == "host" {
-					hosts = append(hosts, parts[1])
+		for _, label := range discovery.Labels.Sub("prometheus:" + name) {
+			if label.HasValue() {
+				if label.Key() == "port" {
+					port = label.Value()
+				} else if label.Key() == "host" {
+					hosts = append(hosts, label.Value())
 				} else {
-					labels[parts[0]] = parts[1]
+					labels[label.Key()] = label.Value()
 				}
 				add = true
 			}
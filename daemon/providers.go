@@ -0,0 +1,137 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/by-cx/lobby/server"
+)
+
+// backgroundProvider is a label provider that refreshes its labels in background
+type backgroundProvider interface {
+	server.LabelProvider
+	Start(errors chan<- error) func()
+	Status() server.ProviderStatus
+}
+
+// providers contains all label providers running in background
+var providers []backgroundProvider
+
+// onProviderChange sends the discovery packet right away when labels of a provider change
+func onProviderChange() {
+	if config.Register && !shuttingDown {
+		sendDiscoveryPacket()
+	}
+}
+
+// loadProviders creates cloud metadata provider if it's enabled and label providers from PROVIDER_<NAME>_COMMAND
+// environment variables and from executables in PROVIDERS_PATH. Options of the providers configured by environment
+// variables are set by PROVIDER_<NAME>_OPTIONS, e.g. "interval=30s timeout=5s stale=2m".
+func loadProviders() ([]backgroundProvider, error) {
+	providers := []backgroundProvider{}
+
+	if len(config.CloudMetadata) > 0 {
+		providers = append(providers, &server.CloudMetadata{
+			Cloud:    config.CloudMetadata,
+			Endpoint: config.CloudMetadataURL,
+			Interval: time.Duration(config.CloudMetadataInterval) * time.Second,
+			OnChange: onProviderChange,
+		})
+	}
+
+	environment := environmentMap()
+	names := environmentNames(environment, "PROVIDER_", "_COMMAND")
+
+	for _, name := range names {
+		command, err := server.ParseCommand(environment["PROVIDER_"+name+"_COMMAND"])
+		if err != nil {
+			return providers, fmt.Errorf("PROVIDER_%s_COMMAND: %v", name, err)
+		}
+
+		provider := &server.ExecProvider{
+			ProviderName: strings.ToLower(name),
+			Command:      command,
+			OnChange:     onProviderChange,
+		}
+		if len(provider.Command) == 0 {
+			return providers, fmt.Errorf("PROVIDER_%s_COMMAND is empty", name)
+		}
+
+		err = provider.SetOptions(environment["PROVIDER_"+name+"_OPTIONS"])
+		if err != nil {
+			return providers, fmt.Errorf("PROVIDER_%s_OPTIONS: %v", name, err)
+		}
+
+		providers = append(providers, provider)
+	}
+
+	if len(config.ProvidersPath) > 0 {
+		directoryProviders, err := server.LoadExecProviders(config.ProvidersPath)
+		if err != nil {
+			return providers, err
+		}
+		for _, provider := range directoryProviders {
+			provider.OnChange = onProviderChange
+			providers = append(providers, provider)
+		}
+	}
+
+	return providers, nil
+}
+
+// environmentMap returns environment variables as a map
+func environmentMap() map[string]string {
+	environment := make(map[string]string)
+	for _, variable := range os.Environ() {
+		parts := strings.SplitN(variable, "=", 2)
+		environment[parts[0]] = parts[1]
+	}
+	return environment
+}
+
+// environmentNames returns sorted NAMEs of variables in format PREFIXNAMESUFFIX
+func environmentNames(environment map[string]string, prefix string, suffixes ...string) []string {
+	found := make(map[string]bool)
+	for key := range environment {
+		for _, suffix := range suffixes {
+			if strings.HasPrefix(key, prefix) && strings.HasSuffix(key, suffix) && len(key) > len(prefix)+len(suffix) {
+				found[strings.TrimSuffix(strings.TrimPrefix(key, prefix), suffix)] = true
+			}
+		}
+	}
+
+	names := []string{}
+	for name := range found {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	return names
+}
+
+// startProviders runs all label providers in background, their failures are logged
+func startProviders() {
+	errors := make(chan error)
+	go func() {
+		for err := range errors {
+			log.Println(err)
+		}
+	}()
+
+	for _, provider := range providers {
+		provider.Start(errors)
+	}
+}
+
+// providersStatus returns status of all label providers
+func providersStatus() []server.ProviderStatus {
+	statuses := []server.ProviderStatus{}
+	for _, provider := range providers {
+		statuses = append(statuses, provider.Status())
+	}
+	return statuses
+}
@@ -1,10 +1,13 @@
 package main
 
 import (
+	"bytes"
 	"encoding/json"
+	"fmt"
 	"log"
 	"os/exec"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/by-cx/lobby/server"
@@ -15,6 +18,64 @@ import (
 var changeDetectedChannel chan bool = make(chan bool)
 var changeDetected bool
 
+// callbackChange is a single change passed to the callback script
+type callbackChange struct {
+	Type server.EventType `json:"type"`
+	server.Diff
+}
+
+// callbackPayload is sent to the callback script when CALLBACK_FORMAT is "changes"
+type callbackPayload struct {
+	Discoveries []server.Discovery `json:"discoveries"`
+	Changes     []callbackChange   `json:"changes"` // changes since the last run of the callback
+}
+
+var pendingChanges []callbackChange
+var pendingChangesLock sync.Mutex
+
+// addPendingChange remembers the change for the next run of the callback
+func addPendingChange(event server.Event) {
+	pendingChangesLock.Lock()
+	defer pendingChangesLock.Unlock()
+
+	pendingChanges = append(pendingChanges, callbackChange{
+		Type: event.Type,
+		Diff: event.Diff(),
+	})
+}
+
+// takePendingChanges returns changes collected since the last call
+func takePendingChanges() []callbackChange {
+	pendingChangesLock.Lock()
+	defer pendingChangesLock.Unlock()
+
+	changes := pendingChanges
+	pendingChanges = nil
+	if changes == nil {
+		changes = []callbackChange{}
+	}
+	return changes
+}
+
+// restorePendingChanges puts changes taken by takePendingChanges back before the changes collected since then
+func restorePendingChanges(changes []callbackChange) {
+	pendingChangesLock.Lock()
+	defer pendingChangesLock.Unlock()
+
+	pendingChanges = append(changes, pendingChanges...)
+}
+
+// callbackInput returns data for stdin of the callback script
+func callbackInput(changes []callbackChange) ([]byte, error) {
+	if config.CallbackFormat == "changes" {
+		return json.Marshal(callbackPayload{
+			Discoveries: discoveryStorage.GetAll(),
+			Changes:     changes,
+		})
+	}
+	return json.Marshal(discoveryStorage.GetAll())
+}
+
 // changeCatcherLoop waits for a change signal and switches variable that says if the callback should run or not
 func changeCatcherLoop() {
 	for {
@@ -31,7 +92,6 @@ func changeCatcherLoop() {
 // often than it's the configured amount of time. That prevents
 func discoveryChangeLoop() {
 	// This other loop tics in strict intervals and prevents the callback script to run more often than it's configured
-	var cmd *exec.Cmd
 
 	// Delay first run of the callback script a little so everything can set up
 	log.Printf("Delaying start of discovery change loop (%d seconds)\n", config.CallbackFirstRunDelay)
@@ -39,55 +99,88 @@ func discoveryChangeLoop() {
 	log.Println("Starting discovery change loop")
 
 	for {
-		if changeDetected {
+		// Callback waits until the storage is fresh again so it doesn't generate configuration from outdated data
+		if changeDetected && !discoveryStorage.Stale() {
 			// We switch this at the beginning so we can detect new changes while the callback script is running
 			changeDetected = false
 
 			log.Println("Running callback function")
-
-			// TODO: this is not the best way
-			callbackCommandSlice := strings.Split(config.Callback, " ")
-
-			if len(callbackCommandSlice) == 1 {
-				cmd = exec.Command(callbackCommandSlice[0])
-			} else if len(callbackCommandSlice) > 1 {
-				cmd = exec.Command(callbackCommandSlice[0], callbackCommandSlice[1:]...)
-			} else {
-				log.Println("wrong number of parts of the callback command")
-				time.Sleep(time.Duration(config.CallbackCooldown) * time.Second)
-				continue
-			}
-
-			stdin, err := cmd.StdinPipe()
+			err := runCallback()
 			if err != nil {
-				log.Println("stdin writing error: ", err.Error())
-				continue
+				log.Printf("callback error: %v\n", err)
 			}
+		}
+		time.Sleep(time.Duration(config.CallbackCooldown) * time.Second)
+	}
+}
 
-			discoveriesJSON, err := json.Marshal(discoveryStorage.GetAll())
-			if err != nil {
-				log.Println("stdin writing error: ", err.Error())
-				continue
-			}
+// runCallback runs the callback script with the discoveries on its stdin. Pending changes are
+// taken only if the script gets them, otherwise they are kept for the next run.
+func runCallback() error {
+	// TODO: this is not the best way
+	callbackCommandSlice := strings.Split(config.Callback, " ")
+	if len(callbackCommandSlice[0]) == 0 {
+		return fmt.Errorf("wrong number of parts of the callback command")
+	}
 
-			_, err = stdin.Write([]byte(discoveriesJSON))
-			if err != nil {
-				log.Println("stdin writing error: ", err.Error())
-				continue
-			}
-			err = stdin.Close()
-			if err != nil {
-				log.Println("stdin writing error: ", err.Error())
-				continue
-			}
+	changes := takePendingChanges()
+	input, err := callbackInput(changes)
+	if err != nil {
+		restorePendingChanges(changes)
+		changeDetected = true
+		return fmt.Errorf("stdin writing error: %v", err)
+	}
 
-			stdout, err := cmd.CombinedOutput()
-			if err != nil {
-				log.Println("Callback error: ", err.Error())
-			}
-			log.Println("Callback output: ", string(stdout))
+	cmd := exec.Command(callbackCommandSlice[0], callbackCommandSlice[1:]...)
+	cmd.Stdin = bytes.NewReader(input)
+	stdout, err := cmd.CombinedOutput()
+	if _, exited := err.(*exec.ExitError); err != nil && !exited {
+		// The script didn't run so it didn't get the changes
+		restorePendingChanges(changes)
+		changeDetected = true
+		return fmt.Errorf("running callback error: %v", err)
+	}
+	log.Println("Callback output: ", string(stdout))
+
+	return err
+}
+
+// processDiscoveryEvents reads events from the discovery storage and it logs them, counts them
+// and triggers the callback.
+func processDiscoveryEvents(events <-chan server.Event) {
+	for event := range events {
+		discoveryEvents.Inc(string(event.Type))
+
+		if event.Type == server.EventUpdated {
+			discovery := event.Discovery()
+			diff := event.Diff()
+			log.Printf("%s has been updated: %s", discovery.Name(), diff.String())
+		}
+
+		// Conflict doesn't change content of the storage
+		if event.Type == server.EventConflict {
+			hostnameConflicts.Inc(event.Namespace)
+			continue
+		}
+
+		if len(config.Callback) > 0 {
+			addPendingChange(event)
+		}
+
+		err := discoveryChange(event.Discovery())
+		if err != nil {
+			log.Printf("discovery changed error: %v", err)
+		}
+	}
+}
+
+// recordHistory saves events from the discovery storage into the history
+func recordHistory(events <-chan server.Event) {
+	for event := range events {
+		err := history.Add(event)
+		if err != nil {
+			log.Printf("history error: %v", err)
 		}
-		time.Sleep(time.Duration(config.CallbackCooldown) * time.Second)
 	}
 }
 
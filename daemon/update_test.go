@@ -0,0 +1,34 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/by-cx/lobby/server"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRunCallbackKeepsChanges(t *testing.T) {
+	originalCallback, originalFormat := config.Callback, config.CallbackFormat
+	defer func() {
+		config.Callback, config.CallbackFormat = originalCallback, originalFormat
+		takePendingChanges()
+	}()
+	config.CallbackFormat = "changes"
+
+	discovery := server.Discovery{Hostname: "test.example.com"}
+	addPendingChange(server.Event{Type: server.EventJoined, New: &discovery})
+
+	// Changes are kept when the script can't be started
+	config.Callback = "/nonexistent/callback"
+	assert.NotNil(t, runCallback())
+	assert.True(t, changeDetected)
+	changeDetected = false
+	changes := takePendingChanges()
+	assert.Equal(t, 1, len(changes))
+	restorePendingChanges(changes)
+
+	// Script that fails still got the changes
+	config.Callback = "false"
+	assert.NotNil(t, runCallback())
+	assert.Equal(t, 0, len(takePendingChanges()))
+}
@@ -0,0 +1,288 @@
+package multi_driver
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/by-cx/lobby/common"
+	"github.com/by-cx/lobby/server"
+)
+
+// forgetAfter is how long the last sequence number of a sender is remembered
+const forgetAfter = time.Hour
+
+// Multi driver publishes every packet via all its drivers and merges incoming packets from all of them.
+// Packets are numbered so copies of the same packet coming from different drivers are passed to the listeners
+// only once. Failure of one driver doesn't affect the others, so the nodes still see each other as long as
+// at least one of the buses works.
+type Driver struct {
+	// sequence has to be the first field, 64-bit atomic operations need 8-byte alignment
+	// which is guaranteed on 32-bit platforms only for the first word of the struct
+	sequence uint64 // last sequence number of the sent packets
+
+	Drivers []common.Driver
+
+	LogChannel chan string
+
+	subscribeListener   common.Listener
+	unsubscribeListener common.Listener
+	rejectListener      common.RejectListener
+	state               common.StateTracker
+
+	lock   sync.Mutex
+	ready  []bool                   // drivers that were initialized successfully
+	states []common.ConnectionState // last reported state of each driver
+	seen   map[string]seenSequence  // last sequence number of each sender
+	pruned time.Time                // when old senders were removed from seen
+}
+
+// seenSequence is the last sequence number received from a sender
+type seenSequence struct {
+	sequence uint64
+	time     time.Time
+}
+
+// senderKey identifies the sender of the packet, instance ID is part of it so two servers with the same hostname
+// don't drop each other's packets
+func senderKey(discovery server.Discovery) string {
+	return server.NormalizeNamespace(discovery.Namespace) + "/" + discovery.Hostname + "/" + discovery.InstanceID
+}
+
+// isDuplicate returns true if the packet or a newer one from the same sender was already received
+func (d *Driver) isDuplicate(discovery server.Discovery) bool {
+	// Packets from senders with a single driver are not numbered
+	if discovery.Sequence == 0 {
+		return false
+	}
+
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	now := time.Now()
+	key := senderKey(discovery)
+	if last, ok := d.seen[key]; ok && last.sequence >= discovery.Sequence {
+		return true
+	}
+	d.seen[key] = seenSequence{sequence: discovery.Sequence, time: now}
+
+	// Senders that are gone for a long time are forgotten
+	if now.Sub(d.pruned) > time.Minute {
+		for key, last := range d.seen {
+			if now.Sub(last.time) > forgetAfter {
+				delete(d.seen, key)
+			}
+		}
+		d.pruned = now
+	}
+
+	return false
+}
+
+// Init initializes all drivers in parallel. It returns once at least one of them is ready, the others
+// continue in background and their errors are sent to LogChannel. Error is returned only if all drivers fail.
+func (d *Driver) Init() error {
+	if d.LogChannel == nil {
+		return fmt.Errorf("please initiate LogChannel variable")
+	}
+	if len(d.Drivers) == 0 {
+		return fmt.Errorf("no drivers configured")
+	}
+
+	// Sequence numbers start at the current time so they keep increasing after restart
+	atomic.StoreUint64(&d.sequence, uint64(time.Now().UnixNano()))
+
+	d.lock.Lock()
+	d.ready = make([]bool, len(d.Drivers))
+	d.states = make([]common.ConnectionState, len(d.Drivers))
+	d.seen = make(map[string]seenSequence)
+	d.lock.Unlock()
+
+	for i, driver := range d.Drivers {
+		i := i
+		driver.RegisterStateFunction(func(state common.ConnectionState) {
+			d.setDriverState(i, state)
+		})
+		driver.RegisterSubscribeFunction(func(discovery server.Discovery) {
+			if !d.isDuplicate(discovery) {
+				d.subscribeListener(discovery)
+			}
+		})
+		driver.RegisterUnsubscribeFunction(func(discovery server.Discovery) {
+			if !d.isDuplicate(discovery) {
+				d.unsubscribeListener(discovery)
+			}
+		})
+		driver.RegisterRejectFunction(func(reason string, err error) {
+			if d.rejectListener != nil {
+				d.rejectListener(reason, err)
+			}
+		})
+	}
+
+	results := make(chan error, len(d.Drivers))
+	for i, driver := range d.Drivers {
+		go func(i int, driver common.Driver) {
+			err := driver.Init()
+			if err == nil {
+				d.lock.Lock()
+				d.ready[i] = true
+				d.lock.Unlock()
+			}
+			results <- err
+		}(i, driver)
+	}
+
+	errors := []string{}
+	for range d.Drivers {
+		err := <-results
+		if err == nil {
+			go d.logErrors(results, len(d.Drivers)-len(errors)-1)
+			return nil
+		}
+		errors = append(errors, err.Error())
+		d.LogChannel <- fmt.Sprintf("driver init error: %v", err)
+	}
+
+	return fmt.Errorf("all drivers failed: %s", strings.Join(errors, "; "))
+}
+
+// setDriverState updates state of one of the drivers. The multi driver is connected if at least one of its drivers
+// is connected. When a driver connects while another one is already connected, StateConnected is reported again
+// so the listener knows the packets should be sent again.
+func (d *Driver) setDriverState(i int, state common.ConnectionState) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	previous := d.states[i]
+	d.states[i] = state
+	// Driver connects during its Init, packets have to be sent via it before Init returns
+	if state == common.StateConnected {
+		d.ready[i] = true
+	}
+
+	aggregated := common.StateDown
+	for _, driverState := range d.states {
+		if driverState == common.StateConnected {
+			aggregated = common.StateConnected
+			break
+		} else if driverState == common.StateReconnecting {
+			aggregated = common.StateReconnecting
+		}
+	}
+
+	if aggregated == common.StateConnected && d.state.Get() == common.StateConnected && state == common.StateConnected && previous != common.StateConnected {
+		d.state.Restored()
+	} else {
+		d.state.Set(aggregated)
+	}
+}
+
+// logErrors logs results of the drivers that are initialized after Init returned
+func (d *Driver) logErrors(results chan error, count int) {
+	for i := 0; i < count; i++ {
+		err := <-results
+		if err != nil {
+			d.LogChannel <- fmt.Sprintf("driver init error: %v", err)
+		}
+	}
+}
+
+// readyDrivers returns drivers that were initialized successfully
+func (d *Driver) readyDrivers() []common.Driver {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	drivers := []common.Driver{}
+	for i, driver := range d.Drivers {
+		if d.ready[i] {
+			drivers = append(drivers, driver)
+		}
+	}
+	return drivers
+}
+
+// Close closes all drivers
+func (d *Driver) Close() error {
+	errors := []string{}
+	for _, driver := range d.readyDrivers() {
+		err := driver.Close()
+		if err != nil {
+			errors = append(errors, err.Error())
+		}
+	}
+
+	if len(errors) > 0 {
+		return fmt.Errorf("closing drivers error: %s", strings.Join(errors, "; "))
+	}
+	return nil
+}
+
+// State returns connected if at least one of the drivers is connected, reconnecting if at least one of them is
+// reconnecting and down otherwise
+func (d *Driver) State() common.ConnectionState {
+	return d.state.Get()
+}
+
+// RegisterSubscribeFunction sets the function that will process the incoming messages
+func (d *Driver) RegisterSubscribeFunction(listener common.Listener) {
+	d.subscribeListener = listener
+}
+
+// RegisterUnsubscribeFunction sets the function that will process the goodbye incoming messages
+func (d *Driver) RegisterUnsubscribeFunction(listener common.Listener) {
+	d.unsubscribeListener = listener
+}
+
+// RegisterRejectFunction sets the function that is called when an incoming packet is dropped
+func (d *Driver) RegisterRejectFunction(listener common.RejectListener) {
+	d.rejectListener = listener
+}
+
+// RegisterStateFunction sets the function that is called when the aggregated connection state changes
+func (d *Driver) RegisterStateFunction(listener common.StateListener) {
+	d.state.Register(listener)
+}
+
+// send numbers the packet and sends it via all ready drivers. It fails only if none of them succeeds,
+// errors of the single drivers are sent to LogChannel.
+func (d *Driver) send(discovery server.Discovery, send func(driver common.Driver, discovery server.Discovery) error) error {
+	discovery.Sequence = atomic.AddUint64(&d.sequence, 1)
+
+	drivers := d.readyDrivers()
+	if len(drivers) == 0 {
+		return fmt.Errorf("no driver is ready")
+	}
+
+	errors := []string{}
+	for _, driver := range drivers {
+		err := send(driver, discovery)
+		if err != nil {
+			errors = append(errors, err.Error())
+		}
+	}
+
+	if len(errors) == len(drivers) {
+		return fmt.Errorf("sending via all drivers failed: %s", strings.Join(errors, "; "))
+	}
+	for _, err := range errors {
+		d.LogChannel <- err
+	}
+	return nil
+}
+
+// SendDiscoveryPacket send discovery packet to the group via all drivers.
+func (d *Driver) SendDiscoveryPacket(discovery server.Discovery) error {
+	return d.send(discovery, func(driver common.Driver, discovery server.Discovery) error {
+		return driver.SendDiscoveryPacket(discovery)
+	})
+}
+
+// SendGoodbyePacket deregister node from the group via all drivers.
+func (d *Driver) SendGoodbyePacket(discovery server.Discovery) error {
+	return d.send(discovery, func(driver common.Driver, discovery server.Discovery) error {
+		return driver.SendGoodbyePacket(discovery)
+	})
+}
@@ -0,0 +1,211 @@
+package multi_driver
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+
+	"github.com/by-cx/lobby/common"
+	"github.com/by-cx/lobby/server"
+	"github.com/stretchr/testify/assert"
+)
+
+// bus delivers packets sent by any of its drivers to all of them
+type bus struct {
+	drivers []*fakeDriver
+	down    bool
+}
+
+type fakeDriver struct {
+	bus     *bus
+	initErr error
+
+	subscribeListener   common.Listener
+	unsubscribeListener common.Listener
+	state               common.StateTracker
+}
+
+func (b *bus) newDriver() *fakeDriver {
+	driver := &fakeDriver{bus: b}
+	b.drivers = append(b.drivers, driver)
+	return driver
+}
+
+func (f *fakeDriver) Init() error {
+	if f.initErr == nil {
+		f.state.Set(common.StateConnected)
+	}
+	return f.initErr
+}
+func (f *fakeDriver) Close() error                  { return nil }
+func (f *fakeDriver) State() common.ConnectionState { return f.state.Get() }
+func (f *fakeDriver) RegisterStateFunction(listener common.StateListener) {
+	f.state.Register(listener)
+}
+func (f *fakeDriver) RegisterSubscribeFunction(listener common.Listener) {
+	f.subscribeListener = listener
+}
+func (f *fakeDriver) RegisterUnsubscribeFunction(listener common.Listener) {
+	f.unsubscribeListener = listener
+}
+func (f *fakeDriver) RegisterRejectFunction(listener common.RejectListener) {}
+
+func (f *fakeDriver) SendDiscoveryPacket(discovery server.Discovery) error {
+	if f.bus.down {
+		return fmt.Errorf("bus is down")
+	}
+	for _, driver := range f.bus.drivers {
+		driver.subscribeListener(discovery)
+	}
+	return nil
+}
+
+func (f *fakeDriver) SendGoodbyePacket(discovery server.Discovery) error {
+	if f.bus.down {
+		return fmt.Errorf("bus is down")
+	}
+	for _, driver := range f.bus.drivers {
+		driver.unsubscribeListener(discovery)
+	}
+	return nil
+}
+
+// newNode returns multi driver connected to both buses that counts received packets
+func newNode(t *testing.T, busA, busB *bus, received *[]server.Discovery, lock *sync.Mutex) *Driver {
+	logs := make(chan string, 100)
+	driver := &Driver{
+		Drivers:    []common.Driver{busA.newDriver(), busB.newDriver()},
+		LogChannel: logs,
+	}
+	driver.RegisterSubscribeFunction(func(discovery server.Discovery) {
+		lock.Lock()
+		defer lock.Unlock()
+		*received = append(*received, discovery)
+	})
+	driver.RegisterUnsubscribeFunction(func(discovery server.Discovery) {
+		lock.Lock()
+		defer lock.Unlock()
+		discovery.Labels = server.Labels{"goodbye"}
+		*received = append(*received, discovery)
+	})
+	assert.Nil(t, driver.Init())
+	return driver
+}
+
+func TestMultiDriverDeduplication(t *testing.T) {
+	busA, busB := &bus{}, &bus{}
+	lock := &sync.Mutex{}
+	sent, received := []server.Discovery{}, []server.Discovery{}
+
+	sender := newNode(t, busA, busB, &sent, lock)
+	newNode(t, busA, busB, &received, lock)
+
+	discovery := server.Discovery{Hostname: "test.example.com", InstanceID: "a", Labels: server.Labels{"service:test"}}
+	assert.Nil(t, sender.SendDiscoveryPacket(discovery))
+	assert.Equal(t, 1, len(received))
+	assert.NotEqual(t, uint64(0), received[0].Sequence)
+
+	// One bus is down, packets still come via the other one
+	busA.down = true
+	assert.Nil(t, sender.SendDiscoveryPacket(discovery))
+	assert.Equal(t, 2, len(received))
+	assert.True(t, received[1].Sequence > received[0].Sequence)
+
+	// Both are down
+	busB.down = true
+	assert.NotNil(t, sender.SendDiscoveryPacket(discovery))
+	assert.Equal(t, 2, len(received))
+
+	busA.down, busB.down = false, false
+	assert.Nil(t, sender.SendGoodbyePacket(discovery))
+	assert.Equal(t, 3, len(received))
+	assert.Equal(t, server.Labels{"goodbye"}, received[2].Labels)
+
+	// Packets older than the last received one are dropped, e.g. when one bus is delayed
+	late := received[1]
+	busA.drivers[1].subscribeListener(late)
+	assert.Equal(t, 3, len(received))
+
+	// Same hostname from another instance is not a duplicate
+	late.InstanceID = "b"
+	busA.drivers[1].subscribeListener(late)
+	assert.Equal(t, 4, len(received))
+
+	// Packets without sequence number are never dropped
+	discovery.Sequence = 0
+	busA.drivers[1].subscribeListener(discovery)
+	busB.drivers[1].subscribeListener(discovery)
+	assert.Equal(t, 6, len(received))
+}
+
+func TestMultiDriverInit(t *testing.T) {
+	busA, busB := &bus{}, &bus{}
+
+	driverA, driverB := busA.newDriver(), busB.newDriver()
+	driverA.initErr = fmt.Errorf("connection refused")
+	driver := &Driver{
+		Drivers:    []common.Driver{driverA, driverB},
+		LogChannel: make(chan string, 10),
+	}
+	driver.RegisterSubscribeFunction(func(discovery server.Discovery) {})
+	driver.RegisterUnsubscribeFunction(func(discovery server.Discovery) {})
+
+	assert.Nil(t, driver.Init())
+	assert.Equal(t, "driver init error: connection refused", <-driver.LogChannel)
+
+	// Only the ready driver is used
+	busA.down = true
+	assert.Nil(t, driver.SendDiscoveryPacket(server.Discovery{Hostname: "test.example.com"}))
+
+	driverB.initErr = fmt.Errorf("timeout")
+	err := driver.Init()
+	assert.NotNil(t, err)
+	assert.Contains(t, err.Error(), "all drivers failed")
+	assert.Contains(t, err.Error(), "connection refused")
+	assert.Contains(t, err.Error(), "timeout")
+}
+
+func TestMultiDriverState(t *testing.T) {
+	busA, busB := &bus{}, &bus{}
+
+	driverA, driverB := busA.newDriver(), busB.newDriver()
+	driverA.initErr = fmt.Errorf("connection refused")
+	driver := &Driver{
+		Drivers:    []common.Driver{driverA, driverB},
+		LogChannel: make(chan string, 10),
+	}
+	states := []common.ConnectionState{}
+	driver.RegisterStateFunction(func(state common.ConnectionState) {
+		states = append(states, state)
+	})
+	driver.RegisterSubscribeFunction(func(discovery server.Discovery) {})
+	driver.RegisterUnsubscribeFunction(func(discovery server.Discovery) {})
+
+	assert.Nil(t, driver.Init())
+	assert.Equal(t, common.StateConnected, driver.State())
+	assert.Equal(t, []common.ConnectionState{common.StateConnected}, states)
+
+	// Connected driver is used even if its Init failed before
+	driverA.state.Set(common.StateConnected)
+	assert.Equal(t, []common.ConnectionState{common.StateConnected, common.StateConnected}, states)
+	assert.Equal(t, 2, len(driver.readyDrivers()))
+
+	// One driver is enough to be connected
+	driverA.state.Set(common.StateReconnecting)
+	assert.Equal(t, common.StateConnected, driver.State())
+	assert.Equal(t, 2, len(states))
+
+	driverB.state.Set(common.StateDown)
+	assert.Equal(t, common.StateReconnecting, driver.State())
+	driverA.state.Set(common.StateDown)
+	assert.Equal(t, common.StateDown, driver.State())
+
+	driverB.state.Set(common.StateConnected)
+	assert.Equal(t, []common.ConnectionState{
+		common.StateConnected,
+		common.StateConnected,
+		common.StateReconnecting,
+		common.StateDown,
+		common.StateConnected,
+	}, states)
+}
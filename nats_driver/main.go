@@ -4,7 +4,6 @@ import (
 	"encoding/json"
 	"fmt"
 	"log"
-	"strings"
 	"time"
 
 	"github.com/by-cx/lobby/common"
@@ -12,6 +11,9 @@ import (
 	"github.com/nats-io/nats.go"
 )
 
+// reconnectWait is time between attempts to connect to the NATS server
+const reconnectWait = 5 * time.Second
+
 // NATS drivers is used to send discovery packet to other nodes into the group via NATS messenging protocol.
 type Driver struct {
 	NATSUrl              string
@@ -22,6 +24,8 @@ type Driver struct {
 	nc                  *nats.Conn
 	subscribeListener   common.Listener
 	unsubscribeListener common.Listener
+	rejectListener      common.RejectListener
+	state               common.StateTracker
 }
 
 // handler is called asynchronously so and because it cannot log directly to stderr there
@@ -29,13 +33,15 @@ type Driver struct {
 func (d *Driver) handler(m *nats.Msg) {
 	message := discoveryEnvelope{}
 	err := json.Unmarshal(m.Data, &message)
-	if err != nil && d.LogChannel != nil {
-		d.LogChannel <- fmt.Errorf("decoding message error: %v", err).Error()
+	if err != nil {
+		d.reject(common.RejectReasonDecode, fmt.Errorf("decoding message error: %v", err))
+		return
 	}
 
 	err = message.Discovery.Validate()
-	if err != nil && d.LogChannel != nil {
-		d.LogChannel <- fmt.Errorf("validation error: %v", err).Error()
+	if err != nil {
+		d.reject(server.ValidationReason(err), fmt.Errorf("validation error: %v", err))
+		return
 	}
 
 	if message.Message == "hi" {
@@ -43,23 +49,56 @@ func (d *Driver) handler(m *nats.Msg) {
 	} else if message.Message == "goodbye" {
 		d.unsubscribeListener(message.Discovery)
 	} else {
-		if d.LogChannel != nil {
-			d.LogChannel <- "incompatible message"
-		}
+		d.reject(common.RejectReasonMessage, fmt.Errorf("incompatible message %q", message.Message))
 	}
+}
 
+// reject logs the reason why the incoming packet was dropped and passes it to the reject listener
+func (d *Driver) reject(reason string, err error) {
+	if d.LogChannel != nil {
+		d.LogChannel <- err.Error()
+	}
+	if d.rejectListener != nil {
+		d.rejectListener(reason, err)
+	}
 }
 
+// Init connects to the NATS server and subscribes to the discovery channel. Lost connection is restored
+// by the NATS client which subscribes again on its own, so Init has to be called only once.
 func (d *Driver) Init() error {
 	if d.LogChannel == nil {
 		return fmt.Errorf("please initiate LogChannel variable")
 	}
+	if d.nc != nil {
+		return fmt.Errorf("driver is already initiated")
+	}
+
+	options := []nats.Option{
+		nats.MaxReconnects(-1),
+		nats.ReconnectWait(reconnectWait),
+		nats.DisconnectErrHandler(func(nc *nats.Conn, err error) {
+			// Called also when the connection is closed on purpose
+			if nc.IsClosed() {
+				return
+			}
+			if err != nil {
+				d.LogChannel <- fmt.Sprintf("NATS connection lost: %v", err)
+			}
+			d.state.Set(common.StateReconnecting)
+		}),
+		nats.ReconnectHandler(func(nc *nats.Conn) {
+			d.state.Set(common.StateConnected)
+		}),
+		nats.ClosedHandler(func(nc *nats.Conn) {
+			d.state.Set(common.StateDown)
+		}),
+	}
 
 	for {
-		nc, err := nats.Connect(d.NATSUrl)
+		nc, err := nats.Connect(d.NATSUrl, options...)
 		if err != nil {
 			log.Printf("Can't connect to the NATS server, waiting for 5 seconds before I try it again. (%v)\n", err)
-			time.Sleep(time.Second * 5)
+			time.Sleep(reconnectWait)
 			continue
 		}
 		d.nc = nc
@@ -68,8 +107,11 @@ func (d *Driver) Init() error {
 
 	_, err := d.nc.Subscribe(d.NATSDiscoveryChannel, d.handler)
 	if err != nil {
+		d.nc.Close()
+		d.nc = nil
 		return fmt.Errorf("subscribe error: %v", err)
 	}
+	d.state.Set(common.StateConnected)
 
 	return nil
 }
@@ -79,6 +121,11 @@ func (d *Driver) Close() error {
 	return d.nc.Drain()
 }
 
+// State returns the current state of the connection to the NATS server
+func (d *Driver) State() common.ConnectionState {
+	return d.state.Get()
+}
+
 // RegisterSubscribeFunction sets the function that will process the incoming messages
 func (d *Driver) RegisterSubscribeFunction(listener common.Listener) {
 	d.subscribeListener = listener
@@ -89,6 +136,16 @@ func (d *Driver) RegisterUnsubscribeFunction(listener common.Listener) {
 	d.unsubscribeListener = listener
 }
 
+// RegisterRejectFunction sets the function that is called when an incoming packet is dropped
+func (d *Driver) RegisterRejectFunction(listener common.RejectListener) {
+	d.rejectListener = listener
+}
+
+// RegisterStateFunction sets the function that is called when the connection state changes
+func (d *Driver) RegisterStateFunction(listener common.StateListener) {
+	d.state.Register(listener)
+}
+
 // SendDiscoveryPacket send discovery packet to the group.
 func (d *Driver) SendDiscoveryPacket(discovery server.Discovery) error {
 	envelope := discoveryEnvelope{
@@ -100,15 +157,9 @@ func (d *Driver) SendDiscoveryPacket(discovery server.Discovery) error {
 	if err != nil {
 		return fmt.Errorf("sending discovery formating message error: %v", err)
 	}
+	// While reconnecting the NATS client buffers the packet and sends it after the connection is restored
 	err = d.nc.Publish(d.NATSDiscoveryChannel, data)
-	// In case the connection is down we will try to reconnect
-	if err != nil && strings.Contains(err.Error(), "connection closed") {
-		d.nc.Close()
-		err = d.Init()
-		if err != nil {
-			return fmt.Errorf("sending discovery reconnect error: %v", err)
-		}
-	} else if err != nil {
+	if err != nil {
 		return fmt.Errorf("sending discovery error: %v", err)
 	}
 	return nil
@@ -0,0 +1,73 @@
+package nats_driver
+
+import (
+	"testing"
+	"time"
+
+	"github.com/by-cx/lobby/common"
+	"github.com/by-cx/lobby/server"
+	natsserver "github.com/nats-io/nats-server/v2/server"
+	natstest "github.com/nats-io/nats-server/v2/test"
+	"github.com/stretchr/testify/assert"
+)
+
+const testPort = 14222
+
+func runServer() *natsserver.Server {
+	options := natstest.DefaultTestOptions
+	options.Port = testPort
+	return natstest.RunServer(&options)
+}
+
+func TestReconnect(t *testing.T) {
+	natsServer := runServer()
+
+	states := make(chan common.ConnectionState, 10)
+	received := make(chan server.Discovery, 10)
+	driver := &Driver{
+		NATSUrl:              natsServer.ClientURL(),
+		NATSDiscoveryChannel: "lobby.discovery",
+		LogChannel:           make(chan string, 10),
+	}
+	driver.RegisterStateFunction(func(state common.ConnectionState) {
+		states <- state
+	})
+	driver.RegisterSubscribeFunction(func(discovery server.Discovery) {
+		received <- discovery
+	})
+	driver.RegisterUnsubscribeFunction(func(discovery server.Discovery) {})
+
+	assert.Nil(t, driver.Init())
+	assert.Equal(t, common.StateConnected, <-states)
+	assert.NotNil(t, driver.Init())
+
+	natsServer.Shutdown()
+	assert.Equal(t, common.StateReconnecting, <-states)
+	assert.Equal(t, common.StateReconnecting, driver.State())
+
+	natsServer = runServer()
+	defer natsServer.Shutdown()
+	select {
+	case state := <-states:
+		assert.Equal(t, common.StateConnected, state)
+	case <-time.After(2 * reconnectWait):
+		t.Fatal("driver didn't reconnect")
+	}
+
+	// The subscription is restored exactly once
+	assert.Nil(t, driver.SendDiscoveryPacket(server.Discovery{Hostname: "test.example.com"}))
+	assert.Equal(t, "test.example.com", (<-received).Hostname)
+	select {
+	case <-received:
+		t.Fatal("packet received twice")
+	case <-time.After(200 * time.Millisecond):
+	}
+
+	assert.Nil(t, driver.Close())
+	select {
+	case state := <-states:
+		assert.Equal(t, common.StateDown, state)
+	case <-time.After(time.Second):
+		t.Fatal("driver isn't down after close")
+	}
+}
@@ -0,0 +1,388 @@
+package nats_kv_driver
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/by-cx/lobby/common"
+	"github.com/by-cx/lobby/server"
+	"github.com/nats-io/nats.go"
+)
+
+const (
+	reconnectWait      = 5 * time.Second  // time between attempts to connect to the NATS server
+	initialSyncTimeout = 10 * time.Second // how long Init waits for the packets already stored in the bucket
+)
+
+// NATS KV driver stores discovery packet of every node in a JetStream key-value bucket under its own key
+// and watches the bucket for changes. Packets expire from the bucket after TTL since they were written,
+// so a new node gets packets of all alive nodes right after start instead of waiting for their keep alive.
+// Goodbye packet deletes the node's key.
+//
+// JetStream has only a single TTL for the whole bucket, so it has to be at least the longest TTL any node
+// can advertise, i.e. MaxTTL of the storage. Otherwise packets of nodes with a long keep alive interval
+// disappear from the bucket before their next keep alive.
+type Driver struct {
+	NATSUrl string
+	Bucket  string        // name of the bucket, it's created if it doesn't exist
+	TTL     time.Duration // how long a packet stays in the bucket, it's used only when the bucket is created
+
+	// EffectiveTTL returns TTL the receiver uses for the packet, usually Discoveries.EffectiveTTL. Packets
+	// older than that are not passed to the subscribe listener. If it's nil, TTL advertised in the packet is used.
+	EffectiveTTL func(discovery server.Discovery) uint
+
+	LogChannel chan string
+
+	nc                  *nats.Conn
+	kv                  nats.KeyValue
+	subscribeListener   common.Listener
+	unsubscribeListener common.Listener
+	rejectListener      common.RejectListener
+	state               common.StateTracker
+
+	watchLock sync.Mutex
+	watcher   nats.KeyWatcher
+	done      chan bool
+	closed    bool // no new watch can be started after Close
+
+	lock      sync.Mutex
+	bucketTTL time.Duration           // TTL of the bucket, it differs from TTL if the bucket already existed
+	entries   map[string]storedPacket // last packet under each key, deleted key is passed to the unsubscribe listener as this packet
+	pruned    time.Time               // when the packets that expired from the bucket were removed from entries
+}
+
+// storedPacket is the last packet received under a key of the bucket
+type storedPacket struct {
+	discovery server.Discovery
+	revision  uint64
+	created   time.Time
+}
+
+// key returns key of the discovery packet in the bucket, every instance has its own key
+// so hostname conflicts are still detected
+func key(discovery server.Discovery) string {
+	key := server.NormalizeNamespace(discovery.Namespace) + "/" + discovery.Hostname
+	if len(discovery.InstanceID) > 0 {
+		key += "/" + discovery.InstanceID
+	}
+	return key
+}
+
+// handler processes a single change in the bucket. It's called from the watch goroutine so it logs
+// into the LogChannel like the other drivers.
+func (d *Driver) handler(entry nats.KeyValueEntry) {
+	if entry.Operation() == nats.KeyValueDelete || entry.Operation() == nats.KeyValuePurge {
+		d.lock.Lock()
+		stored, ok := d.entries[entry.Key()]
+		delete(d.entries, entry.Key())
+		d.lock.Unlock()
+
+		// Delete is the goodbye packet, it's not numbered so the multi driver doesn't drop it
+		if ok {
+			discovery := stored.discovery
+			discovery.Sequence = 0
+			d.unsubscribeListener(discovery)
+		}
+		return
+	}
+
+	discovery := server.Discovery{}
+	err := json.Unmarshal(entry.Value(), &discovery)
+	if err != nil {
+		d.reject(common.RejectReasonDecode, fmt.Errorf("decoding message error: %v", err))
+		return
+	}
+
+	err = discovery.Validate()
+	if err != nil {
+		d.reject(server.ValidationReason(err), fmt.Errorf("validation error: %v", err))
+		return
+	}
+
+	// The bucket keeps packets of nodes that died without the goodbye packet until they expire from it,
+	// they are replayed when the watch starts and they must not look alive again
+	if d.expired(discovery, entry.Created()) {
+		return
+	}
+
+	d.lock.Lock()
+	// The watch can deliver the same revision again after reconnect
+	if stored, ok := d.entries[entry.Key()]; ok && stored.revision >= entry.Revision() {
+		d.lock.Unlock()
+		return
+	}
+	d.entries[entry.Key()] = storedPacket{discovery: discovery, revision: entry.Revision(), created: entry.Created()}
+	d.pruneEntries()
+	d.lock.Unlock()
+
+	d.subscribeListener(discovery)
+}
+
+// expired returns true if the packet written at created is older than its TTL
+func (d *Driver) expired(discovery server.Discovery, created time.Time) bool {
+	var ttl uint
+	if d.EffectiveTTL != nil {
+		ttl = d.EffectiveTTL(discovery)
+	} else {
+		ttl = discovery.TTL
+	}
+	if ttl == 0 {
+		return false
+	}
+
+	return time.Since(created) > time.Duration(ttl)*time.Second
+}
+
+// pruneEntries forgets packets that expired from the bucket, JetStream doesn't tell the watchers about them.
+// It has to be called with the lock held.
+func (d *Driver) pruneEntries() {
+	now := time.Now()
+	if now.Sub(d.pruned) < time.Minute {
+		return
+	}
+
+	for key, stored := range d.entries {
+		if now.Sub(stored.created) > d.bucketTTL {
+			delete(d.entries, key)
+		}
+	}
+	d.pruned = now
+}
+
+// reject logs the reason why the incoming packet was dropped and passes it to the reject listener
+func (d *Driver) reject(reason string, err error) {
+	if d.LogChannel != nil {
+		d.LogChannel <- err.Error()
+	}
+	if d.rejectListener != nil {
+		d.rejectListener(reason, err)
+	}
+}
+
+// Init connects to the NATS server, creates the bucket if needed and starts watching it. It returns
+// once the packets already stored in the bucket are processed. Lost connection is restored by the NATS
+// client and the watch is started again after every reconnect, so Init has to be called only once.
+func (d *Driver) Init() error {
+	if d.LogChannel == nil {
+		return fmt.Errorf("please initiate LogChannel variable")
+	}
+	if len(d.Bucket) == 0 {
+		return fmt.Errorf("parameter Bucket cannot be empty")
+	}
+	if d.TTL <= 0 {
+		return fmt.Errorf("parameter TTL has to be positive")
+	}
+	if d.nc != nil {
+		return fmt.Errorf("driver is already initiated")
+	}
+
+	options := []nats.Option{
+		nats.MaxReconnects(-1),
+		nats.ReconnectWait(reconnectWait),
+		// Put that fails while reconnecting must not be stored later, the packet would be outdated by then
+		nats.ReconnectBufSize(-1),
+		nats.DisconnectErrHandler(func(nc *nats.Conn, err error) {
+			// Called also when the connection is closed on purpose
+			if nc.IsClosed() {
+				return
+			}
+			if err != nil {
+				d.LogChannel <- fmt.Sprintf("NATS connection lost: %v", err)
+			}
+			d.state.Set(common.StateReconnecting)
+		}),
+		nats.ReconnectHandler(func(nc *nats.Conn) {
+			d.state.Set(common.StateConnected)
+			// The watch doesn't always survive restart of the server so it's replaced by a new one,
+			// packets delivered again are dropped in the handler.
+			go func() {
+				err := d.startWatch(false)
+				if err != nil {
+					d.LogChannel <- err.Error()
+				}
+			}()
+		}),
+		nats.ClosedHandler(func(nc *nats.Conn) {
+			d.state.Set(common.StateDown)
+		}),
+	}
+
+	for {
+		nc, err := nats.Connect(d.NATSUrl, options...)
+		if err != nil {
+			log.Printf("Can't connect to the NATS server, waiting for 5 seconds before I try it again. (%v)\n", err)
+			time.Sleep(reconnectWait)
+			continue
+		}
+		d.nc = nc
+		break
+	}
+
+	err := d.watch()
+	if err != nil {
+		d.nc.Close()
+		d.nc = nil
+		return err
+	}
+	d.state.Set(common.StateConnected)
+
+	return nil
+}
+
+// watch opens the bucket and starts goroutine that passes its changes to the handler
+func (d *Driver) watch() error {
+	js, err := d.nc.JetStream()
+	if err != nil {
+		return fmt.Errorf("JetStream error: %v", err)
+	}
+
+	d.kv, err = js.KeyValue(d.Bucket)
+	if err == nats.ErrBucketNotFound {
+		d.kv, err = js.CreateKeyValue(&nats.KeyValueConfig{
+			Bucket:  d.Bucket,
+			History: 1,
+			TTL:     d.TTL,
+		})
+	}
+	if err != nil {
+		return fmt.Errorf("bucket %s error: %v", d.Bucket, err)
+	}
+
+	status, err := d.kv.Status()
+	if err != nil {
+		return fmt.Errorf("bucket %s status error: %v", d.Bucket, err)
+	}
+	if status.TTL() > 0 && status.TTL() < d.TTL {
+		d.LogChannel <- fmt.Sprintf("bucket %s has TTL %s, packets of nodes advertising longer TTL will disappear from it before their next keep alive", d.Bucket, status.TTL())
+	}
+
+	d.lock.Lock()
+	d.bucketTTL = status.TTL()
+	if d.bucketTTL <= 0 {
+		d.bucketTTL = d.TTL
+	}
+	d.entries = make(map[string]storedPacket)
+	d.pruned = time.Now()
+	d.lock.Unlock()
+
+	return d.startWatch(true)
+}
+
+// startWatch replaces the current watch of the bucket by a new one. If wait is true, it returns
+// once the packets already stored in the bucket are processed.
+func (d *Driver) startWatch(wait bool) error {
+	d.watchLock.Lock()
+	defer d.watchLock.Unlock()
+
+	if d.closed {
+		return nil
+	}
+	if d.watcher != nil {
+		d.watcher.Stop()
+		close(d.done)
+		d.watcher = nil
+	}
+
+	watcher, err := d.kv.WatchAll()
+	if err != nil {
+		return fmt.Errorf("watching bucket %s error: %v", d.Bucket, err)
+	}
+	d.watcher = watcher
+
+	d.done = make(chan bool)
+	synced := make(chan bool)
+	go func(updates <-chan nats.KeyValueEntry, done, synced chan bool) {
+		for {
+			select {
+			case entry := <-updates:
+				// nil entry means all packets stored before the watch started were received
+				if entry == nil {
+					if synced != nil {
+						close(synced)
+						synced = nil
+					}
+					continue
+				}
+				d.handler(entry)
+			case <-done:
+				return
+			}
+		}
+	}(d.watcher.Updates(), d.done, synced)
+
+	if !wait {
+		return nil
+	}
+
+	select {
+	case <-synced:
+	case <-time.After(initialSyncTimeout):
+		d.LogChannel <- fmt.Sprintf("packets stored in bucket %s were not received in %s, continuing without them", d.Bucket, initialSyncTimeout)
+	}
+
+	return nil
+}
+
+// Close is called when all is done.
+func (d *Driver) Close() error {
+	d.watchLock.Lock()
+	if d.watcher != nil {
+		d.watcher.Stop()
+		close(d.done)
+		d.watcher = nil
+	}
+	d.closed = true
+	d.watchLock.Unlock()
+	return d.nc.Drain()
+}
+
+// State returns the current state of the connection to the NATS server
+func (d *Driver) State() common.ConnectionState {
+	return d.state.Get()
+}
+
+// RegisterSubscribeFunction sets the function that will process the incoming messages
+func (d *Driver) RegisterSubscribeFunction(listener common.Listener) {
+	d.subscribeListener = listener
+}
+
+// RegisterUnsubscribeFunction sets the function that will process the goodbye incoming messages
+func (d *Driver) RegisterUnsubscribeFunction(listener common.Listener) {
+	d.unsubscribeListener = listener
+}
+
+// RegisterRejectFunction sets the function that is called when an incoming packet is dropped
+func (d *Driver) RegisterRejectFunction(listener common.RejectListener) {
+	d.rejectListener = listener
+}
+
+// RegisterStateFunction sets the function that is called when the connection state changes
+func (d *Driver) RegisterStateFunction(listener common.StateListener) {
+	d.state.Register(listener)
+}
+
+// SendDiscoveryPacket stores discovery packet in the bucket.
+func (d *Driver) SendDiscoveryPacket(discovery server.Discovery) error {
+	data, err := discovery.Bytes()
+	if err != nil {
+		return fmt.Errorf("sending discovery formating message error: %v", err)
+	}
+
+	_, err = d.kv.Put(key(discovery), data)
+	if err != nil {
+		return fmt.Errorf("sending discovery error: %v", err)
+	}
+	return nil
+}
+
+// SendGoodbyePacket deletes the node's packet from the bucket. Other nodes see it as the goodbye packet.
+func (d *Driver) SendGoodbyePacket(discovery server.Discovery) error {
+	err := d.kv.Delete(key(discovery))
+	if err != nil {
+		return fmt.Errorf("sending goodbye error: %v", err)
+	}
+	return nil
+}
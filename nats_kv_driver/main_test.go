@@ -0,0 +1,227 @@
+package nats_kv_driver
+
+import (
+	"testing"
+	"time"
+
+	"github.com/by-cx/lobby/common"
+	"github.com/by-cx/lobby/server"
+	natsserver "github.com/nats-io/nats-server/v2/server"
+	natstest "github.com/nats-io/nats-server/v2/test"
+	"github.com/nats-io/nats.go"
+	"github.com/stretchr/testify/assert"
+)
+
+const testPort = 14223
+
+func runServer(storeDir string) *natsserver.Server {
+	options := natstest.DefaultTestOptions
+	options.Port = testPort
+	options.JetStream = true
+	options.StoreDir = storeDir
+	return natstest.RunServer(&options)
+}
+
+// testNode is a driver with channels receiving its packets and state changes
+type testNode struct {
+	driver   *Driver
+	received chan server.Discovery
+	goodbyes chan server.Discovery
+	states   chan common.ConnectionState
+}
+
+func newTestNode(t *testing.T, url string) *testNode {
+	node := &testNode{
+		driver: &Driver{
+			NATSUrl:    url,
+			Bucket:     "lobby_test",
+			TTL:        time.Minute,
+			LogChannel: make(chan string, 10),
+		},
+		received: make(chan server.Discovery, 10),
+		goodbyes: make(chan server.Discovery, 10),
+		states:   make(chan common.ConnectionState, 10),
+	}
+	node.driver.RegisterSubscribeFunction(func(discovery server.Discovery) {
+		node.received <- discovery
+	})
+	node.driver.RegisterUnsubscribeFunction(func(discovery server.Discovery) {
+		node.goodbyes <- discovery
+	})
+	node.driver.RegisterStateFunction(func(state common.ConnectionState) {
+		node.states <- state
+	})
+
+	assert.Nil(t, node.driver.Init())
+	assert.Equal(t, common.StateConnected, <-node.states)
+	return node
+}
+
+func receive(t *testing.T, packets chan server.Discovery) server.Discovery {
+	select {
+	case discovery := <-packets:
+		return discovery
+	case <-time.After(2 * reconnectWait):
+		t.Fatal("packet not received")
+	}
+	return server.Discovery{}
+}
+
+func TestDriver(t *testing.T) {
+	natsServer := runServer(t.TempDir())
+	defer natsServer.Shutdown()
+
+	nodeA := newTestNode(t, natsServer.ClientURL())
+	defer nodeA.driver.Close()
+
+	discovery := server.Discovery{Hostname: "a.example.com", InstanceID: "abcd", Labels: server.Labels{"service:test"}}
+	assert.Nil(t, nodeA.driver.SendDiscoveryPacket(discovery))
+	assert.Equal(t, server.Labels{"service:test"}, receive(t, nodeA.received).Labels)
+
+	// New node gets the stored packet during Init
+	nodeB := newTestNode(t, natsServer.ClientURL())
+	defer nodeB.driver.Close()
+	assert.Equal(t, 1, len(nodeB.received))
+	assert.Equal(t, "a.example.com", (<-nodeB.received).Hostname)
+
+	// Goodbye deletes the packet and other nodes get the last packet stored under the key
+	discovery.Sequence = 10
+	assert.Nil(t, nodeA.driver.SendGoodbyePacket(discovery))
+	goodbye := receive(t, nodeB.goodbyes)
+	assert.Equal(t, "a.example.com", goodbye.Hostname)
+	assert.Equal(t, server.Labels{"service:test"}, goodbye.Labels)
+	assert.Equal(t, uint64(0), goodbye.Sequence)
+
+	nodeC := newTestNode(t, natsServer.ClientURL())
+	defer nodeC.driver.Close()
+	assert.Equal(t, 0, len(nodeC.received))
+
+	// Invalid packets are rejected
+	rejected := make(chan string, 1)
+	nodeC.driver.RegisterRejectFunction(func(reason string, err error) {
+		rejected <- reason
+	})
+	_, err := nodeA.driver.kv.Put("default/broken", []byte("{"))
+	assert.Nil(t, err)
+	select {
+	case reason := <-rejected:
+		assert.Equal(t, common.RejectReasonDecode, reason)
+	case <-time.After(time.Second):
+		t.Fatal("packet not rejected")
+	}
+}
+
+// testEntry is a change in the bucket delivered by the watch
+type testEntry struct {
+	key       string
+	value     []byte
+	revision  uint64
+	created   time.Time
+	operation nats.KeyValueOp
+}
+
+func (e *testEntry) Bucket() string             { return "lobby_test" }
+func (e *testEntry) Key() string                { return e.key }
+func (e *testEntry) Value() []byte              { return e.value }
+func (e *testEntry) Revision() uint64           { return e.revision }
+func (e *testEntry) Created() time.Time         { return e.created }
+func (e *testEntry) Delta() uint64              { return 0 }
+func (e *testEntry) Operation() nats.KeyValueOp { return e.operation }
+
+func TestHandler(t *testing.T) {
+	received := 0
+	driver := &Driver{
+		bucketTTL: time.Minute,
+		entries:   make(map[string]storedPacket),
+		pruned:    time.Now(),
+	}
+	driver.RegisterSubscribeFunction(func(discovery server.Discovery) {
+		received++
+	})
+
+	value := []byte(`{"hostname": "a.example.com"}`)
+	driver.handler(&testEntry{key: "default/a.example.com", value: value, revision: 5, created: time.Now().Add(-2 * time.Minute)})
+	assert.Equal(t, 1, received)
+
+	// Same revision delivered again is ignored
+	driver.handler(&testEntry{key: "default/a.example.com", value: value, revision: 5, created: time.Now()})
+	assert.Equal(t, 1, received)
+
+	// Packets that expired from the bucket are forgotten
+	driver.pruned = time.Now().Add(-2 * time.Minute)
+	driver.handler(&testEntry{key: "default/b.example.com", value: []byte(`{"hostname": "b.example.com"}`), revision: 6, created: time.Now()})
+	assert.Equal(t, 2, received)
+	assert.Equal(t, 1, len(driver.entries))
+	_, ok := driver.entries["default/b.example.com"]
+	assert.True(t, ok)
+}
+
+func TestHandlerExpiredEntries(t *testing.T) {
+	received := []server.Discovery{}
+	driver := &Driver{
+		bucketTTL: 10 * time.Minute,
+		entries:   make(map[string]storedPacket),
+		pruned:    time.Now(),
+	}
+	driver.RegisterSubscribeFunction(func(discovery server.Discovery) {
+		received = append(received, discovery)
+	})
+
+	// Packet of a node that died without the goodbye packet is still in the bucket but it's not alive
+	value := []byte(`{"hostname": "dead.example.com", "ttl": 60}`)
+	driver.handler(&testEntry{key: "default/dead.example.com", value: value, revision: 1, created: time.Now().Add(-2 * time.Minute)})
+	assert.Equal(t, 0, len(received))
+	assert.Equal(t, 0, len(driver.entries))
+
+	value = []byte(`{"hostname": "alive.example.com", "ttl": 60}`)
+	driver.handler(&testEntry{key: "default/alive.example.com", value: value, revision: 2, created: time.Now().Add(-30 * time.Second)})
+	assert.Equal(t, 1, len(received))
+	assert.Equal(t, "alive.example.com", received[0].Hostname)
+
+	// TTL used by the receiver has the priority
+	driver.EffectiveTTL = func(discovery server.Discovery) uint {
+		return 300
+	}
+	value = []byte(`{"hostname": "slow.example.com", "ttl": 60}`)
+	driver.handler(&testEntry{key: "default/slow.example.com", value: value, revision: 3, created: time.Now().Add(-2 * time.Minute)})
+	assert.Equal(t, 2, len(received))
+	assert.Equal(t, "slow.example.com", received[1].Hostname)
+}
+
+func TestReconnect(t *testing.T) {
+	storeDir := t.TempDir()
+	natsServer := runServer(storeDir)
+
+	nodeA := newTestNode(t, natsServer.ClientURL())
+	nodeB := newTestNode(t, natsServer.ClientURL())
+
+	natsServer.Shutdown()
+	assert.Equal(t, common.StateReconnecting, <-nodeA.states)
+	assert.Equal(t, common.StateReconnecting, <-nodeB.states)
+	assert.Equal(t, common.StateReconnecting, nodeA.driver.State())
+	assert.NotNil(t, nodeA.driver.SendDiscoveryPacket(server.Discovery{Hostname: "a.example.com"}))
+
+	natsServer = runServer(storeDir)
+	defer natsServer.Shutdown()
+	for _, node := range []*testNode{nodeA, nodeB} {
+		select {
+		case state := <-node.states:
+			assert.Equal(t, common.StateConnected, state)
+		case <-time.After(2 * reconnectWait):
+			t.Fatal("driver didn't reconnect")
+		}
+	}
+
+	// Watch continues after reconnect
+	assert.Nil(t, nodeA.driver.SendDiscoveryPacket(server.Discovery{Hostname: "a.example.com"}))
+	assert.Equal(t, "a.example.com", receive(t, nodeB.received).Hostname)
+	select {
+	case <-nodeB.received:
+		t.Fatal("packet received twice")
+	case <-time.After(200 * time.Millisecond):
+	}
+
+	assert.Nil(t, nodeA.driver.Close())
+	assert.Nil(t, nodeB.driver.Close())
+	assert.Equal(t, common.StateDown, <-nodeA.states)
+}
@@ -2,6 +2,9 @@ package redis_driver
 
 import (
 	"encoding/json"
+	"net"
+	"sync"
+	"time"
 
 	"github.com/by-cx/lobby/common"
 	"github.com/by-cx/lobby/server"
@@ -10,6 +13,11 @@ import (
 	"fmt"
 )
 
+const (
+	pingInterval  = 15 * time.Second // subscription connection is checked if nothing comes in for this time
+	reconnectWait = 5 * time.Second  // time between attempts to restore the subscription
+)
+
 // Redis drivers is used to send discovery packet to other nodes into the group via Redis's pubsub protocol.
 type Driver struct {
 	Host     string
@@ -22,8 +30,14 @@ type Driver struct {
 
 	subscribeListener   common.Listener
 	unsubscribeListener common.Listener
+	rejectListener      common.RejectListener
+	state               common.StateTracker
 
 	redis *redis.Client
+
+	lock   sync.Mutex
+	pubsub *redis.PubSub
+	closed bool
 }
 
 // handler is called asynchronously so and because it cannot log directly to stderr there
@@ -31,13 +45,15 @@ type Driver struct {
 func (d *Driver) handler(payload string) {
 	message := discoveryEnvelope{}
 	err := json.Unmarshal([]byte(payload), &message)
-	if err != nil && d.LogChannel != nil {
-		d.LogChannel <- fmt.Errorf("decoding message error: %v", err).Error()
+	if err != nil {
+		d.reject(common.RejectReasonDecode, fmt.Errorf("decoding message error: %v", err))
+		return
 	}
 
 	err = message.Discovery.Validate()
-	if err != nil && d.LogChannel != nil {
-		d.LogChannel <- fmt.Errorf("validation error: %v", err).Error()
+	if err != nil {
+		d.reject(server.ValidationReason(err), fmt.Errorf("validation error: %v", err))
+		return
 	}
 
 	if message.Message == "hi" {
@@ -45,9 +61,17 @@ func (d *Driver) handler(payload string) {
 	} else if message.Message == "goodbye" {
 		d.unsubscribeListener(message.Discovery)
 	} else {
-		if d.LogChannel != nil {
-			d.LogChannel <- "incompatible message"
-		}
+		d.reject(common.RejectReasonMessage, fmt.Errorf("incompatible message %q", message.Message))
+	}
+}
+
+// reject logs the reason why the incoming packet was dropped and passes it to the reject listener
+func (d *Driver) reject(reason string, err error) {
+	if d.LogChannel != nil {
+		d.LogChannel <- err.Error()
+	}
+	if d.rejectListener != nil {
+		d.rejectListener(reason, err)
 	}
 }
 
@@ -76,24 +100,106 @@ func (d *Driver) Init() error {
 		DB:       int(d.DB),
 	})
 
-	pubsub := d.redis.Subscribe(d.Channel)
+	d.lock.Lock()
+	d.pubsub = d.redis.Subscribe(d.Channel)
+	d.lock.Unlock()
+
+	go d.receive()
+
+	return nil
+}
 
-	go func(pubsub *redis.PubSub, d *Driver) {
-		channel := pubsub.Channel()
+// receive passes incoming messages to the handler and tracks state of the subscription. Broken connection
+// is restored by the Redis client which subscribes again on its own, a connection that stops answering
+// pings is replaced by a new subscription.
+func (d *Driver) receive() {
+	pinged := false
 
-		for message := range channel {
+	for {
+		d.lock.Lock()
+		if d.closed {
+			d.lock.Unlock()
+			d.state.Set(common.StateDown)
+			return
+		}
+		pubsub := d.pubsub
+		d.lock.Unlock()
+
+		message, err := pubsub.ReceiveTimeout(pingInterval)
+		if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+			if !pinged {
+				pinged = true
+				err = pubsub.Ping()
+				if err == nil {
+					continue
+				}
+			} else {
+				err = fmt.Errorf("no answer to ping")
+				d.resubscribe()
+			}
+		}
+		if err != nil {
+			if d.isClosed() {
+				continue
+			}
+			if d.State() == common.StateConnected {
+				d.LogChannel <- fmt.Sprintf("Redis subscription lost: %v", err)
+			}
+			d.state.Set(common.StateReconnecting)
+			pinged = false
+			time.Sleep(reconnectWait)
+			continue
+		}
+
+		pinged = false
+		switch message := message.(type) {
+		case *redis.Subscription:
+			if message.Kind == "subscribe" {
+				d.state.Set(common.StateConnected)
+			}
+		case *redis.Message:
 			d.handler(message.Payload)
 		}
-	}(pubsub, d)
+	}
+}
 
-	return nil
+// resubscribe replaces the subscription by a new one with a new connection
+func (d *Driver) resubscribe() {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	if d.closed {
+		return
+	}
+	d.pubsub.Close()
+	d.pubsub = d.redis.Subscribe(d.Channel)
+}
+
+// isClosed returns true if Close was called
+func (d *Driver) isClosed() bool {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	return d.closed
 }
 
 // Close is called when all is done.
 func (d *Driver) Close() error {
+	d.lock.Lock()
+	d.closed = true
+	if d.pubsub != nil {
+		d.pubsub.Close()
+	}
+	d.lock.Unlock()
+
 	return d.redis.Close()
 }
 
+// State returns the current state of the subscription
+func (d *Driver) State() common.ConnectionState {
+	return d.state.Get()
+}
+
 // RegisterSubscribeFunction sets the function that will process the incoming messages
 func (d *Driver) RegisterSubscribeFunction(listener common.Listener) {
 	d.subscribeListener = listener
@@ -104,6 +210,16 @@ func (d *Driver) RegisterUnsubscribeFunction(listener common.Listener) {
 	d.unsubscribeListener = listener
 }
 
+// RegisterRejectFunction sets the function that is called when an incoming packet is dropped
+func (d *Driver) RegisterRejectFunction(listener common.RejectListener) {
+	d.rejectListener = listener
+}
+
+// RegisterStateFunction sets the function that is called when the connection state changes
+func (d *Driver) RegisterStateFunction(listener common.StateListener) {
+	d.state.Register(listener)
+}
+
 // SendDiscoveryPacket send discovery packet to the group.
 func (d *Driver) SendDiscoveryPacket(discovery server.Discovery) error {
 	envelope := discoveryEnvelope{
@@ -0,0 +1,220 @@
+package redis_driver
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/by-cx/lobby/common"
+	"github.com/by-cx/lobby/server"
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeRedis is a minimal Redis server that supports only the pub/sub commands used by the driver
+type fakeRedis struct {
+	listener net.Listener
+
+	lock        sync.Mutex
+	conns       map[net.Conn]bool
+	subscribers map[net.Conn]bool
+	subscribes  int // number of SUBSCRIBE commands received
+}
+
+func runFakeRedis(t *testing.T) *fakeRedis {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+
+	f := &fakeRedis{
+		listener:    listener,
+		conns:       make(map[net.Conn]bool),
+		subscribers: make(map[net.Conn]bool),
+	}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			f.lock.Lock()
+			f.conns[conn] = true
+			f.lock.Unlock()
+			go f.serve(conn)
+		}
+	}()
+
+	return f
+}
+
+func (f *fakeRedis) port() uint {
+	return uint(f.listener.Addr().(*net.TCPAddr).Port)
+}
+
+func (f *fakeRedis) subscribeCount() int {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	return f.subscribes
+}
+
+// dropConnections closes all client connections while the server keeps running
+func (f *fakeRedis) dropConnections() {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	for conn := range f.conns {
+		conn.Close()
+	}
+}
+
+func (f *fakeRedis) close() {
+	f.listener.Close()
+	f.dropConnections()
+}
+
+func (f *fakeRedis) serve(conn net.Conn) {
+	defer func() {
+		f.lock.Lock()
+		delete(f.conns, conn)
+		delete(f.subscribers, conn)
+		f.lock.Unlock()
+		conn.Close()
+	}()
+
+	reader := bufio.NewReader(conn)
+	for {
+		command, err := readCommand(reader)
+		if err != nil {
+			return
+		}
+
+		f.lock.Lock()
+		switch strings.ToLower(command[0]) {
+		case "subscribe":
+			f.subscribes++
+			f.subscribers[conn] = true
+			for _, channel := range command[1:] {
+				fmt.Fprintf(conn, "*3\r\n$9\r\nsubscribe\r\n$%d\r\n%s\r\n:1\r\n", len(channel), channel)
+			}
+		case "unsubscribe":
+			delete(f.subscribers, conn)
+			for _, channel := range command[1:] {
+				fmt.Fprintf(conn, "*3\r\n$11\r\nunsubscribe\r\n$%d\r\n%s\r\n:0\r\n", len(channel), channel)
+			}
+		case "ping":
+			fmt.Fprint(conn, "*2\r\n$4\r\npong\r\n$0\r\n\r\n")
+		case "publish":
+			channel, payload := command[1], command[2]
+			for subscriber := range f.subscribers {
+				fmt.Fprintf(subscriber, "*3\r\n$7\r\nmessage\r\n$%d\r\n%s\r\n$%d\r\n%s\r\n", len(channel), channel, len(payload), payload)
+			}
+			fmt.Fprintf(conn, ":%d\r\n", len(f.subscribers))
+		default:
+			fmt.Fprint(conn, "+OK\r\n")
+		}
+		f.lock.Unlock()
+	}
+}
+
+// readCommand reads a command sent as RESP array of bulk strings
+func readCommand(reader *bufio.Reader) ([]string, error) {
+	line, err := reader.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	if !strings.HasPrefix(line, "*") {
+		return nil, fmt.Errorf("unexpected line %q", line)
+	}
+	count, err := strconv.Atoi(strings.TrimSpace(line[1:]))
+	if err != nil {
+		return nil, err
+	}
+
+	command := []string{}
+	for i := 0; i < count; i++ {
+		line, err = reader.ReadString('\n')
+		if err != nil {
+			return nil, err
+		}
+		length, err := strconv.Atoi(strings.TrimSpace(line[1:]))
+		if err != nil {
+			return nil, err
+		}
+		data := make([]byte, length+2)
+		_, err = io.ReadFull(reader, data)
+		if err != nil {
+			return nil, err
+		}
+		command = append(command, string(data[:length]))
+	}
+
+	return command, nil
+}
+
+func TestReconnect(t *testing.T) {
+	redisServer := runFakeRedis(t)
+	defer redisServer.close()
+
+	states := make(chan common.ConnectionState, 10)
+	received := make(chan server.Discovery, 10)
+	driver := &Driver{
+		Host:       "127.0.0.1",
+		Port:       redisServer.port(),
+		Channel:    "lobby:discovery",
+		LogChannel: make(chan string, 10),
+	}
+	driver.RegisterStateFunction(func(state common.ConnectionState) {
+		states <- state
+	})
+	driver.RegisterSubscribeFunction(func(discovery server.Discovery) {
+		received <- discovery
+	})
+	driver.RegisterUnsubscribeFunction(func(discovery server.Discovery) {})
+
+	assert.Nil(t, driver.Init())
+	assert.Equal(t, common.StateConnected, <-states)
+	assert.Equal(t, 1, redisServer.subscribeCount())
+
+	redisServer.dropConnections()
+	select {
+	case state := <-states:
+		assert.Equal(t, common.StateReconnecting, state)
+	case <-time.After(time.Second):
+		t.Fatal("lost connection wasn't detected")
+	}
+	assert.Contains(t, <-driver.LogChannel, "Redis subscription lost")
+
+	select {
+	case state := <-states:
+		assert.Equal(t, common.StateConnected, state)
+	case <-time.After(2 * reconnectWait):
+		t.Fatal("driver didn't reconnect")
+	}
+
+	// The subscription is restored exactly once
+	assert.Nil(t, driver.SendDiscoveryPacket(server.Discovery{Hostname: "test.example.com"}))
+	select {
+	case discovery := <-received:
+		assert.Equal(t, "test.example.com", discovery.Hostname)
+	case <-time.After(time.Second):
+		t.Fatal("packet not received")
+	}
+	select {
+	case <-received:
+		t.Fatal("packet received twice")
+	case <-time.After(200 * time.Millisecond):
+	}
+	assert.Equal(t, 2, redisServer.subscribeCount())
+	assert.Equal(t, 0, len(states))
+
+	assert.Nil(t, driver.Close())
+	select {
+	case state := <-states:
+		assert.Equal(t, common.StateDown, state)
+	case <-time.After(time.Second):
+		t.Fatal("driver isn't down after close")
+	}
+}
@@ -0,0 +1,320 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os/exec"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Types of health checks
+const (
+	CheckTCP  = "tcp"  // connects to host:port
+	CheckHTTP = "http" // sends GET request and expects given status code
+	CheckExec = "exec" // runs a command and expects given exit code
+)
+
+const (
+	DefaultCheckInterval = 10 * time.Second // how often the check runs if not configured
+	DefaultCheckTimeout  = 5 * time.Second  // timeout of the check if not configured
+)
+
+// CheckStatus describes current state of a health check
+type CheckStatus struct {
+	Name      string   `json:"name"`
+	Type      string   `json:"type"`
+	Target    string   `json:"target"`
+	Healthy   bool     `json:"healthy"`
+	Labels    Labels   `json:"labels,omitempty"`     // labels gated by the check
+	Files     []string `json:"files,omitempty"`      // label files gated by the check
+	LastCheck int64    `json:"last_check,omitempty"` // unix timestamp of the last check
+	LastError string   `json:"last_error,omitempty"` // error of the last check, empty if it passed
+	Successes int      `json:"successes"`            // number of consecutive successful checks
+	Failures  int      `json:"failures"`             // number of consecutive failed checks
+}
+
+// HealthCheck gates labels, they are advertised only while the check passes. The first check sets the state
+// directly, then it takes Rise consecutive successes to become healthy and Fall consecutive failures to become
+// unhealthy. Labels are withdrawn until the first check finishes.
+type HealthCheck struct {
+	Name           string        // name of the check
+	Type           string        // CheckTCP, CheckHTTP or CheckExec
+	Target         string        // host:port for TCP, URL for HTTP, command for exec check split by ParseCommand
+	ExpectedStatus int           // expected HTTP status code, 200 if it's zero
+	ExpectedCode   int           // expected exit code of the command
+	Interval       time.Duration // how often the check runs, DefaultCheckInterval is used if it's zero
+	Timeout        time.Duration // timeout of the check, DefaultCheckTimeout is used if it's zero
+	Rise           int           // consecutive successes needed to become healthy, 1 if it's zero
+	Fall           int           // consecutive failures needed to become unhealthy, 1 if it's zero
+	Labels         Labels        // labels gated by the check
+	Files          []string      // names of the files in LabelsPath whose labels are gated by the check
+	OnChange       func()        // called when the check changes its state, can be nil
+
+	lock      sync.RWMutex
+	checked   bool
+	healthy   bool
+	successes int
+	failures  int
+	lastCheck time.Time
+	lastError error
+}
+
+// IsValidCheckType returns true if the check type is supported
+func IsValidCheckType(checkType string) bool {
+	return checkType == CheckTCP || checkType == CheckHTTP || checkType == CheckExec
+}
+
+func (c *HealthCheck) timeout() time.Duration {
+	if c.Timeout <= 0 {
+		return DefaultCheckTimeout
+	}
+	return c.Timeout
+}
+
+func (c *HealthCheck) interval() time.Duration {
+	if c.Interval <= 0 {
+		return DefaultCheckInterval
+	}
+	return c.Interval
+}
+
+func threshold(value int) int {
+	if value <= 0 {
+		return 1
+	}
+	return value
+}
+
+// Healthy returns true if the gated labels should be advertised
+func (c *HealthCheck) Healthy() bool {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+
+	return c.healthy
+}
+
+// Gates returns true if the label is gated by this check
+func (c *HealthCheck) Gates(label SourcedLabel) bool {
+	for _, gated := range c.Labels {
+		if gated == label.Label {
+			return true
+		}
+	}
+
+	for _, source := range label.Sources {
+		if source.Type != LabelSourceFile {
+			continue
+		}
+		for _, file := range c.Files {
+			if path.Base(source.File) == file {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// Status returns current state of the check
+func (c *HealthCheck) Status() CheckStatus {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+
+	status := CheckStatus{
+		Name:      c.Name,
+		Type:      c.Type,
+		Target:    c.Target,
+		Healthy:   c.healthy,
+		Labels:    c.Labels,
+		Files:     c.Files,
+		Successes: c.successes,
+		Failures:  c.failures,
+	}
+	if !c.lastCheck.IsZero() {
+		status.LastCheck = c.lastCheck.Unix()
+	}
+	if c.lastError != nil {
+		status.LastError = c.lastError.Error()
+	}
+
+	return status
+}
+
+// check runs the check once and returns nil if it passed
+func (c *HealthCheck) check() error {
+	switch c.Type {
+	case CheckTCP:
+		conn, err := net.DialTimeout("tcp", c.Target, c.timeout())
+		if err != nil {
+			return err
+		}
+		return conn.Close()
+	case CheckHTTP:
+		expected := c.ExpectedStatus
+		if expected == 0 {
+			expected = http.StatusOK
+		}
+
+		client := &http.Client{Timeout: c.timeout()}
+		resp, err := client.Get(c.Target)
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+
+		if resp.StatusCode != expected {
+			return fmt.Errorf("status %d, expected %d", resp.StatusCode, expected)
+		}
+		return nil
+	case CheckExec:
+		command, err := ParseCommand(c.Target)
+		if err != nil {
+			return fmt.Errorf("command error: %v", err)
+		}
+		if len(command) == 0 {
+			return fmt.Errorf("no command")
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), c.timeout())
+		defer cancel()
+
+		err = exec.CommandContext(ctx, command[0], command[1:]...).Run()
+		if ctx.Err() == context.DeadlineExceeded {
+			return fmt.Errorf("timeout after %s", c.timeout())
+		}
+
+		code := 0
+		exitErr := &exec.ExitError{}
+		if errors.As(err, &exitErr) {
+			code = exitErr.ExitCode()
+		} else if err != nil {
+			return err
+		}
+
+		if code != c.ExpectedCode {
+			return fmt.Errorf("exit code %d, expected %d", code, c.ExpectedCode)
+		}
+		return nil
+	default:
+		return fmt.Errorf("unknown check type %s", c.Type)
+	}
+}
+
+// Run runs the check once and updates its state. OnChange is called if the state has changed.
+func (c *HealthCheck) Run() error {
+	err := c.check()
+
+	c.lock.Lock()
+	wasHealthy := c.healthy
+	c.lastCheck = time.Now()
+	c.lastError = err
+	if err == nil {
+		c.successes++
+		c.failures = 0
+		if !c.checked || c.successes >= threshold(c.Rise) {
+			c.healthy = true
+		}
+	} else {
+		c.failures++
+		c.successes = 0
+		if !c.checked || c.failures >= threshold(c.Fall) {
+			c.healthy = false
+		}
+	}
+	c.checked = true
+	changed := wasHealthy != c.healthy
+	c.lock.Unlock()
+
+	if changed && c.OnChange != nil {
+		c.OnChange()
+	}
+
+	if err != nil {
+		return fmt.Errorf("health check %s failed: %v", c.Name, err)
+	}
+	return nil
+}
+
+// Start runs the check regularly in background until the returned function is called. Failures are sent into
+// errors channel if it's not nil.
+func (c *HealthCheck) Start(errors chan<- error) func() {
+	done := make(chan struct{})
+
+	go func() {
+		ticker := time.NewTicker(c.interval())
+		defer ticker.Stop()
+
+		for {
+			err := c.Run()
+			if err != nil && errors != nil {
+				errors <- err
+			}
+
+			select {
+			case <-ticker.C:
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			close(done)
+		})
+	}
+}
+
+// SetOptions sets options of the check from space separated key=value pairs, e.g.
+// "interval=10s timeout=2s rise=2 fall=3 status=204 code=0".
+func (c *HealthCheck) SetOptions(options string) error {
+	for _, option := range strings.Fields(options) {
+		parts := strings.SplitN(option, "=", 2)
+		if len(parts) != 2 {
+			return fmt.Errorf("invalid check option %q", option)
+		}
+
+		var err error
+		switch parts[0] {
+		case "interval", "timeout":
+			var value time.Duration
+			value, err = time.ParseDuration(parts[1])
+			if err == nil && value <= 0 {
+				err = fmt.Errorf("duration has to be positive")
+			}
+			if parts[0] == "interval" {
+				c.Interval = value
+			} else {
+				c.Timeout = value
+			}
+		case "rise", "fall", "status", "code":
+			var value int
+			value, err = strconv.Atoi(parts[1])
+			switch parts[0] {
+			case "rise":
+				c.Rise = value
+			case "fall":
+				c.Fall = value
+			case "status":
+				c.ExpectedStatus = value
+			case "code":
+				c.ExpectedCode = value
+			}
+		default:
+			return fmt.Errorf("unknown check option %q", parts[0])
+		}
+		if err != nil {
+			return fmt.Errorf("invalid value of check option %q: %v", option, err)
+		}
+	}
+
+	return nil
+}
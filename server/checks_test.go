@@ -0,0 +1,147 @@
+package server
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHealthCheckTypes(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	defer listener.Close()
+
+	check := HealthCheck{Name: "tcp", Type: CheckTCP, Target: listener.Addr().String()}
+	assert.Nil(t, check.Run())
+	assert.True(t, check.Healthy())
+
+	listener.Close()
+	assert.NotNil(t, check.Run())
+	assert.False(t, check.Healthy())
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/health" {
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer server.Close()
+
+	check = HealthCheck{Name: "http", Type: CheckHTTP, Target: server.URL + "/health", ExpectedStatus: http.StatusNoContent}
+	assert.Nil(t, check.Run())
+	check.Target = server.URL + "/other"
+	err = check.Run()
+	assert.NotNil(t, err)
+	assert.Contains(t, err.Error(), "status 503, expected 204")
+
+	check = HealthCheck{Name: "exec", Type: CheckExec, Target: "false", ExpectedCode: 1}
+	assert.Nil(t, check.Run())
+	check.ExpectedCode = 0
+	err = check.Run()
+	assert.NotNil(t, err)
+	assert.Contains(t, err.Error(), "exit code 1, expected 0")
+
+	status := check.Status()
+	assert.Equal(t, "exec", status.Name)
+	assert.False(t, status.Healthy)
+	assert.Equal(t, 1, status.Failures)
+	assert.Contains(t, status.LastError, "exit code 1")
+
+	// Quoted arguments are passed as they are, the command doesn't run through a shell
+	check = HealthCheck{Name: "exec", Type: CheckExec, Target: `test "a b" = 'a b'`}
+	assert.Nil(t, check.Run())
+	check.Target = `test "a b" = a b`
+	assert.NotNil(t, check.Run())
+}
+
+func TestHealthCheckThresholds(t *testing.T) {
+	changes := 0
+	check := HealthCheck{Name: "test", Type: CheckExec, Target: "true", Rise: 2, Fall: 3, OnChange: func() {
+		changes++
+	}}
+
+	// Labels are withdrawn until the first check and the first check sets the state directly
+	assert.False(t, check.Healthy())
+	check.Run()
+	assert.True(t, check.Healthy())
+	assert.Equal(t, 1, changes)
+
+	check.Target = "false"
+	check.Run()
+	check.Run()
+	assert.True(t, check.Healthy())
+	check.Run()
+	assert.False(t, check.Healthy())
+	assert.Equal(t, 2, changes)
+
+	check.Target = "true"
+	check.Run()
+	assert.False(t, check.Healthy())
+	check.Run()
+	assert.True(t, check.Healthy())
+	assert.Equal(t, 3, changes)
+	assert.Equal(t, 2, check.Status().Successes)
+}
+
+func TestHealthCheckGating(t *testing.T) {
+	err := os.MkdirAll(testLabelPath, os.ModePerm)
+	assert.Nil(t, err)
+	defer os.RemoveAll(tmpPath)
+
+	err = os.WriteFile(testLabelPath+"/mail", []byte("service:imap\nservice:smtp"), 0644)
+	assert.Nil(t, err)
+
+	smtp := &HealthCheck{Name: "smtp", Type: CheckExec, Target: "false", Labels: Labels{"service:smtp"}}
+	files := &HealthCheck{Name: "mail", Type: CheckExec, Target: "true", Files: []string{"mail"}}
+	localHost := LocalHost{
+		LabelsPath:            testLabelPath,
+		RuntimeLabelsFilename: "_runtime",
+		HostnameOverride:      "test.example.com",
+		InitialLabels:         Labels{"service:smtp", "role:primary"},
+		Checks:                []*HealthCheck{smtp, files},
+	}
+
+	// Nothing is checked yet
+	discovery, err := localHost.GetIdentification()
+	assert.Nil(t, err)
+	assert.Equal(t, Labels{"role:primary"}, discovery.Labels)
+
+	smtp.Run()
+	files.Run()
+	discovery, err = localHost.GetIdentification()
+	assert.Nil(t, err)
+	assert.Equal(t, Labels{"role:primary", "service:imap"}, discovery.Labels)
+
+	labels, err := localHost.LabelSources()
+	assert.Nil(t, err)
+	assert.Equal(t, Label("service:smtp"), labels[2].Label)
+	assert.Equal(t, []string{"smtp"}, labels[2].WithdrawnBy)
+
+	smtp.Target = "true"
+	smtp.Run()
+	discovery, err = localHost.GetIdentification()
+	assert.Nil(t, err)
+	assert.Equal(t, Labels{"role:primary", "service:imap", "service:smtp"}, discovery.Labels)
+}
+
+func TestHealthCheckSetOptions(t *testing.T) {
+	check := HealthCheck{}
+	err := check.SetOptions("interval=30s timeout=2s rise=2 fall=3 status=204 code=1")
+	assert.Nil(t, err)
+	assert.Equal(t, 2, check.Rise)
+	assert.Equal(t, 3, check.Fall)
+	assert.Equal(t, 204, check.ExpectedStatus)
+	assert.Equal(t, 1, check.ExpectedCode)
+	assert.Equal(t, "30s", check.Interval.String())
+	assert.Equal(t, "2s", check.Timeout.String())
+
+	assert.NotNil(t, check.SetOptions("interval=-1s"))
+	assert.NotNil(t, check.SetOptions("rise=two"))
+	assert.NotNil(t, check.SetOptions("every=10s"))
+	assert.NotNil(t, check.SetOptions("rise"))
+}
@@ -0,0 +1,414 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	CloudMetadataPrefix   = "cloud:"                 // prefix of labels published by CloudMetadata provider
+	DefaultCloudEndpoint  = "http://169.254.169.254" // link-local address of the metadata service in AWS, GCP and OpenStack
+	DefaultCloudInterval  = 5 * time.Minute          // how often the metadata are refreshed if not configured
+	DefaultCloudTimeout   = 2 * time.Second          // timeout of a single request to the metadata service if not configured
+	awsTokenTTL           = "21600"                  // lifetime of IMDSv2 token [secs]
+	gcpMetadataFlavor     = "Google"                 // value of the Metadata-Flavor header required by GCP
+	openStackMetadataPath = "/openstack/latest/meta_data.json"
+)
+
+// Supported clouds of CloudMetadata provider
+const (
+	CloudAuto      = "auto" // try AWS, GCP and OpenStack in this order
+	CloudAWS       = "aws"
+	CloudGCP       = "gcp"
+	CloudOpenStack = "openstack"
+)
+
+// errNotFound is returned by metadata requests when the metadata service returns 404
+var errNotFound = fmt.Errorf("not found")
+
+// CloudMetadata is a label provider that reads instance metadata from the cloud's metadata service
+// and publishes them under CloudMetadataPrefix:
+//
+//	cloud:provider:aws
+//	cloud:instance_id:i-0123456789abcdef0
+//	cloud:instance_type:t3.micro
+//	cloud:region:eu-central-1
+//	cloud:zone:eu-central-1a
+//	cloud:private_ip4:10.0.1.15
+//	cloud:public_ip4:3.120.1.2
+//	cloud:tag:KEY:VALUE                     AWS instance tags, GCP network tags (without value), OpenStack metadata
+//
+// Metadata are read in background by Start, Labels returns the result of the last successful read.
+type CloudMetadata struct {
+	Cloud    string        // one of CloudAuto, CloudAWS, CloudGCP, CloudOpenStack, empty means CloudAuto
+	Endpoint string        // base URL of the metadata service, DefaultCloudEndpoint is used if it's empty
+	Interval time.Duration // how often the metadata are refreshed, DefaultCloudInterval is used if it's zero
+	Timeout  time.Duration // timeout of a single request, DefaultCloudTimeout is used if it's zero
+	OnChange func()        // called when the labels change, can be nil
+
+	lock        sync.RWMutex
+	labels      Labels
+	detected    string // cloud detected by the last successful read
+	lastRun     time.Time
+	lastSuccess time.Time
+	lastError   error
+}
+
+// IsValidCloud returns true if the cloud is supported by CloudMetadata
+func IsValidCloud(cloud string) bool {
+	switch cloud {
+	case CloudAuto, CloudAWS, CloudGCP, CloudOpenStack:
+		return true
+	}
+	return false
+}
+
+// Name returns name of the provider
+func (c *CloudMetadata) Name() string {
+	return "cloud"
+}
+
+// Labels returns labels from the last successful read of the metadata
+func (c *CloudMetadata) Labels() (Labels, error) {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+
+	return append(Labels{}, c.labels...), nil
+}
+
+// Status returns result of the last reads of the metadata
+func (c *CloudMetadata) Status() ProviderStatus {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+
+	status := ProviderStatus{
+		Name:   c.Name(),
+		Labels: append(Labels{}, c.labels...),
+	}
+	if !c.lastRun.IsZero() {
+		status.LastRun = c.lastRun.Unix()
+	}
+	if !c.lastSuccess.IsZero() {
+		status.LastSuccess = c.lastSuccess.Unix()
+	}
+	if c.lastError != nil {
+		status.LastError = c.lastError.Error()
+	}
+
+	return status
+}
+
+func (c *CloudMetadata) endpoint() string {
+	if len(c.Endpoint) == 0 {
+		return DefaultCloudEndpoint
+	}
+	return strings.TrimSuffix(c.Endpoint, "/")
+}
+
+func (c *CloudMetadata) interval() time.Duration {
+	if c.Interval <= 0 {
+		return DefaultCloudInterval
+	}
+	return c.Interval
+}
+
+func (c *CloudMetadata) client() *http.Client {
+	timeout := c.Timeout
+	if timeout <= 0 {
+		timeout = DefaultCloudTimeout
+	}
+	return &http.Client{Timeout: timeout}
+}
+
+// request sends request to the metadata service and returns body of the response
+func (c *CloudMetadata) request(method, path string, headers map[string]string) (string, error) {
+	req, err := http.NewRequest(method, c.endpoint()+path, nil)
+	if err != nil {
+		return "", err
+	}
+	for key, value := range headers {
+		req.Header.Set(key, value)
+	}
+
+	resp, err := c.client().Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return "", err
+	}
+
+	if resp.StatusCode == http.StatusNotFound {
+		return "", errNotFound
+	}
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("%s %s: unexpected status %d", method, path, resp.StatusCode)
+	}
+
+	return strings.TrimSpace(string(body)), nil
+}
+
+// Run reads the metadata once. Labels are kept from the last successful read if it fails.
+func (c *CloudMetadata) Run() error {
+	c.lock.RLock()
+	cloud := c.detected
+	c.lock.RUnlock()
+	if len(cloud) == 0 {
+		cloud = c.Cloud
+	}
+
+	var labels Labels
+	var err error
+
+	switch cloud {
+	case CloudAWS:
+		labels, err = c.readAWS()
+	case CloudGCP:
+		labels, err = c.readGCP()
+	case CloudOpenStack:
+		labels, err = c.readOpenStack()
+	case CloudAuto, "":
+		errors := []string{}
+		for _, reader := range []struct {
+			cloud string
+			read  func() (Labels, error)
+		}{{CloudAWS, c.readAWS}, {CloudGCP, c.readGCP}, {CloudOpenStack, c.readOpenStack}} {
+			labels, err = reader.read()
+			if err == nil {
+				cloud = reader.cloud
+				break
+			}
+			errors = append(errors, fmt.Sprintf("%s: %v", reader.cloud, err))
+		}
+		if err != nil {
+			err = fmt.Errorf("no metadata service detected (%s)", strings.Join(errors, ", "))
+		}
+	default:
+		err = fmt.Errorf("unsupported cloud %s", cloud)
+	}
+
+	if err == nil {
+		labels = append(Labels{Label(CloudMetadataPrefix + "provider:" + cloud)}, labels...)
+	}
+
+	c.lock.Lock()
+	previous := c.labels
+	c.lastRun = time.Now()
+	c.lastError = err
+	if err == nil {
+		c.labels = labels
+		c.detected = cloud
+		c.lastSuccess = c.lastRun
+	}
+	changed := labelsDifference(previous, c.labels) != nil || labelsDifference(c.labels, previous) != nil
+	c.lock.Unlock()
+
+	if changed && c.OnChange != nil {
+		c.OnChange()
+	}
+
+	if err != nil {
+		return fmt.Errorf("cloud metadata error: %v", err)
+	}
+	return nil
+}
+
+// Start reads the metadata regularly in background until the returned function is called. Errors are sent
+// into errors channel if it's not nil.
+func (c *CloudMetadata) Start(errors chan<- error) func() {
+	done := make(chan struct{})
+
+	go func() {
+		ticker := time.NewTicker(c.interval())
+		defer ticker.Stop()
+
+		for {
+			err := c.Run()
+			if err != nil && errors != nil {
+				errors <- err
+			}
+
+			select {
+			case <-ticker.C:
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			close(done)
+		})
+	}
+}
+
+// appendCloudLabel adds label with the metadata value if it's not empty and it's a valid label
+func appendCloudLabel(labels Labels, name, value string) Labels {
+	value = strings.TrimSpace(value)
+	if len(value) == 0 {
+		return labels
+	}
+
+	label := Label(CloudMetadataPrefix + name + ":" + value)
+	if label.Validate() != nil {
+		return labels
+	}
+	return append(labels, label)
+}
+
+// readAWS reads metadata from AWS IMDSv2
+func (c *CloudMetadata) readAWS() (Labels, error) {
+	token, err := c.request(http.MethodPut, "/latest/api/token", map[string]string{"X-aws-ec2-metadata-token-ttl-seconds": awsTokenTTL})
+	if err != nil {
+		return nil, fmt.Errorf("getting IMDSv2 token error: %v", err)
+	}
+	headers := map[string]string{"X-aws-ec2-metadata-token": token}
+
+	labels := Labels{}
+	for _, field := range []struct{ name, path string }{
+		{"instance_id", "instance-id"},
+		{"instance_type", "instance-type"},
+		{"region", "placement/region"},
+		{"zone", "placement/availability-zone"},
+		{"private_ip4", "local-ipv4"},
+		{"public_ip4", "public-ipv4"},
+	} {
+		value, err := c.request(http.MethodGet, "/latest/meta-data/"+field.path, headers)
+		if err == errNotFound && field.name != "instance_id" {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		labels = appendCloudLabel(labels, field.name, value)
+	}
+
+	// Tags are available only when they are allowed in instance metadata options
+	keys, err := c.request(http.MethodGet, "/latest/meta-data/tags/instance", headers)
+	if err != nil && err != errNotFound {
+		return nil, err
+	}
+	if err == nil {
+		for _, key := range strings.Split(keys, "\n") {
+			key = strings.TrimSpace(key)
+			if len(key) == 0 {
+				continue
+			}
+			value, err := c.request(http.MethodGet, "/latest/meta-data/tags/instance/"+url.PathEscape(key), headers)
+			if err != nil {
+				return nil, err
+			}
+			labels = appendCloudLabel(labels, "tag:"+key, value)
+		}
+	}
+
+	return labels, nil
+}
+
+// readGCP reads metadata from Google Compute Engine metadata server
+func (c *CloudMetadata) readGCP() (Labels, error) {
+	headers := map[string]string{"Metadata-Flavor": gcpMetadataFlavor}
+	values := make(map[string]string)
+
+	for _, path := range []string{"id", "machine-type", "zone", "network-interfaces/0/ip", "network-interfaces/0/access-configs/0/external-ip", "tags"} {
+		value, err := c.request(http.MethodGet, "/computeMetadata/v1/instance/"+path, headers)
+		if err == errNotFound {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		values[path] = value
+	}
+
+	if len(values["id"]) == 0 {
+		return nil, fmt.Errorf("instance ID not found")
+	}
+
+	// Machine type and zone are returned as projects/PROJECT/zones/ZONE
+	lastPart := func(value string) string {
+		return value[strings.LastIndex(value, "/")+1:]
+	}
+	zone := lastPart(values["zone"])
+	region := zone
+	if idx := strings.LastIndex(zone, "-"); idx > 0 {
+		region = zone[:idx]
+	}
+
+	labels := Labels{}
+	labels = appendCloudLabel(labels, "instance_id", values["id"])
+	labels = appendCloudLabel(labels, "instance_type", lastPart(values["machine-type"]))
+	labels = appendCloudLabel(labels, "region", region)
+	labels = appendCloudLabel(labels, "zone", zone)
+	labels = appendCloudLabel(labels, "private_ip4", values["network-interfaces/0/ip"])
+	labels = appendCloudLabel(labels, "public_ip4", values["network-interfaces/0/access-configs/0/external-ip"])
+
+	if len(values["tags"]) > 0 {
+		tags := []string{}
+		err := json.Unmarshal([]byte(values["tags"]), &tags)
+		if err != nil {
+			return nil, fmt.Errorf("decoding tags error: %v", err)
+		}
+		for _, tag := range tags {
+			labels = appendCloudLabel(labels, "tag", tag)
+		}
+	}
+
+	return labels, nil
+}
+
+// readOpenStack reads metadata from OpenStack metadata service, IP addresses and instance type come from its EC2 compatible API
+func (c *CloudMetadata) readOpenStack() (Labels, error) {
+	body, err := c.request(http.MethodGet, openStackMetadataPath, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	metadata := struct {
+		UUID             string            `json:"uuid"`
+		AvailabilityZone string            `json:"availability_zone"`
+		Meta             map[string]string `json:"meta"`
+	}{}
+	err = json.Unmarshal([]byte(body), &metadata)
+	if err != nil {
+		return nil, fmt.Errorf("decoding metadata error: %v", err)
+	}
+
+	labels := Labels{}
+	labels = appendCloudLabel(labels, "instance_id", metadata.UUID)
+
+	instanceType, err := c.request(http.MethodGet, "/latest/meta-data/instance-type", nil)
+	if err == nil {
+		labels = appendCloudLabel(labels, "instance_type", instanceType)
+	}
+	labels = appendCloudLabel(labels, "zone", metadata.AvailabilityZone)
+	for _, field := range []struct{ name, path string }{{"private_ip4", "local-ipv4"}, {"public_ip4", "public-ipv4"}} {
+		value, err := c.request(http.MethodGet, "/latest/meta-data/"+field.path, nil)
+		if err == nil {
+			labels = appendCloudLabel(labels, field.name, value)
+		}
+	}
+
+	keys := []string{}
+	for key := range metadata.Meta {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		labels = appendCloudLabel(labels, "tag:"+key, metadata.Meta[key])
+	}
+
+	return labels, nil
+}
@@ -0,0 +1,162 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeAWS emulates AWS IMDSv2
+func fakeAWS() http.Handler {
+	values := map[string]string{
+		"/latest/meta-data/instance-id":                 "i-0123456789abcdef0",
+		"/latest/meta-data/instance-type":               "t3.micro",
+		"/latest/meta-data/placement/region":            "eu-central-1",
+		"/latest/meta-data/placement/availability-zone": "eu-central-1a",
+		"/latest/meta-data/local-ipv4":                  "10.0.1.15",
+		"/latest/meta-data/tags/instance":               "Name\nrole",
+		"/latest/meta-data/tags/instance/Name":          "web1",
+		"/latest/meta-data/tags/instance/role":          "frontend",
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodPut && r.URL.Path == "/latest/api/token" && r.Header.Get("X-aws-ec2-metadata-token-ttl-seconds") != "" {
+			w.Write([]byte("secret"))
+			return
+		}
+		if r.Header.Get("X-aws-ec2-metadata-token") != "secret" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		value, ok := values[r.URL.Path]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Write([]byte(value))
+	})
+}
+
+// fakeGCP emulates GCE metadata server
+func fakeGCP() http.Handler {
+	values := map[string]string{
+		"/computeMetadata/v1/instance/id":                                                "1234567890",
+		"/computeMetadata/v1/instance/machine-type":                                      "projects/123/machineTypes/e2-medium",
+		"/computeMetadata/v1/instance/zone":                                              "projects/123/zones/europe-west1-b",
+		"/computeMetadata/v1/instance/network-interfaces/0/ip":                           "10.132.0.2",
+		"/computeMetadata/v1/instance/network-interfaces/0/access-configs/0/external-ip": "34.76.1.2",
+		"/computeMetadata/v1/instance/tags":                                              `["http-server","smtp"]`,
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		value, ok := values[r.URL.Path]
+		if !ok || r.Header.Get("Metadata-Flavor") != "Google" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Write([]byte(value))
+	})
+}
+
+// fakeOpenStack emulates OpenStack metadata service with EC2 compatible API
+func fakeOpenStack() http.Handler {
+	values := map[string]string{
+		"/openstack/latest/meta_data.json": `{"uuid": "d8e02d56-2648-49a3-bf97-6be8f1204f38", "availability_zone": "nova", "meta": {"role": "db"}}`,
+		"/latest/meta-data/instance-type":  "m1.small",
+		"/latest/meta-data/local-ipv4":     "192.168.0.5",
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		value, ok := values[r.URL.Path]
+		if !ok || r.Method != http.MethodGet {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Write([]byte(value))
+	})
+}
+
+func TestCloudMetadataAWS(t *testing.T) {
+	server := httptest.NewServer(fakeAWS())
+	defer server.Close()
+
+	changes := 0
+	provider := CloudMetadata{Cloud: CloudAWS, Endpoint: server.URL, OnChange: func() { changes++ }}
+	err := provider.Run()
+	assert.Nil(t, err)
+
+	labels, err := provider.Labels()
+	assert.Nil(t, err)
+	assert.Equal(t, Labels{
+		"cloud:provider:aws",
+		"cloud:instance_id:i-0123456789abcdef0",
+		"cloud:instance_type:t3.micro",
+		"cloud:region:eu-central-1",
+		"cloud:zone:eu-central-1a",
+		"cloud:private_ip4:10.0.1.15",
+		"cloud:tag:Name:web1",
+		"cloud:tag:role:frontend",
+	}, labels)
+	assert.Equal(t, 1, changes)
+
+	// Labels are kept when the metadata service is not available
+	server.Close()
+	err = provider.Run()
+	assert.NotNil(t, err)
+	labels, _ = provider.Labels()
+	assert.Equal(t, 8, len(labels))
+	assert.Equal(t, 1, changes)
+	assert.NotEqual(t, "", provider.Status().LastError)
+}
+
+func TestCloudMetadataGCP(t *testing.T) {
+	server := httptest.NewServer(fakeGCP())
+	defer server.Close()
+
+	provider := CloudMetadata{Cloud: CloudGCP, Endpoint: server.URL}
+	err := provider.Run()
+	assert.Nil(t, err)
+
+	labels, _ := provider.Labels()
+	assert.Equal(t, Labels{
+		"cloud:provider:gcp",
+		"cloud:instance_id:1234567890",
+		"cloud:instance_type:e2-medium",
+		"cloud:region:europe-west1",
+		"cloud:zone:europe-west1-b",
+		"cloud:private_ip4:10.132.0.2",
+		"cloud:public_ip4:34.76.1.2",
+		"cloud:tag:http-server",
+		"cloud:tag:smtp",
+	}, labels)
+}
+
+func TestCloudMetadataAuto(t *testing.T) {
+	server := httptest.NewServer(fakeOpenStack())
+	defer server.Close()
+
+	provider := CloudMetadata{Endpoint: server.URL}
+	err := provider.Run()
+	assert.Nil(t, err)
+
+	labels, _ := provider.Labels()
+	assert.Equal(t, Labels{
+		"cloud:provider:openstack",
+		"cloud:instance_id:d8e02d56-2648-49a3-bf97-6be8f1204f38",
+		"cloud:instance_type:m1.small",
+		"cloud:zone:nova",
+		"cloud:private_ip4:192.168.0.5",
+		"cloud:tag:role:db",
+	}, labels)
+
+	gcpServer := httptest.NewServer(fakeGCP())
+	defer gcpServer.Close()
+
+	provider = CloudMetadata{Cloud: CloudAuto, Endpoint: gcpServer.URL}
+	err = provider.Run()
+	assert.Nil(t, err)
+	labels, _ = provider.Labels()
+	assert.Equal(t, Label("cloud:provider:gcp"), labels[0])
+}
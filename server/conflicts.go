@@ -0,0 +1,202 @@
+package server
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"time"
+)
+
+const MachineIDFile = "/etc/machine-id" // systemd's machine ID used as default instance ID
+
+// Conflict describes a hostname that is announced by more than one instance at the same time,
+// usually it's a cloned VM or wrong hostname override.
+type Conflict struct {
+	Namespace   string   `json:"namespace"`
+	Hostname    string   `json:"hostname"`
+	InstanceIDs []string `json:"instance_ids"`
+	Since       int64    `json:"since"` // unix timestamp when the conflict was detected
+}
+
+// hostnameInstances keeps track of instances announcing the same hostname
+type hostnameInstances struct {
+	lastSeen      map[string]instanceSeen // instance ID -> last packet of the instance
+	conflictSince int64                   // 0 if there is no conflict
+}
+
+// instanceSeen is the time of the last packet of an instance and its effective TTL
+type instanceSeen struct {
+	time int64
+	ttl  int64
+}
+
+// trackInstance records packet from the discovery's instance and it returns conflict if there is a new one.
+// Instances not seen longer than their effective TTL are forgotten. It has to be called with the write lock held.
+func (d *Discoveries) trackInstance(discovery Discovery) *Conflict {
+	if len(discovery.InstanceID) == 0 {
+		return nil
+	}
+
+	if d.instances == nil {
+		d.instances = make(map[string]*hostnameInstances)
+	}
+
+	key := discoveryKey(discovery.Namespace, discovery.Hostname)
+	instances, ok := d.instances[key]
+	if !ok {
+		instances = &hostnameInstances{lastSeen: make(map[string]instanceSeen)}
+		d.instances[key] = instances
+	}
+	ttl := int64(d.EffectiveTTL(discovery))
+	if ttl == 0 {
+		ttl = TimeToLife
+	}
+	instances.lastSeen[discovery.InstanceID] = instanceSeen{time: discovery.LastCheck, ttl: ttl}
+	d.pruneInstances(key)
+
+	if len(instances.lastSeen) > 1 && instances.conflictSince == 0 {
+		instances.conflictSince = discovery.LastCheck
+		conflict := d.conflict(key)
+		return &conflict
+	}
+
+	return nil
+}
+
+// pruneInstances forgets instances of the hostname not seen for longer than their effective TTL. Time while
+// the storage is frozen is not counted, see SetConnected. It has to be called with the write lock held.
+func (d *Discoveries) pruneInstances(key string) {
+	instances, ok := d.instances[key]
+	if !ok {
+		return
+	}
+
+	now := time.Now().Unix()
+	frozen := d.frozenFor(now)
+	for instanceID, seen := range instances.lastSeen {
+		if now-(seen.time+frozen) >= seen.ttl {
+			delete(instances.lastSeen, instanceID)
+		}
+	}
+
+	if len(instances.lastSeen) < 2 {
+		instances.conflictSince = 0
+	}
+	if len(instances.lastSeen) == 0 {
+		delete(d.instances, key)
+	}
+}
+
+// forgetInstance removes instance from the tracking, it has to be called with the write lock held
+func (d *Discoveries) forgetInstance(key, instanceID string) {
+	instances, ok := d.instances[key]
+	if !ok {
+		return
+	}
+
+	delete(instances.lastSeen, instanceID)
+	d.pruneInstances(key)
+}
+
+// conflict returns Conflict struct for given key, it has to be called with the read lock held
+func (d *Discoveries) conflict(key string) Conflict {
+	instances := d.instances[key]
+	parts := strings.SplitN(key, "/", 2)
+
+	conflict := Conflict{
+		Namespace:   parts[0],
+		Hostname:    parts[1],
+		InstanceIDs: []string{},
+		Since:       instances.conflictSince,
+	}
+	for instanceID := range instances.lastSeen {
+		conflict.InstanceIDs = append(conflict.InstanceIDs, instanceID)
+	}
+	sort.Strings(conflict.InstanceIDs)
+
+	return conflict
+}
+
+// Conflicts returns list of hostnames currently announced by more than one instance
+func (d *Discoveries) Conflicts() []Conflict {
+	d.lock.RLock()
+	defer d.lock.RUnlock()
+
+	conflicts := []Conflict{}
+	for key, instances := range d.instances {
+		if instances.conflictSince > 0 {
+			conflicts = append(conflicts, d.conflict(key))
+		}
+	}
+	sort.Slice(conflicts, func(i, j int) bool {
+		if conflicts[i].Namespace != conflicts[j].Namespace {
+			return conflicts[i].Namespace < conflicts[j].Namespace
+		}
+		return conflicts[i].Hostname < conflicts[j].Hostname
+	})
+
+	return conflicts
+}
+
+// ConflictingInstances returns instance IDs announcing the hostname if there is a conflict, otherwise nil
+func (d *Discoveries) ConflictingInstances(namespace, hostname string) []string {
+	d.lock.RLock()
+	defer d.lock.RUnlock()
+
+	key := discoveryKey(namespace, hostname)
+	if instances, ok := d.instances[key]; ok && instances.conflictSince > 0 {
+		return d.conflict(key).InstanceIDs
+	}
+	return nil
+}
+
+// LoadInstanceID returns persistent ID of the local instance. It's read from machineIDFile (usually
+// /etc/machine-id) if it exists, then from stateFile. If none of them exists, a new random ID is
+// generated and saved into stateFile.
+func LoadInstanceID(machineIDFile, stateFile string) (string, error) {
+	for _, filename := range []string{machineIDFile, stateFile} {
+		if len(filename) == 0 {
+			continue
+		}
+
+		content, err := os.ReadFile(filename)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return "", fmt.Errorf("reading instance ID error: %v", err)
+		}
+
+		instanceID := strings.TrimSpace(string(content))
+		if !IsValidInstanceID(instanceID) {
+			return "", fmt.Errorf("invalid instance ID in %s", filename)
+		}
+		return instanceID, nil
+	}
+
+	if len(stateFile) == 0 {
+		return "", fmt.Errorf("no instance ID found and no file to store a new one")
+	}
+
+	randomBytes := make([]byte, 16)
+	_, err := rand.Read(randomBytes)
+	if err != nil {
+		return "", fmt.Errorf("generating instance ID error: %v", err)
+	}
+	instanceID := hex.EncodeToString(randomBytes)
+
+	err = os.MkdirAll(path.Dir(stateFile), 0755)
+	if err != nil {
+		return "", fmt.Errorf("saving instance ID error: %v", err)
+	}
+	err = os.WriteFile(stateFile, []byte(instanceID+"\n"), 0644)
+	if err != nil {
+		return "", fmt.Errorf("saving instance ID error: %v", err)
+	}
+
+	return instanceID, nil
+}
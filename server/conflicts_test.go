@@ -0,0 +1,119 @@
+package server
+
+import (
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDiscoveriesConflicts(t *testing.T) {
+	discoveries := Discoveries{TTL: 30}
+	events, cancel := discoveries.Subscribe()
+	defer cancel()
+
+	discoveries.Add(Discovery{Hostname: "clone.example.com", InstanceID: "aaa", Labels: Labels{"service:smtp"}})
+	discoveries.Add(Discovery{Hostname: "clone.example.com", InstanceID: "aaa", Labels: Labels{"service:smtp"}})
+	assert.Equal(t, 0, len(discoveries.Conflicts()))
+	assert.Nil(t, discoveries.ConflictingInstances(DefaultNamespace, "clone.example.com"))
+
+	discoveries.Add(Discovery{Hostname: "clone.example.com", InstanceID: "bbb", Labels: Labels{"service:smtp"}})
+	discoveries.Add(Discovery{Hostname: "clone.example.com", InstanceID: "aaa", Labels: Labels{"service:smtp"}})
+
+	conflicts := discoveries.Conflicts()
+	assert.Equal(t, 1, len(conflicts))
+	assert.Equal(t, "clone.example.com", conflicts[0].Hostname)
+	assert.Equal(t, DefaultNamespace, conflicts[0].Namespace)
+	assert.Equal(t, []string{"aaa", "bbb"}, conflicts[0].InstanceIDs)
+	assert.Equal(t, []string{"aaa", "bbb"}, discoveries.ConflictingInstances(DefaultNamespace, "clone.example.com"))
+
+	assert.Equal(t, EventJoined, nextEvent(t, events).Type)
+	event := nextEvent(t, events)
+	assert.Equal(t, EventConflict, event.Type)
+	assert.Equal(t, []string{"aaa", "bbb"}, event.Conflict.InstanceIDs)
+
+	// Goodbye from the other instance doesn't remove the record of "aaa"
+	discoveries.Goodbye(Discovery{Namespace: DefaultNamespace, Hostname: "clone.example.com", InstanceID: "bbb"})
+	assert.True(t, discoveries.Exist(DefaultNamespace, "clone.example.com"))
+	assert.Equal(t, 0, len(discoveries.Conflicts()))
+
+	discoveries.Goodbye(Discovery{Hostname: "clone.example.com", InstanceID: "aaa"})
+	assert.False(t, discoveries.Exist(DefaultNamespace, "clone.example.com"))
+	assert.Equal(t, EventLeft, nextEvent(t, events).Type)
+
+	// Packets without instance ID can be removed by any goodbye
+	discoveries.Add(Discovery{Hostname: "old.example.com"})
+	discoveries.Goodbye(Discovery{Hostname: "old.example.com", InstanceID: "ccc"})
+	assert.False(t, discoveries.Exist(DefaultNamespace, "old.example.com"))
+}
+
+func TestDiscoveriesConflictsTTL(t *testing.T) {
+	for _, storageTTL := range []uint{30, 0} {
+		discoveries := Discoveries{TTL: storageTTL}
+
+		// Slow nodes advertising longer TTL than the storage's one
+		discoveries.Add(Discovery{Hostname: "slow.example.com", InstanceID: "aaa", TTL: 120})
+		discoveries.Add(Discovery{Hostname: "slow.example.com", InstanceID: "bbb", TTL: 120})
+		since := discoveries.Conflicts()[0].Since
+
+		age := func(seconds int64) {
+			discoveries.lock.Lock()
+			defer discoveries.lock.Unlock()
+			for _, instances := range discoveries.instances {
+				for instanceID, seen := range instances.lastSeen {
+					seen.time -= seconds
+					instances.lastSeen[instanceID] = seen
+				}
+			}
+		}
+
+		age(60)
+		discoveries.Clean()
+		assert.Equal(t, 1, len(discoveries.Conflicts()), storageTTL)
+		assert.Equal(t, since, discoveries.Conflicts()[0].Since)
+
+		// Frozen storage doesn't forget instances
+		discoveries.SetConnected(false)
+		discoveries.lock.Lock()
+		discoveries.disconnectedAt -= 100
+		discoveries.lock.Unlock()
+		age(100)
+		discoveries.Clean()
+		assert.Equal(t, 1, len(discoveries.Conflicts()), storageTTL)
+		discoveries.SetConnected(true)
+
+		age(100)
+		discoveries.Clean()
+		assert.Equal(t, 0, len(discoveries.Conflicts()), storageTTL)
+	}
+}
+
+func TestLoadInstanceID(t *testing.T) {
+	err := os.MkdirAll(tmpPath, os.ModePerm)
+	assert.Nil(t, err)
+	defer os.RemoveAll(tmpPath)
+
+	machineIDFile := tmpPath + "/machine-id"
+	stateFile := tmpPath + "/lobby/instance_id"
+
+	// Generated and stored
+	instanceID, err := LoadInstanceID(machineIDFile, stateFile)
+	assert.Nil(t, err)
+	assert.Equal(t, 32, len(instanceID))
+
+	instanceID2, err := LoadInstanceID(machineIDFile, stateFile)
+	assert.Nil(t, err)
+	assert.Equal(t, instanceID, instanceID2)
+
+	// Machine ID has priority
+	err = os.WriteFile(machineIDFile, []byte("0123456789abcdef\n"), 0644)
+	assert.Nil(t, err)
+	instanceID, err = LoadInstanceID(machineIDFile, stateFile)
+	assert.Nil(t, err)
+	assert.Equal(t, "0123456789abcdef", instanceID)
+
+	err = os.WriteFile(machineIDFile, []byte("not valid!"), 0644)
+	assert.Nil(t, err)
+	_, err = LoadInstanceID(machineIDFile, stateFile)
+	assert.NotNil(t, err)
+}
@@ -0,0 +1,135 @@
+package server
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// ValueChange describes a key of key:value labels whose values differ between two discoveries
+type ValueChange struct {
+	Key string   `json:"key"`
+	Old []string `json:"old"`
+	New []string `json:"new"`
+}
+
+// Diff describes changes between two versions of a discovery packet. Last check, TTL, keep alive
+// interval and instance ID are not considered a change.
+type Diff struct {
+	OldNamespace string        `json:"old_namespace,omitempty"` // set only when the namespace has changed
+	Namespace    string        `json:"namespace"`
+	OldHostname  string        `json:"old_hostname,omitempty"` // set only when the hostname has changed
+	Hostname     string        `json:"hostname"`
+	Added        Labels        `json:"added,omitempty"`   // labels that are in the new discovery but not in the old one
+	Removed      Labels        `json:"removed,omitempty"` // labels that are in the old discovery but not in the new one
+	Changed      []ValueChange `json:"changed,omitempty"` // keys present in both discoveries with different values
+}
+
+// DiffDiscoveries returns changes between discovery a (old) and b (new). Labels with changed values
+// are reported in Added and Removed and their keys also in Changed.
+func DiffDiscoveries(a, b Discovery) Diff {
+	diff := Diff{
+		Namespace: NormalizeNamespace(b.Namespace),
+		Hostname:  b.Hostname,
+		Added:     labelsDifference(b.Labels, a.Labels),
+		Removed:   labelsDifference(a.Labels, b.Labels),
+	}
+
+	if NormalizeNamespace(a.Namespace) != diff.Namespace {
+		diff.OldNamespace = NormalizeNamespace(a.Namespace)
+	}
+	if a.Hostname != b.Hostname {
+		diff.OldHostname = a.Hostname
+	}
+
+	if len(diff.Added) > 0 || len(diff.Removed) > 0 {
+		diff.Changed = valueChanges(a.Labels, b.Labels)
+	}
+
+	return diff
+}
+
+// valueChanges returns keys of key:value labels that are in both a and b but with different values
+func valueChanges(a, b Labels) []ValueChange {
+	oldValues := keyValues(a)
+	newValues := keyValues(b)
+
+	keys := []string{}
+	for key := range oldValues {
+		if _, ok := newValues[key]; ok {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+
+	changes := []ValueChange{}
+	for _, key := range keys {
+		if strings.Join(oldValues[key], "\n") != strings.Join(newValues[key], "\n") {
+			changes = append(changes, ValueChange{
+				Key: key,
+				Old: oldValues[key],
+				New: newValues[key],
+			})
+		}
+	}
+
+	if len(changes) == 0 {
+		return nil
+	}
+	return changes
+}
+
+// keyValues returns sorted values of labels with a value grouped by their keys
+func keyValues(labels Labels) map[string][]string {
+	values := make(map[string][]string)
+	for _, label := range labels {
+		if label.HasValue() {
+			values[label.Key()] = append(values[label.Key()], label.Value())
+		}
+	}
+	for key := range values {
+		sort.Strings(values[key])
+	}
+	return values
+}
+
+// Empty returns true if there is no change
+func (d *Diff) Empty() bool {
+	return len(d.OldNamespace) == 0 && len(d.OldHostname) == 0 && len(d.Added) == 0 && len(d.Removed) == 0
+}
+
+// String returns one line summary of the changes suitable for logs
+func (d *Diff) String() string {
+	parts := []string{}
+
+	if len(d.OldNamespace) > 0 {
+		parts = append(parts, fmt.Sprintf("namespace %s -> %s", d.OldNamespace, d.Namespace))
+	}
+	if len(d.OldHostname) > 0 {
+		parts = append(parts, fmt.Sprintf("hostname %s -> %s", d.OldHostname, d.Hostname))
+	}
+	for _, change := range d.Changed {
+		parts = append(parts, fmt.Sprintf("%s: %s -> %s", change.Key, strings.Join(change.Old, ","), strings.Join(change.New, ",")))
+	}
+
+	// Labels already described as changed values are not repeated
+	changedKeys := make(map[string]bool, len(d.Changed))
+	for _, change := range d.Changed {
+		changedKeys[change.Key] = true
+	}
+	for _, label := range d.Added {
+		if !label.HasValue() || !changedKeys[label.Key()] {
+			parts = append(parts, "+"+label.String())
+		}
+	}
+	for _, label := range d.Removed {
+		if !label.HasValue() || !changedKeys[label.Key()] {
+			parts = append(parts, "-"+label.String())
+		}
+	}
+
+	if len(parts) == 0 {
+		return "no changes"
+	}
+	return strings.Join(parts, ", ")
+}
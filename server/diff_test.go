@@ -0,0 +1,79 @@
+package server
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDiffDiscoveries(t *testing.T) {
+	old := Discovery{
+		Hostname:  "abcd.com",
+		Labels:    Labels{"service:smtp", "service:imap", "location:prague", "backup"},
+		LastCheck: 52,
+		TTL:       30,
+	}
+	new := Discovery{
+		Hostname:  "abcd.com",
+		Labels:    Labels{"service:smtp", "location:brno", "monitoring", "backup"},
+		LastCheck: 60,
+		TTL:       90,
+	}
+
+	diff := DiffDiscoveries(old, new)
+	assert.False(t, diff.Empty())
+	assert.Equal(t, DefaultNamespace, diff.Namespace)
+	assert.Equal(t, "abcd.com", diff.Hostname)
+	assert.Equal(t, "", diff.OldHostname)
+	assert.Equal(t, Labels{"location:brno", "monitoring"}, diff.Added)
+	assert.Equal(t, Labels{"service:imap", "location:prague"}, diff.Removed)
+	assert.Equal(t, []ValueChange{
+		{Key: "location", Old: []string{"prague"}, New: []string{"brno"}},
+		{Key: "service", Old: []string{"imap", "smtp"}, New: []string{"smtp"}},
+	}, diff.Changed)
+	assert.Equal(t, "location: prague -> brno, service: imap,smtp -> smtp, +monitoring", diff.String())
+
+	diff = DiffDiscoveries(old, old)
+	assert.True(t, diff.Empty())
+	assert.Nil(t, diff.Changed)
+	assert.Equal(t, "no changes", diff.String())
+
+	// Timing doesn't matter and neither does order of the labels
+	reordered := copyDiscovery(old)
+	reordered.Labels = Labels{"backup", "location:prague", "service:imap", "service:smtp"}
+	reordered.LastCheck = 100
+	diff = DiffDiscoveries(old, reordered)
+	assert.True(t, diff.Empty())
+}
+
+func TestDiffDiscoveriesHostname(t *testing.T) {
+	old := Discovery{Hostname: "abcd.com", Labels: Labels{"service:smtp"}}
+	new := Discovery{Namespace: "prod", Hostname: "efgh.com", Labels: Labels{"service:smtp"}}
+
+	diff := DiffDiscoveries(old, new)
+	assert.False(t, diff.Empty())
+	assert.Equal(t, "abcd.com", diff.OldHostname)
+	assert.Equal(t, "efgh.com", diff.Hostname)
+	assert.Equal(t, DefaultNamespace, diff.OldNamespace)
+	assert.Equal(t, "prod", diff.Namespace)
+	assert.Nil(t, diff.Added)
+	assert.Nil(t, diff.Removed)
+	assert.Equal(t, "namespace default -> prod, hostname abcd.com -> efgh.com", diff.String())
+}
+
+func TestEventDiff(t *testing.T) {
+	old := Discovery{Hostname: "abcd.com", Labels: Labels{"location:prague"}}
+	new := Discovery{Hostname: "abcd.com", Labels: Labels{"location:brno"}}
+
+	event := newEvent(EventUpdated, &old, &new)
+	assert.Equal(t, []ValueChange{{Key: "location", Old: []string{"prague"}, New: []string{"brno"}}}, event.Changed)
+	diff := event.Diff()
+	assert.Equal(t, event.Changed, diff.Changed)
+
+	event = newEvent(EventLeft, &old, nil)
+	assert.Nil(t, event.Changed)
+	diff = event.Diff()
+	assert.Equal(t, "abcd.com", diff.Hostname)
+	assert.Equal(t, "", diff.OldHostname)
+	assert.Equal(t, Labels{"location:prague"}, diff.Removed)
+}
@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"sort"
 	"strings"
+	"sync"
 	"time"
 )
 
@@ -14,24 +15,88 @@ import (
 
 const TimeToLife = 60 // when server won't occur in the discovery channel longer than this, it should be considered as not-alive
 
+const DefaultNamespace = "default" // namespace of discoveries that don't set any
+
+// NormalizeNamespace returns DefaultNamespace for empty namespace, otherwise the namespace in lower case
+// without surrounding spaces so namespaces from query parameters can be compared too
+func NormalizeNamespace(namespace string) string {
+	namespace = strings.ToLower(strings.TrimSpace(namespace))
+	if len(namespace) == 0 {
+		return DefaultNamespace
+	}
+	return namespace
+}
+
 // Discovery contains information about a single server and is used for server discovery
 type Discovery struct {
-	Hostname string `json:"hostname"`
-	Labels   Labels `json:"labels"`
+	Namespace string `json:"namespace,omitempty"` // environment the server belongs to, e.g. prod or staging, empty means DefaultNamespace
+	Hostname  string `json:"hostname"`
+	Labels    Labels `json:"labels"`
+
+	// Persistent ID of the daemon instance that sent the packet, it's used to detect two servers with the same hostname.
+	InstanceID string `json:"instance_id,omitempty"`
 
 	// For internal use to check if the server is still alive.
 	// Contains timestamp of the last check.
 	LastCheck int64 `json:"last_check"`
 
-	TTL uint `json:"-"` // after how many second consider the server to be off, if 0 then 60 secs is used
+	// Advertised by the sender, receivers use them within their configured bounds, see Discoveries.EffectiveTTL.
+	TTL       uint `json:"ttl,omitempty"`        // after how many second consider the server to be off, if 0 then 60 secs is used
+	KeepAlive uint `json:"keep_alive,omitempty"` // how often the server sends the discovery packet [secs]
+
+	// Increasing number of the packet set by the sender when it publishes it via multiple drivers, so receivers
+	// can drop the copies. Zero means the packet is not numbered.
+	Sequence uint64 `json:"sequence,omitempty"`
 }
 
-// Validate checks all values in the struct if the content is valid
+// Validate checks all values in the struct if the content is valid. Returned error is always *ValidationError.
 func (d *Discovery) Validate() error {
-	// TODO: implement
+	if !IsValidHostname(d.Hostname) {
+		return &ValidationError{
+			Reason:  ValidationReasonHostname,
+			Message: fmt.Sprintf("invalid hostname %q", d.Hostname),
+		}
+	}
+
+	if len(d.Namespace) > 0 && !IsValidNamespace(d.Namespace) {
+		return &ValidationError{
+			Reason:  ValidationReasonNamespace,
+			Message: fmt.Sprintf("invalid namespace %q", d.Namespace),
+		}
+	}
+
+	if len(d.InstanceID) > 0 && !IsValidInstanceID(d.InstanceID) {
+		return &ValidationError{
+			Reason:  ValidationReasonInstanceID,
+			Message: fmt.Sprintf("invalid instance ID %q", d.InstanceID),
+		}
+	}
+
+	for _, label := range d.Labels {
+		err := label.Validate()
+		if err != nil {
+			return err
+		}
+	}
+
+	if d.LastCheck < 0 || d.LastCheck > time.Now().Unix()+MaxClockSkew {
+		return &ValidationError{
+			Reason:  ValidationReasonLastCheck,
+			Message: fmt.Sprintf("last check %d of %s is out of range", d.LastCheck, d.Hostname),
+		}
+	}
+
 	return nil
 }
 
+// Name returns hostname of the server prefixed by its namespace if it's not the default one
+func (d *Discovery) Name() string {
+	if NormalizeNamespace(d.Namespace) == DefaultNamespace {
+		return d.Hostname
+	}
+	return d.Namespace + "/" + d.Hostname
+}
+
 // IsAlive return true if the server should be considered as alive
 func (d *Discovery) IsAlive() bool {
 	if d.TTL == 0 {
@@ -73,174 +138,407 @@ func (d *Discovery) SortLabels() {
 // Discovery storage
 // -----------------
 
-// Discoveries helps to store instances of Discovery struct and access them in thread safe mode
+// Discoveries helps to store instances of Discovery struct and access them in thread safe mode.
+// Zero value is ready to use. All returned discoveries are copies so the caller can modify them freely.
+// Every change is published as an Event to the subscribers, see Subscribe.
 type Discoveries struct {
-	activeServers []Discovery
-	LogChannel    chan string
-	TTL           uint
+	activeServers map[string]Discovery
+	instances     map[string]*hostnameInstances
+	subscribers   []*subscription
+	lock          sync.RWMutex
+
+	LogChannel chan string
+	Namespaces []string // namespaces this storage accepts discoveries from, empty means all of them
+	TTL        uint     // TTL used for discoveries that don't advertise their own TTL or keep alive interval
+	MinTTL     uint     // advertised TTL lower than this is raised to this value, 0 means no limit
+	MaxTTL     uint     // advertised TTL higher than this is lowered to this value, 0 means no limit
+
+	DisconnectedGrace uint  // how long the discoveries don't expire while the local node is disconnected [secs], 0 means until it's connected again
+	disconnectedAt    int64 // unix timestamp when the local node was disconnected from the other nodes, 0 if it's connected
 }
 
-func (d *Discoveries) hostnameIndex(hostname string) int {
-	for idx, discovery := range d.activeServers {
-		if discovery.Hostname == hostname {
-			return idx
+// discoveryKey returns key of the discovery in the internal map
+func discoveryKey(namespace, hostname string) string {
+	return NormalizeNamespace(namespace) + "/" + hostname
+}
+
+// Watches returns true if discoveries from the namespace are accepted by this storage
+func (d *Discoveries) Watches(namespace string) bool {
+	if len(d.Namespaces) == 0 {
+		return true
+	}
+
+	namespace = NormalizeNamespace(namespace)
+	for _, watched := range d.Namespaces {
+		if NormalizeNamespace(watched) == namespace {
+			return true
 		}
 	}
-	return -1
+	return false
+}
+
+// EffectiveTTL returns TTL used for the discovery. It's the TTL advertised by the sender or three
+// times its keep alive interval if only that is set. If there is none of them, storage's TTL is used.
+// Advertised values are kept within MinTTL and MaxTTL.
+func (d *Discoveries) EffectiveTTL(discovery Discovery) uint {
+	ttl := discovery.TTL
+	if ttl == 0 && discovery.KeepAlive > 0 {
+		ttl = 3 * discovery.KeepAlive
+	}
+	if ttl == 0 {
+		return d.TTL
+	}
+
+	if d.MinTTL > 0 && ttl < d.MinTTL {
+		ttl = d.MinTTL
+	}
+	if d.MaxTTL > 0 && ttl > d.MaxTTL {
+		ttl = d.MaxTTL
+	}
+
+	return ttl
 }
 
-// Add appends a new discovery/server to the storage
-func (d *Discoveries) Add(discovery Discovery) {
-	if d.Exist(discovery.Hostname) {
-		d.Refresh(discovery.Hostname)
+// ExpiresAt returns unix timestamp when the discovery expires if no other keep alive packet arrives.
+// While the local node is disconnected the time keeps moving forward, see SetConnected.
+func (d *Discoveries) ExpiresAt(discovery Discovery) int64 {
+	ttl := d.EffectiveTTL(discovery)
+	if ttl == 0 {
+		ttl = TimeToLife
+	}
 
-		idx := d.hostnameIndex(discovery.Hostname)
-		if idx >= 0 {
-			d.activeServers[idx].Labels = discovery.Labels
-		}
+	d.lock.RLock()
+	frozen := d.frozenFor(time.Now().Unix())
+	d.lock.RUnlock()
 
+	return discovery.LastCheck + frozen + int64(ttl)
+}
+
+// init prepares the internal map, it has to be called with the write lock held.
+func (d *Discoveries) init() {
+	if d.activeServers == nil {
+		d.activeServers = make(map[string]Discovery)
+	}
+}
+
+// log sends message to the LogChannel if it's set. It shouldn't be called with the lock held
+// because the channel doesn't have to be buffered.
+func (d *Discoveries) log(messages ...string) {
+	if d.LogChannel == nil {
 		return
 	}
+	for _, message := range messages {
+		d.LogChannel <- message
+	}
+}
 
-	discovery.LastCheck = time.Now().Unix()
-	d.activeServers = append(d.activeServers, discovery)
-	if d.LogChannel != nil {
-		d.LogChannel <- fmt.Sprintf("%s registered", discovery.Hostname)
+// copyDiscovery returns discovery with its own copy of the labels slice
+func copyDiscovery(discovery Discovery) Discovery {
+	labels := make(Labels, len(discovery.Labels))
+	copy(labels, discovery.Labels)
+	discovery.Labels = labels
+	return discovery
+}
+
+// sortedServers returns copy of all stored discoveries sorted by namespace and hostname, it has to be called with the read lock held.
+func (d *Discoveries) sortedServers() []Discovery {
+	servers := make([]Discovery, 0, len(d.activeServers))
+	for _, discovery := range d.activeServers {
+		servers = append(servers, copyDiscovery(discovery))
 	}
+	sort.Slice(servers, func(i, j int) bool {
+		if servers[i].Namespace != servers[j].Namespace {
+			return servers[i].Namespace < servers[j].Namespace
+		}
+		return servers[i].Hostname < servers[j].Hostname
+	})
+	return servers
 }
 
-// Refresh updates
-func (d *Discoveries) Refresh(hostname string) {
-	idx := d.hostnameIndex(hostname)
-	if idx >= 0 {
-		d.activeServers[idx].LastCheck = time.Now().Unix()
+// Add adds a new discovery/server to the storage or updates the existing one with the same namespace and hostname.
+// The operation is atomic and it returns the previous version of the discovery and true if the hostname
+// was already registered. Discoveries from namespaces the storage doesn't watch are ignored.
+func (d *Discoveries) Add(discovery Discovery) (Discovery, bool) {
+	if !d.Watches(discovery.Namespace) {
+		return Discovery{}, false
+	}
+
+	discovery = copyDiscovery(discovery)
+	discovery.Namespace = NormalizeNamespace(discovery.Namespace)
+	discovery.LastCheck = time.Now().Unix()
+	key := discoveryKey(discovery.Namespace, discovery.Hostname)
+
+	d.lock.Lock()
+	d.init()
+	previous, exists := d.activeServers[key]
+	d.activeServers[key] = discovery
+	if !exists {
+		d.publish(newEvent(EventJoined, nil, &discovery))
+	} else if Compare(previous, discovery) {
+		d.publish(newEvent(EventUpdated, &previous, &discovery))
+	}
+	conflict := d.trackInstance(discovery)
+	if conflict != nil {
+		d.publish(newConflictEvent(discovery, *conflict))
+	}
+	d.lock.Unlock()
+
+	if !exists {
+		d.log(fmt.Sprintf("%s registered", discovery.Name()))
 	}
+	if conflict != nil {
+		d.log(fmt.Sprintf("hostname conflict: %s is announced by instances %s", discovery.Name(), strings.Join(conflict.InstanceIDs, ", ")))
+	}
+
+	return previous, exists
 }
 
-// Delete removes server identified by hostname from the storage
-func (d *Discoveries) Delete(hostname string) {
-	if !d.Exist(hostname) {
-		return
+// Refresh updates last check of the server identified by namespace and hostname
+func (d *Discoveries) Refresh(namespace, hostname string) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	key := discoveryKey(namespace, hostname)
+	if discovery, ok := d.activeServers[key]; ok {
+		discovery.LastCheck = time.Now().Unix()
+		d.activeServers[key] = discovery
 	}
+}
+
+// Delete removes server identified by namespace and hostname from the storage
+func (d *Discoveries) Delete(namespace, hostname string) {
+	key := discoveryKey(namespace, hostname)
 
-	if d.LogChannel != nil {
-		d.LogChannel <- fmt.Sprintf("removing %s", hostname)
+	d.lock.Lock()
+	previous, exists := d.activeServers[key]
+	if exists {
+		delete(d.activeServers, key)
+		d.publish(newEvent(EventLeft, &previous, nil))
 	}
+	d.lock.Unlock()
 
-	newSet := []Discovery{}
-	for _, server := range d.activeServers {
-		if server.Hostname != hostname {
-			newSet = append(newSet, server)
-		}
+	if exists {
+		d.log(fmt.Sprintf("removing %s", previous.Name()))
 	}
-	d.activeServers = newSet
 }
 
-// Exist returns true if server with given hostname exists
-func (d *Discoveries) Exist(hostname string) bool {
-	for _, server := range d.activeServers {
-		if server.Hostname == hostname {
-			return true
-		}
+// Goodbye processes goodbye packet of the server. The server is removed only if the instance ID in the
+// packet matches the stored one, so goodbye of one of two servers with the same hostname doesn't remove the other.
+func (d *Discoveries) Goodbye(discovery Discovery) {
+	key := discoveryKey(discovery.Namespace, discovery.Hostname)
+
+	d.lock.Lock()
+	d.forgetInstance(key, discovery.InstanceID)
+	previous, exists := d.activeServers[key]
+	otherInstance := len(discovery.InstanceID) > 0 && len(previous.InstanceID) > 0 && discovery.InstanceID != previous.InstanceID
+	if exists && !otherInstance {
+		delete(d.activeServers, key)
+		d.publish(newEvent(EventLeft, &previous, nil))
+	}
+	d.lock.Unlock()
+
+	if exists && otherInstance {
+		d.log(fmt.Sprintf("ignoring goodbye of %s from instance %s, the record belongs to %s", previous.Name(), discovery.InstanceID, previous.InstanceID))
+	} else if exists {
+		d.log(fmt.Sprintf("removing %s", previous.Name()))
 	}
-	return false
 }
 
-// Get returns Discovery struct with the given hostname but it can be also an empty struct if it's not found. Check if hostname is empty or use Exist first to be sure.
-func (d *Discoveries) Get(hostname string) Discovery {
-	for _, server := range d.activeServers {
-		if server.Hostname == hostname {
-			return server
-		}
+// Exist returns true if server with given namespace and hostname exists
+func (d *Discoveries) Exist(namespace, hostname string) bool {
+	d.lock.RLock()
+	defer d.lock.RUnlock()
+
+	_, ok := d.activeServers[discoveryKey(namespace, hostname)]
+	return ok
+}
+
+// Get returns Discovery struct with the given namespace and hostname but it can be also an empty struct if it's not found. Check if hostname is empty or use Exist first to be sure.
+func (d *Discoveries) Get(namespace, hostname string) Discovery {
+	d.lock.RLock()
+	defer d.lock.RUnlock()
+
+	if discovery, ok := d.activeServers[discoveryKey(namespace, hostname)]; ok {
+		return copyDiscovery(discovery)
 	}
 	return Discovery{}
 }
 
-// GetAll returns copy of the internal storage
+// GetAll returns copy of the internal storage sorted by namespace and hostname
 func (d *Discoveries) GetAll() []Discovery {
-	return d.activeServers
+	d.lock.RLock()
+	defer d.lock.RUnlock()
+
+	return d.sortedServers()
 }
 
 // Filter returns list of discoveries based on given labels
 func (d *Discoveries) Filter(labelsFilter []string) []Discovery {
-	newSet := []Discovery{}
+	return d.filter(labelsFilter, func(label Label, labelFilter string) bool {
+		return label.String() == labelFilter
+	})
+}
 
-	var found bool
-	if len(labelsFilter) > 0 {
-		for _, discovery := range d.activeServers {
-			newDiscovery := discovery
-			newDiscovery.Labels = Labels{}
-
-			found = false
-			for _, label := range discovery.Labels {
-				for _, labelFilter := range labelsFilter {
-					if label.String() == labelFilter {
-						found = true
-						newDiscovery.Labels = append(newDiscovery.Labels, label)
-						break
-					}
-				}
-			}
+// FilterPrefix returns list of discoveries based on given label prefixes.
+func (d *Discoveries) FilterPrefix(prefixes []string) []Discovery {
+	return d.filter(prefixes, func(label Label, prefix string) bool {
+		return strings.HasPrefix(label.String(), prefix)
+	})
+}
 
-			if found {
-				newSet = append(newSet, newDiscovery)
-			}
+// FilterQuery returns list of discoveries matching the query. Unlike Filter and FilterPrefix it returns
+// discoveries with all their labels.
+func (d *Discoveries) FilterQuery(query *Query) []Discovery {
+	newSet := []Discovery{}
 
+	for _, discovery := range d.GetAll() {
+		if query.Match(discovery) {
+			newSet = append(newSet, discovery)
 		}
-
 	}
 
 	return newSet
 }
 
-// Filter returns list of discoveries based on given label prefixes.
-func (d *Discoveries) FilterPrefix(prefixes []string) []Discovery {
+// InNamespaces returns only discoveries from given namespaces
+func InNamespaces(discoveries []Discovery, namespaces []string) []Discovery {
 	newSet := []Discovery{}
 
-	var found bool
-	if len(prefixes) > 0 {
-		for _, discovery := range d.activeServers {
-			newDiscovery := discovery
-			newDiscovery.Labels = Labels{}
+	for _, discovery := range discoveries {
+		if InNamespace(discovery.Namespace, namespaces) {
+			newSet = append(newSet, discovery)
+		}
+	}
+
+	return newSet
+}
 
-			found = false
+// InNamespace returns true if the namespace is one of the namespaces, all of them are normalized before comparison
+func InNamespace(namespace string, namespaces []string) bool {
+	for _, candidate := range namespaces {
+		if NormalizeNamespace(namespace) == NormalizeNamespace(candidate) {
+			return true
+		}
+	}
+	return false
+}
 
-			if found {
-				newSet = append(newSet, newDiscovery)
-			}
+// filter returns discoveries with at least one label matching at least one of the filters. Returned
+// discoveries contain only the matching labels.
+func (d *Discoveries) filter(filters []string, match func(Label, string) bool) []Discovery {
+	newSet := []Discovery{}
 
-			for _, label := range discovery.Labels {
-				for _, prefix := range prefixes {
-					if strings.HasPrefix(label.String(), prefix) {
-						found = true
-						newDiscovery.Labels = append(newDiscovery.Labels, label)
-						break
-					}
+	if len(filters) == 0 {
+		return newSet
+	}
+
+	for _, discovery := range d.GetAll() {
+		newDiscovery := discovery
+		newDiscovery.Labels = Labels{}
+
+		for _, label := range discovery.Labels {
+			for _, filter := range filters {
+				if match(label, filter) {
+					newDiscovery.Labels = append(newDiscovery.Labels, label)
+					break
 				}
 			}
+		}
+
+		if len(newDiscovery.Labels) > 0 {
+			newSet = append(newSet, newDiscovery)
+		}
+	}
+
+	return newSet
+}
+
+// isAlive returns true if the discovery is alive according to its effective TTL
+func (d *Discoveries) isAlive(discovery Discovery) bool {
+	discovery.TTL = d.EffectiveTTL(discovery)
+	return discovery.IsAlive()
+}
+
+// SetConnected tells the storage whether the local node is connected to the other nodes. While it's disconnected the
+// discoveries don't expire for up to DisconnectedGrace seconds because missing keep alive packets say nothing about
+// the other nodes. After reconnect the time when expiration was frozen is added to the last checks.
+func (d *Discoveries) SetConnected(connected bool) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	now := time.Now().Unix()
+	if !connected {
+		if d.disconnectedAt == 0 {
+			d.disconnectedAt = now
+		}
+		return
+	}
+	if d.disconnectedAt == 0 {
+		return
+	}
 
-			if found {
-				newSet = append(newSet, newDiscovery)
+	frozen := d.frozenFor(now)
+	for key, discovery := range d.activeServers {
+		discovery.LastCheck += frozen
+		if discovery.LastCheck > now {
+			discovery.LastCheck = now
+		}
+		d.activeServers[key] = discovery
+	}
+	for _, instances := range d.instances {
+		for instanceID, seen := range instances.lastSeen {
+			seen.time += frozen
+			if seen.time > now {
+				seen.time = now
 			}
+			instances.lastSeen[instanceID] = seen
 		}
+	}
+	d.disconnectedAt = 0
+}
+
+// Stale returns true if the local node is disconnected so the stored discoveries may be outdated
+func (d *Discoveries) Stale() bool {
+	d.lock.RLock()
+	defer d.lock.RUnlock()
+
+	return d.disconnectedAt != 0
+}
 
+// frozenFor returns for how many seconds the expiration is frozen, it has to be called with the lock held
+func (d *Discoveries) frozenFor(now int64) int64 {
+	if d.disconnectedAt == 0 {
+		return 0
 	}
 
-	return newSet
+	frozen := now - d.disconnectedAt
+	if d.DisconnectedGrace > 0 && frozen > int64(d.DisconnectedGrace) {
+		frozen = int64(d.DisconnectedGrace)
+	}
+	return frozen
 }
 
-// Clean checks loops over last check values for each discovery object and removes it if it's passed
+// Clean checks loops over last check values for each discovery object and removes it if it's passed.
+// Expired event is published for each removed discovery. Time while the local node is disconnected
+// is not counted, see SetConnected.
 func (d *Discoveries) Clean() {
-	newSet := []Discovery{}
-	for _, server := range d.activeServers {
-		server.TTL = d.TTL
-		if server.IsAlive() {
-			newSet = append(newSet, server)
-		} else {
-			if d.LogChannel != nil {
-				d.LogChannel <- fmt.Sprintf("%s not alive anymore", server.Hostname)
-			}
+	messages := []string{}
+
+	d.lock.Lock()
+	for key := range d.instances {
+		d.pruneInstances(key)
+	}
+	frozen := d.frozenFor(time.Now().Unix())
+	for _, server := range d.sortedServers() {
+		shifted := server
+		shifted.LastCheck += frozen
+		if !d.isAlive(shifted) {
+			delete(d.activeServers, discoveryKey(server.Namespace, server.Hostname))
+			d.publish(newEvent(EventExpired, &server, nil))
+			messages = append(messages, fmt.Sprintf("%s not alive anymore", server.Name()))
 		}
 	}
-	d.activeServers = newSet
+	d.lock.Unlock()
+
+	d.log(messages...)
 }
@@ -2,6 +2,9 @@ package server
 
 import (
 	"encoding/json"
+	"fmt"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 
@@ -28,7 +31,7 @@ func TestDiscovery(t *testing.T) {
 	discovery.LastCheck = now
 
 	assert.Equal(t, Labels{Label("service:test")}, discovery.FindLabelsByPrefix("service"))
-	assert.Equal(t, nil, discovery.Validate()) // TODO: This needs more love
+	assert.Nil(t, discovery.Validate())
 
 	content, err := json.Marshal(&discovery)
 	assert.Nil(t, err)
@@ -36,3 +39,213 @@ func TestDiscovery(t *testing.T) {
 	assert.Nil(t, err)
 	assert.Equal(t, content, content2)
 }
+
+func TestDiscoveriesAdd(t *testing.T) {
+	discoveries := Discoveries{}
+
+	previous, exists := discoveries.Add(Discovery{Hostname: "b.example.com", Labels: Labels{"service:test"}})
+	assert.False(t, exists)
+	assert.Equal(t, Discovery{}, previous)
+
+	previous, exists = discoveries.Add(Discovery{Hostname: "b.example.com", Labels: Labels{"service:test2"}})
+	assert.True(t, exists)
+	assert.Equal(t, Labels{"service:test"}, previous.Labels)
+
+	discoveries.Add(Discovery{Hostname: "a.example.com", Labels: Labels{"service:other"}})
+
+	all := discoveries.GetAll()
+	assert.Equal(t, 2, len(all))
+	assert.Equal(t, "a.example.com", all[0].Hostname)
+	assert.Equal(t, Labels{"service:test2"}, all[1].Labels)
+	assert.True(t, discoveries.Exist(DefaultNamespace, "a.example.com"))
+
+	// Returned values are copies
+	all[1].Labels[0] = "changed"
+	assert.Equal(t, Labels{"service:test2"}, discoveries.Get(DefaultNamespace, "b.example.com").Labels)
+
+	discoveries.Delete(DefaultNamespace, "a.example.com")
+	assert.False(t, discoveries.Exist(DefaultNamespace, "a.example.com"))
+	assert.Equal(t, "", discoveries.Get(DefaultNamespace, "a.example.com").Hostname)
+}
+
+func TestDiscoveriesFilter(t *testing.T) {
+	discoveries := Discoveries{}
+	discoveries.Add(Discovery{Hostname: "a.example.com", Labels: Labels{"service:smtp", "location:prague"}})
+	discoveries.Add(Discovery{Hostname: "b.example.com", Labels: Labels{"service:imap", "location:brno"}})
+
+	filtered := discoveries.Filter([]string{"service:smtp", "location:brno"})
+	assert.Equal(t, 2, len(filtered))
+	assert.Equal(t, Labels{"service:smtp"}, filtered[0].Labels)
+	assert.Equal(t, Labels{"location:brno"}, filtered[1].Labels)
+
+	filtered = discoveries.FilterPrefix([]string{"service:i"})
+	assert.Equal(t, 1, len(filtered))
+	assert.Equal(t, "b.example.com", filtered[0].Hostname)
+
+	assert.Equal(t, 0, len(discoveries.Filter([]string{})))
+}
+
+func TestDiscoveriesConcurrency(t *testing.T) {
+	discoveries := Discoveries{TTL: 30}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				hostname := fmt.Sprintf("host%d.example.com", j%10)
+				discoveries.Add(Discovery{Hostname: hostname, Labels: Labels{Label(fmt.Sprintf("worker:%d", i))}})
+				discoveries.GetAll()
+				discoveries.FilterPrefix([]string{"worker:"})
+				discoveries.Clean()
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	assert.Equal(t, 10, len(discoveries.GetAll()))
+}
+
+func TestDiscoveryValidate(t *testing.T) {
+	valid := Discovery{
+		Hostname:  "smtp-1.example.com",
+		Labels:    Labels{"service:smtp", "public_ip6:2a03::1"},
+		LastCheck: time.Now().Unix(),
+	}
+	assert.Nil(t, valid.Validate())
+
+	for _, hostname := range []string{"", "-abc.com", "abc-.com", "a..com", "a.com.", "a_b.com", "a b.com", strings.Repeat("a", 64) + ".com"} {
+		discovery := valid
+		discovery.Hostname = hostname
+		assert.Equal(t, ValidationReasonHostname, ValidationReason(discovery.Validate()), hostname)
+	}
+
+	for _, label := range []Label{"", "service:smtp\nservice:imap", "tab\tlabel", Label(strings.Repeat("a", MaxLabelLength+1))} {
+		discovery := valid
+		discovery.Labels = Labels{"service:test", label}
+		assert.Equal(t, ValidationReasonLabel, ValidationReason(discovery.Validate()))
+	}
+
+	for _, lastCheck := range []int64{-1, time.Now().Unix() + MaxClockSkew + 60} {
+		discovery := valid
+		discovery.LastCheck = lastCheck
+		assert.Equal(t, ValidationReasonLastCheck, ValidationReason(discovery.Validate()))
+	}
+
+	assert.Equal(t, "unknown", ValidationReason(fmt.Errorf("other error")))
+}
+
+func TestDiscoveriesEffectiveTTL(t *testing.T) {
+	discoveries := Discoveries{TTL: 30, MinTTL: 10, MaxTTL: 300}
+
+	assert.Equal(t, uint(30), discoveries.EffectiveTTL(Discovery{}))
+	assert.Equal(t, uint(90), discoveries.EffectiveTTL(Discovery{TTL: 90}))
+	assert.Equal(t, uint(90), discoveries.EffectiveTTL(Discovery{KeepAlive: 30}))
+	assert.Equal(t, uint(60), discoveries.EffectiveTTL(Discovery{TTL: 60, KeepAlive: 30}))
+	assert.Equal(t, uint(10), discoveries.EffectiveTTL(Discovery{TTL: 1}))
+	assert.Equal(t, uint(300), discoveries.EffectiveTTL(Discovery{TTL: 3600}))
+
+	assert.Equal(t, int64(1090), discoveries.ExpiresAt(Discovery{TTL: 90, LastCheck: 1000}))
+
+	// Slow node advertising longer TTL is not expired
+	discoveries.Add(Discovery{Hostname: "slow.example.com", TTL: 90, KeepAlive: 30})
+	discoveries.Add(Discovery{Hostname: "fast.example.com"})
+
+	discoveries.lock.Lock()
+	for hostname, discovery := range discoveries.activeServers {
+		discovery.LastCheck = time.Now().Unix() - 45
+		discoveries.activeServers[hostname] = discovery
+	}
+	discoveries.lock.Unlock()
+
+	discoveries.Clean()
+	assert.True(t, discoveries.Exist(DefaultNamespace, "slow.example.com"))
+	assert.False(t, discoveries.Exist(DefaultNamespace, "fast.example.com"))
+	assert.Equal(t, uint(90), discoveries.Get(DefaultNamespace, "slow.example.com").TTL)
+}
+
+func TestDiscoveriesNamespaces(t *testing.T) {
+	discoveries := Discoveries{Namespaces: []string{"prod", "staging"}}
+
+	discoveries.Add(Discovery{Namespace: "prod", Hostname: "db1.example.com", Labels: Labels{"service:db"}})
+	discoveries.Add(Discovery{Namespace: "staging", Hostname: "db1.example.com", Labels: Labels{"service:db", "debug"}})
+	discoveries.Add(Discovery{Namespace: "dev", Hostname: "db1.example.com"})
+	discoveries.Add(Discovery{Hostname: "old.example.com"})
+
+	all := discoveries.GetAll()
+	assert.Equal(t, 2, len(all))
+	assert.Equal(t, "prod", all[0].Namespace)
+	assert.Equal(t, "staging/db1.example.com", all[1].Name())
+	assert.Equal(t, Labels{"service:db"}, discoveries.Get("prod", "db1.example.com").Labels)
+	assert.False(t, discoveries.Exist("dev", "db1.example.com"))
+
+	assert.Equal(t, 1, len(InNamespaces(all, []string{"staging"})))
+	assert.Equal(t, 1, len(InNamespaces(all, []string{" Staging"})))
+	assert.True(t, InNamespace("", []string{"prod", "default"}))
+
+	discoveries.Delete("staging", "db1.example.com")
+	assert.True(t, discoveries.Exist("prod", "db1.example.com"))
+	assert.False(t, discoveries.Exist("staging", "db1.example.com"))
+
+	// Empty namespace is the default one
+	discoveries = Discoveries{}
+	discoveries.Add(Discovery{Hostname: "old.example.com"})
+	assert.True(t, discoveries.Exist(DefaultNamespace, "old.example.com"))
+	assert.Equal(t, DefaultNamespace, discoveries.GetAll()[0].Namespace)
+	assert.Equal(t, "old.example.com", discoveries.GetAll()[0].Name())
+
+	invalid := Discovery{Namespace: "Prod", Hostname: "db1.example.com"}
+	assert.Equal(t, ValidationReasonNamespace, ValidationReason(invalid.Validate()))
+}
+
+func TestDiscoveriesDisconnected(t *testing.T) {
+	discoveries := Discoveries{TTL: 30}
+
+	discoveries.Add(Discovery{Hostname: "old.example.com"})
+	discoveries.Add(Discovery{Hostname: "new.example.com"})
+	setLastCheck := func(hostname string, ago int64) {
+		discoveries.lock.Lock()
+		defer discoveries.lock.Unlock()
+		key := discoveryKey(DefaultNamespace, hostname)
+		discovery := discoveries.activeServers[key]
+		discovery.LastCheck = time.Now().Unix() - ago
+		discoveries.activeServers[key] = discovery
+	}
+	disconnect := func(ago int64) {
+		discoveries.lock.Lock()
+		defer discoveries.lock.Unlock()
+		discoveries.disconnectedAt = time.Now().Unix() - ago
+	}
+
+	// Disconnected 100 seconds ago, one server was already expired at that time
+	setLastCheck("old.example.com", 140)
+	setLastCheck("new.example.com", 110)
+	assert.False(t, discoveries.Stale())
+	discoveries.SetConnected(false)
+	assert.True(t, discoveries.Stale())
+	disconnect(100)
+
+	discoveries.Clean()
+	assert.False(t, discoveries.Exist(DefaultNamespace, "old.example.com"))
+	assert.True(t, discoveries.Exist(DefaultNamespace, "new.example.com"))
+	assert.Equal(t, time.Now().Unix()+20, discoveries.ExpiresAt(discoveries.Get(DefaultNamespace, "new.example.com")))
+
+	// Time while disconnected is not counted after reconnect
+	discoveries.SetConnected(true)
+	assert.False(t, discoveries.Stale())
+	assert.Equal(t, time.Now().Unix()-10, discoveries.Get(DefaultNamespace, "new.example.com").LastCheck)
+	discoveries.Clean()
+	assert.True(t, discoveries.Exist(DefaultNamespace, "new.example.com"))
+
+	// Expiration is frozen only for the grace period
+	discoveries.DisconnectedGrace = 60
+	discoveries.SetConnected(false)
+	disconnect(100)
+	setLastCheck("new.example.com", 80)
+	discoveries.Clean()
+	assert.True(t, discoveries.Exist(DefaultNamespace, "new.example.com"))
+	setLastCheck("new.example.com", 100)
+	discoveries.Clean()
+	assert.False(t, discoveries.Exist(DefaultNamespace, "new.example.com"))
+}
@@ -0,0 +1,220 @@
+package server
+
+import (
+	"sync"
+	"time"
+)
+
+// EventType says what happened with the discovery in the storage
+type EventType string
+
+const (
+	EventJoined   EventType = "joined"   // new server appeared
+	EventUpdated  EventType = "updated"  // known server changed its labels
+	EventLeft     EventType = "left"     // server sent goodbye packet
+	EventExpired  EventType = "expired"  // server didn't send keep alive packet for longer than TTL
+	EventConflict EventType = "conflict" // hostname is announced by more than one instance
+)
+
+// Event describes a single change in Discoveries storage
+type Event struct {
+	Type      EventType     `json:"type"`
+	Time      time.Time     `json:"time"`
+	Namespace string        `json:"namespace"`
+	Hostname  string        `json:"hostname"`
+	Old       *Discovery    `json:"old,omitempty"`      // nil for joined event
+	New       *Discovery    `json:"new,omitempty"`      // nil for left and expired events
+	Added     Labels        `json:"added,omitempty"`    // labels that are in New but not in Old
+	Removed   Labels        `json:"removed,omitempty"`  // labels that are in Old but not in New
+	Changed   []ValueChange `json:"changed,omitempty"`  // keys of key:value labels with different values in Old and New
+	Conflict  *Conflict     `json:"conflict,omitempty"` // only for conflict event
+}
+
+// Diff returns changes between the old and the new version of the discovery. Missing version is
+// considered to be a discovery without labels, so all labels are added for joined event and removed
+// for left and expired events.
+func (e *Event) Diff() Diff {
+	old := Discovery{Namespace: e.Namespace, Hostname: e.Hostname}
+	new := old
+	if e.Old != nil {
+		old = *e.Old
+	}
+	if e.New != nil {
+		new = *e.New
+	}
+	return DiffDiscoveries(old, new)
+}
+
+// Discovery returns the new version of the discovery or the old one if there is no new one
+func (e *Event) Discovery() Discovery {
+	if e.New != nil {
+		return *e.New
+	}
+	if e.Old != nil {
+		return *e.Old
+	}
+	return Discovery{}
+}
+
+// newEvent creates event of given type, old or new can be nil
+func newEvent(eventType EventType, old, new *Discovery) Event {
+	event := Event{
+		Type: eventType,
+		Time: time.Now(),
+	}
+
+	var oldLabels, newLabels Labels
+	if old != nil {
+		oldCopy := copyDiscovery(*old)
+		event.Old = &oldCopy
+		event.Namespace = old.Namespace
+		event.Hostname = old.Hostname
+		oldLabels = old.Labels
+	}
+	if new != nil {
+		newCopy := copyDiscovery(*new)
+		event.New = &newCopy
+		event.Namespace = new.Namespace
+		event.Hostname = new.Hostname
+		newLabels = new.Labels
+	}
+
+	event.Added = labelsDifference(newLabels, oldLabels)
+	event.Removed = labelsDifference(oldLabels, newLabels)
+	if old != nil && new != nil {
+		event.Changed = valueChanges(oldLabels, newLabels)
+	}
+
+	return event
+}
+
+// newConflictEvent creates event about newly detected hostname conflict
+func newConflictEvent(discovery Discovery, conflict Conflict) Event {
+	discovery = copyDiscovery(discovery)
+
+	return Event{
+		Type:      EventConflict,
+		Time:      time.Now(),
+		Namespace: discovery.Namespace,
+		Hostname:  discovery.Hostname,
+		New:       &discovery,
+		Conflict:  &conflict,
+	}
+}
+
+// labelsDifference returns labels from a that are not in b
+func labelsDifference(a, b Labels) Labels {
+	index := make(map[Label]bool, len(b))
+	for _, label := range b {
+		index[label] = true
+	}
+
+	difference := Labels{}
+	for _, label := range a {
+		if !index[label] {
+			difference = append(difference, label)
+		}
+	}
+
+	if len(difference) == 0 {
+		return nil
+	}
+	return difference
+}
+
+// subscription delivers events to a single subscriber. Events are queued so publishing never blocks
+// the storage, the subscriber has to read the channel to release the memory.
+type subscription struct {
+	lock   sync.Mutex
+	queue  []Event
+	signal chan struct{}
+	done   chan struct{}
+	once   sync.Once
+	events chan Event
+}
+
+func newSubscription() *subscription {
+	s := &subscription{
+		signal: make(chan struct{}, 1),
+		done:   make(chan struct{}),
+		events: make(chan Event),
+	}
+	go s.run()
+	return s
+}
+
+// push adds event into the queue
+func (s *subscription) push(event Event) {
+	s.lock.Lock()
+	s.queue = append(s.queue, event)
+	s.lock.Unlock()
+
+	select {
+	case s.signal <- struct{}{}:
+	default:
+	}
+}
+
+// run passes queued events into the events channel until the subscription is cancelled
+func (s *subscription) run() {
+	defer close(s.events)
+
+	for {
+		s.lock.Lock()
+		queue := s.queue
+		s.queue = nil
+		s.lock.Unlock()
+
+		for _, event := range queue {
+			select {
+			case s.events <- event:
+			case <-s.done:
+				return
+			}
+		}
+
+		select {
+		case <-s.signal:
+		case <-s.done:
+			return
+		}
+	}
+}
+
+func (s *subscription) cancel() {
+	s.once.Do(func() {
+		close(s.done)
+	})
+}
+
+// Subscribe returns channel where all future events from the storage are sent in order they happened
+// and a function that cancels the subscription and closes the channel.
+func (d *Discoveries) Subscribe() (<-chan Event, func()) {
+	s := newSubscription()
+
+	d.lock.Lock()
+	d.subscribers = append(d.subscribers, s)
+	d.lock.Unlock()
+
+	cancel := func() {
+		d.lock.Lock()
+		for idx, subscriber := range d.subscribers {
+			if subscriber == s {
+				d.subscribers = append(d.subscribers[:idx], d.subscribers[idx+1:]...)
+				break
+			}
+		}
+		d.lock.Unlock()
+
+		s.cancel()
+	}
+
+	return s.events, cancel
+}
+
+// publish sends event to all subscribers, it has to be called with the write lock held so the events keep their order
+func (d *Discoveries) publish(event Event) {
+	for _, subscriber := range d.subscribers {
+		subscriber.push(event)
+	}
+}
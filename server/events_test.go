@@ -0,0 +1,80 @@
+package server
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// nextEvent returns next event from the channel or fails the test after a second
+func nextEvent(t *testing.T, events <-chan Event) Event {
+	select {
+	case event := <-events:
+		return event
+	case <-time.After(time.Second):
+		t.Fatal("no event received")
+	}
+	return Event{}
+}
+
+func TestDiscoveriesEvents(t *testing.T) {
+	discoveries := Discoveries{TTL: 30}
+
+	events, cancel := discoveries.Subscribe()
+	events2, cancel2 := discoveries.Subscribe()
+
+	discoveries.Add(Discovery{Hostname: "a.example.com", Labels: Labels{"service:smtp"}})
+	discoveries.Add(Discovery{Hostname: "a.example.com", Labels: Labels{"service:smtp"}}) // keep alive, no event
+	discoveries.Add(Discovery{Hostname: "a.example.com", Labels: Labels{"service:imap"}})
+	discoveries.Add(Discovery{Hostname: "b.example.com", Labels: Labels{"service:smtp"}})
+	discoveries.Delete(DefaultNamespace, "a.example.com")
+	discoveries.Delete(DefaultNamespace, "a.example.com") // doesn't exist anymore, no event
+
+	// Expire b.example.com
+	discoveries.lock.Lock()
+	expired := discoveries.activeServers[discoveryKey(DefaultNamespace, "b.example.com")]
+	expired.LastCheck = time.Now().Unix() - 60
+	discoveries.activeServers[discoveryKey(DefaultNamespace, "b.example.com")] = expired
+	discoveries.lock.Unlock()
+	discoveries.Clean()
+
+	event := nextEvent(t, events)
+	assert.Equal(t, EventJoined, event.Type)
+	assert.Equal(t, "a.example.com", event.Hostname)
+	assert.Nil(t, event.Old)
+	assert.Equal(t, Labels{"service:smtp"}, event.Added)
+	assert.False(t, event.Time.IsZero())
+
+	event = nextEvent(t, events)
+	assert.Equal(t, EventUpdated, event.Type)
+	assert.Equal(t, Labels{"service:smtp"}, event.Old.Labels)
+	assert.Equal(t, Labels{"service:imap"}, event.New.Labels)
+	assert.Equal(t, Labels{"service:imap"}, event.Added)
+	assert.Equal(t, Labels{"service:smtp"}, event.Removed)
+
+	event = nextEvent(t, events)
+	assert.Equal(t, EventJoined, event.Type)
+	assert.Equal(t, "b.example.com", event.Hostname)
+
+	event = nextEvent(t, events)
+	assert.Equal(t, EventLeft, event.Type)
+	assert.Equal(t, "a.example.com", event.Discovery().Hostname)
+	assert.Nil(t, event.New)
+
+	event = nextEvent(t, events)
+	assert.Equal(t, EventExpired, event.Type)
+	assert.Equal(t, "b.example.com", event.Hostname)
+
+	// Second subscriber gets the same events
+	assert.Equal(t, EventJoined, nextEvent(t, events2).Type)
+
+	cancel()
+	_, ok := <-events
+	assert.False(t, ok, "channel should be closed after cancel")
+
+	// Cancelled subscriber doesn't block the others
+	discoveries.Add(Discovery{Hostname: "c.example.com"})
+	cancel2()
+	assert.Equal(t, 0, len(discoveries.subscribers))
+}
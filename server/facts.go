@@ -0,0 +1,219 @@
+package server
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/shirou/gopsutil/v3/cpu"
+	"github.com/shirou/gopsutil/v3/host"
+	"github.com/shirou/gopsutil/v3/mem"
+	psnet "github.com/shirou/gopsutil/v3/net"
+)
+
+const (
+	SystemFactsPrefix = "sys:"              // prefix reserved for labels of SystemFacts provider
+	DMIPath           = "/sys/class/dmi/id" // where DMI information is exported by Linux kernel
+)
+
+// SystemFactNames contains all facts supported by SystemFacts
+var SystemFactNames = []string{"os", "platform", "kernel", "arch", "cpus", "memory", "virtualization", "boot_time", "ip", "dmi"}
+
+// IsValidSystemFact returns true if the name is one of SystemFactNames
+func IsValidSystemFact(name string) bool {
+	for _, fact := range SystemFactNames {
+		if fact == name {
+			return true
+		}
+	}
+	return false
+}
+
+// reservedPrefixes are prefixes of labels that can be published only by the built-in providers, so other
+// labels can't pretend to be system facts or cloud metadata
+var reservedPrefixes = []struct{ prefix, owner string }{
+	{SystemFactsPrefix, "system facts"},
+	{CloudMetadataPrefix, "cloud metadata"},
+}
+
+// HasReservedPrefix returns true if the label uses prefix reserved for system facts or cloud metadata
+func (l Label) HasReservedPrefix() bool {
+	return l.ReservedPrefixError() != nil
+}
+
+// ReservedPrefixError returns error saying which reserved prefix the label uses, nil if it doesn't use any
+func (l Label) ReservedPrefixError() error {
+	for _, reserved := range reservedPrefixes {
+		if strings.HasPrefix(l.String(), reserved.prefix) {
+			return fmt.Errorf("prefix %s is reserved for %s", reserved.prefix, reserved.owner)
+		}
+	}
+	return nil
+}
+
+// SystemFacts is a label provider that publishes facts about the local system under SystemFactsPrefix:
+//
+//	sys:os:linux
+//	sys:platform:ubuntu
+//	sys:platform_version:20.04
+//	sys:kernel:5.4.0-80-generic
+//	sys:arch:x86_64
+//	sys:cpus:8
+//	sys:memory:16777216000                  total memory in bytes
+//	sys:virtualization_system:kvm
+//	sys:virtualization_role:guest
+//	sys:boot_time:1628000000                unix timestamp
+//	sys:ip4:eth0:192.168.1.10               every non-loopback address of every interface
+//	sys:ip6:eth0:fe80::1
+//	sys:dmi:vendor:Dell Inc.
+//	sys:dmi:product:PowerEdge R640
+//
+// Facts are gathered again every time labels are requested so they are never out of date.
+type SystemFacts struct {
+	Facts   []string // which facts are published, see SystemFactNames
+	DMIPath string   // directory with DMI information, DMIPath constant is used if it's empty
+
+	LogChannel chan string // facts that are not valid labels are reported here if it's set
+
+	errors errorReporter
+}
+
+// Name returns name of the provider
+func (s *SystemFacts) Name() string {
+	return "sys"
+}
+
+// Labels returns labels with the enabled facts. Facts that are not available on this system or that are not
+// valid labels (e.g. DMI value with a control character) are skipped so a single fact doesn't withdraw all of them
+// or make the whole discovery packet invalid. Only unknown fact is an error.
+func (s *SystemFacts) Labels() (Labels, error) {
+	labels := Labels{}
+
+	var info *host.InfoStat
+	for _, fact := range s.Facts {
+		switch fact {
+		case "os", "platform", "kernel", "arch", "virtualization", "boot_time":
+			if info == nil {
+				// host.Info returns partial info with warnings on some systems, what's available is used
+				info, _ = host.Info()
+				if info == nil {
+					info = &host.InfoStat{}
+				}
+			}
+		}
+
+		switch fact {
+		case "os":
+			labels = appendFact(labels, "os", info.OS)
+		case "platform":
+			labels = appendFact(labels, "platform", info.Platform)
+			labels = appendFact(labels, "platform_version", info.PlatformVersion)
+		case "kernel":
+			labels = appendFact(labels, "kernel", info.KernelVersion)
+		case "arch":
+			labels = appendFact(labels, "arch", info.KernelArch)
+		case "virtualization":
+			labels = appendFact(labels, "virtualization_system", info.VirtualizationSystem)
+			labels = appendFact(labels, "virtualization_role", info.VirtualizationRole)
+		case "boot_time":
+			if info.BootTime > 0 {
+				labels = appendFact(labels, "boot_time", strconv.FormatUint(info.BootTime, 10))
+			}
+		case "cpus":
+			count, err := cpu.Counts(true)
+			if err == nil && count > 0 {
+				labels = appendFact(labels, "cpus", strconv.Itoa(count))
+			}
+		case "memory":
+			memory, err := mem.VirtualMemory()
+			if err == nil {
+				labels = appendFact(labels, "memory", strconv.FormatUint(memory.Total, 10))
+			}
+		case "ip":
+			interfaces, err := psnet.Interfaces()
+			if err == nil {
+				labels = append(labels, interfaceLabels(interfaces)...)
+			}
+		case "dmi":
+			labels = append(labels, s.dmiLabels()...)
+		default:
+			return labels, fmt.Errorf("unknown system fact %s", fact)
+		}
+	}
+
+	valid := Labels{}
+	invalid := []string{}
+	for _, label := range labels {
+		err := label.Validate()
+		if err != nil {
+			invalid = append(invalid, fmt.Sprintf("system fact skipped: %v", err))
+			continue
+		}
+		valid = append(valid, label)
+	}
+	s.errors.report(s.LogChannel, invalid)
+
+	return valid, nil
+}
+
+// appendFact adds label with the fact if the value is not empty
+func appendFact(labels Labels, name, value string) Labels {
+	value = strings.TrimSpace(value)
+	if len(value) == 0 {
+		return labels
+	}
+	return append(labels, Label(SystemFactsPrefix+name+":"+value))
+}
+
+// interfaceLabels returns labels with all non-loopback addresses of the interfaces
+func interfaceLabels(interfaces psnet.InterfaceStatList) Labels {
+	labels := Labels{}
+
+	for _, iface := range interfaces {
+		for _, addr := range iface.Addrs {
+			ip, _, err := net.ParseCIDR(addr.Addr)
+			if err != nil {
+				ip = net.ParseIP(addr.Addr)
+			}
+			if ip == nil || ip.IsLoopback() {
+				continue
+			}
+
+			if ip.To4() != nil {
+				labels = appendFact(labels, "ip4:"+iface.Name, ip.String())
+			} else {
+				labels = appendFact(labels, "ip6:"+iface.Name, ip.String())
+			}
+		}
+	}
+
+	sort.Slice(labels, func(i, j int) bool {
+		return labels[i] < labels[j]
+	})
+
+	return labels
+}
+
+// dmiLabels returns vendor and product name of the machine, missing files are skipped
+func (s *SystemFacts) dmiLabels() Labels {
+	labels := Labels{}
+
+	dmiPath := s.DMIPath
+	if len(dmiPath) == 0 {
+		dmiPath = DMIPath
+	}
+
+	for _, fact := range []struct{ name, filename string }{{"vendor", "sys_vendor"}, {"product", "product_name"}} {
+		content, err := os.ReadFile(path.Join(dmiPath, fact.filename))
+		if err != nil {
+			continue
+		}
+		labels = appendFact(labels, "dmi:"+fact.name, string(content))
+	}
+
+	return labels
+}
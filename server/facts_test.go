@@ -0,0 +1,106 @@
+package server
+
+import (
+	"os"
+	"strings"
+	"testing"
+
+	psnet "github.com/shirou/gopsutil/v3/net"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSystemFacts(t *testing.T) {
+	facts := SystemFacts{Facts: []string{"arch", "cpus", "memory"}}
+
+	labels, err := facts.Labels()
+	assert.Nil(t, err)
+	assert.Equal(t, 3, len(labels))
+	for _, label := range labels {
+		assert.True(t, label.HasReservedPrefix())
+		assert.Nil(t, label.Validate())
+	}
+	assert.Equal(t, "sys:arch", labels[0].String()[:len("sys:arch")])
+
+	cpus, err := Label(strings.TrimPrefix(labels[1].String(), SystemFactsPrefix)).Int()
+	assert.Nil(t, err)
+	assert.True(t, cpus > 0)
+
+	facts.Facts = []string{"unknown"}
+	_, err = facts.Labels()
+	assert.NotNil(t, err)
+}
+
+func TestSystemFactsDMI(t *testing.T) {
+	dmiPath := tmpPath + "/dmi"
+	err := os.MkdirAll(dmiPath, os.ModePerm)
+	assert.Nil(t, err)
+	defer os.RemoveAll(tmpPath)
+
+	err = os.WriteFile(dmiPath+"/sys_vendor", []byte("Dell Inc.\n"), 0644)
+	assert.Nil(t, err)
+
+	facts := SystemFacts{Facts: []string{"dmi"}, DMIPath: dmiPath}
+	labels, err := facts.Labels()
+	assert.Nil(t, err)
+	assert.Equal(t, Labels{"sys:dmi:vendor:Dell Inc."}, labels)
+
+	// Invalid value is skipped and reported once, the other facts are kept
+	err = os.WriteFile(dmiPath+"/product_name", []byte("Power\x01Edge\n"), 0644)
+	assert.Nil(t, err)
+	facts.LogChannel = make(chan string, 10)
+	labels, err = facts.Labels()
+	assert.Nil(t, err)
+	assert.Equal(t, Labels{"sys:dmi:vendor:Dell Inc."}, labels)
+	assert.Equal(t, 1, len(facts.LogChannel))
+	assert.Contains(t, <-facts.LogChannel, `label "sys:dmi:product:Power\x01Edge" contains control character`)
+
+	_, err = facts.Labels()
+	assert.Nil(t, err)
+	assert.Equal(t, 0, len(facts.LogChannel))
+}
+
+func TestInterfaceLabels(t *testing.T) {
+	interfaces := psnet.InterfaceStatList{
+		{Name: "lo", Addrs: psnet.InterfaceAddrList{{Addr: "127.0.0.1/8"}, {Addr: "::1/128"}}},
+		{Name: "eth0", Addrs: psnet.InterfaceAddrList{{Addr: "192.168.1.10/24"}, {Addr: "fe80::1/64"}}},
+		{Name: "eth1", Addrs: psnet.InterfaceAddrList{{Addr: "10.0.0.1/8"}}},
+	}
+
+	assert.Equal(t, Labels{
+		"sys:ip4:eth0:192.168.1.10",
+		"sys:ip4:eth1:10.0.0.1",
+		"sys:ip6:eth0:fe80::1",
+	}, interfaceLabels(interfaces))
+}
+
+func TestReservedPrefix(t *testing.T) {
+	localHost := LocalHost{
+		LabelsPath:            testLabelPath,
+		RuntimeLabelsFilename: "_runtime",
+	}
+
+	err := os.MkdirAll(testLabelPath, os.ModePerm)
+	assert.Nil(t, err)
+	defer os.RemoveAll(tmpPath)
+
+	err = localHost.AddLabels(Labels{"sys:os:windows"})
+	assert.NotNil(t, err)
+
+	provider := ExecProvider{ProviderName: "test", Command: []string{"echo", "sys:os:windows"}}
+	err = provider.Run()
+	assert.NotNil(t, err)
+
+	// Cloud metadata labels can't be faked either
+	err = localHost.AddLabels(Labels{"cloud:region:eu-west-1"})
+	if assert.NotNil(t, err) {
+		assert.Equal(t, "label cloud:region:eu-west-1 can't be added, prefix cloud: is reserved for cloud metadata", err.Error())
+	}
+
+	provider.Command = []string{"echo", "cloud:instance_id:i-1234"}
+	err = provider.Run()
+	if assert.NotNil(t, err) {
+		assert.Contains(t, err.Error(), "line 1: prefix cloud: is reserved for cloud metadata")
+	}
+
+	assert.False(t, Label("cloudy").HasReservedPrefix())
+}
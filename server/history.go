@@ -0,0 +1,228 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+)
+
+const DefaultHistorySize = 1000 // default number of events kept in History
+
+// HistoryFilter describes which events should be returned by History.Find. Empty values are ignored.
+type HistoryFilter struct {
+	Namespace string
+	Hostname  string
+	Since     time.Time
+	Until     time.Time
+	Query     *Query // event matches if the old or the new version of the discovery matches the query
+}
+
+// Match returns true if the event passes the filter
+func (f *HistoryFilter) Match(event Event) bool {
+	if len(f.Namespace) > 0 && NormalizeNamespace(event.Namespace) != NormalizeNamespace(f.Namespace) {
+		return false
+	}
+	if len(f.Hostname) > 0 && event.Hostname != f.Hostname {
+		return false
+	}
+	if !f.Since.IsZero() && event.Time.Before(f.Since) {
+		return false
+	}
+	if !f.Until.IsZero() && event.Time.After(f.Until) {
+		return false
+	}
+	if f.Query != nil {
+		oldMatch := event.Old != nil && f.Query.Match(*event.Old)
+		newMatch := event.New != nil && f.Query.Match(*event.New)
+		if !oldMatch && !newMatch {
+			return false
+		}
+	}
+	return true
+}
+
+// History is a bounded journal of events from Discoveries. If Filename is set, events are appended
+// to the file, one JSON per line, and they can be loaded back after restart by Load. The file is
+// compacted when it grows over twice the size of the journal.
+type History struct {
+	Size     int    // maximum number of kept events, DefaultHistorySize is used if it's zero
+	Filename string // file where the events are stored, if empty the history is kept only in memory
+
+	lock          sync.RWMutex
+	events        []Event
+	file          *os.File
+	linesInFile   int
+	compactFailed bool
+}
+
+func (h *History) size() int {
+	if h.Size <= 0 {
+		return DefaultHistorySize
+	}
+	return h.Size
+}
+
+// trim drops the oldest events over the size limit, it has to be called with the write lock held.
+// Events are dropped in batches once there is twice the size of them, so they are not copied on every Add.
+func (h *History) trim() {
+	if len(h.events) > 2*h.size() {
+		h.events = append([]Event{}, h.kept()...)
+	}
+}
+
+// kept returns the last Size events, it has to be called with the lock held
+func (h *History) kept() []Event {
+	if len(h.events) > h.size() {
+		return h.events[len(h.events)-h.size():]
+	}
+	return h.events
+}
+
+// Load reads events stored in Filename. Missing file is not an error.
+func (h *History) Load() error {
+	if len(h.Filename) == 0 {
+		return nil
+	}
+
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	file, err := os.Open(h.Filename)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("opening history file error: %v", err)
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	lineNumber := 0
+	for scanner.Scan() {
+		lineNumber++
+		event := Event{}
+		err = json.Unmarshal(scanner.Bytes(), &event)
+		if err != nil {
+			return fmt.Errorf("%s:%d: decoding history event error: %v", h.Filename, lineNumber, err)
+		}
+		h.events = append(h.events, event)
+		h.trim()
+	}
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("reading history file error: %v", err)
+	}
+
+	h.linesInFile = lineNumber
+
+	return nil
+}
+
+// Add appends event into the journal
+func (h *History) Add(event Event) error {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	h.events = append(h.events, event)
+	h.trim()
+
+	if len(h.Filename) == 0 {
+		return nil
+	}
+
+	if h.linesInFile >= 2*h.size() && !h.compactFailed {
+		err := h.compact()
+		if err != nil {
+			// Let's not try it again for every event, the journal still works in append mode
+			h.compactFailed = true
+			return err
+		}
+		return nil
+	}
+
+	return h.append(event)
+}
+
+// append writes a single event at the end of the file, it has to be called with the write lock held
+func (h *History) append(event Event) error {
+	if h.file == nil {
+		file, err := os.OpenFile(h.Filename, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0640)
+		if err != nil {
+			return fmt.Errorf("opening history file error: %v", err)
+		}
+		h.file = file
+	}
+
+	data, err := json.Marshal(event)
+	if err != nil {
+		return fmt.Errorf("encoding history event error: %v", err)
+	}
+
+	_, err = h.file.Write(append(data, '\n'))
+	if err != nil {
+		return fmt.Errorf("writing history file error: %v", err)
+	}
+	h.linesInFile++
+
+	return nil
+}
+
+// compact replaces the file by the events kept in memory, it has to be called with the write lock held
+func (h *History) compact() error {
+	events := h.kept()
+	content := &bytes.Buffer{}
+	for _, event := range events {
+		data, err := json.Marshal(event)
+		if err != nil {
+			return fmt.Errorf("encoding history event error: %v", err)
+		}
+		content.Write(append(data, '\n'))
+	}
+
+	err := writeFileAtomically(h.Filename, content.Bytes(), 0640)
+	if err != nil {
+		return fmt.Errorf("compacting history file error: %v", err)
+	}
+
+	// The file is replaced, the next event is appended to the new one
+	if h.file != nil {
+		h.file.Close()
+		h.file = nil
+	}
+	h.linesInFile = len(events)
+
+	return nil
+}
+
+// Find returns events matching the filter from the oldest to the newest
+func (h *History) Find(filter HistoryFilter) []Event {
+	h.lock.RLock()
+	defer h.lock.RUnlock()
+
+	events := []Event{}
+	for _, event := range h.kept() {
+		if filter.Match(event) {
+			events = append(events, event)
+		}
+	}
+
+	return events
+}
+
+// Close closes the history file
+func (h *History) Close() error {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	if h.file == nil {
+		return nil
+	}
+
+	err := h.file.Close()
+	h.file = nil
+	return err
+}
@@ -0,0 +1,94 @@
+package server
+
+import (
+	"fmt"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHistory(t *testing.T) {
+	err := os.MkdirAll(tmpPath, os.ModePerm)
+	assert.Nil(t, err)
+	defer os.RemoveAll(tmpPath)
+
+	historyFile := tmpPath + "/history.jsonl"
+	history := History{Size: 3, Filename: historyFile}
+
+	smtp := Discovery{Hostname: "smtp2.example.com", Labels: Labels{"service:smtp"}}
+	smtpUpdated := Discovery{Hostname: "smtp2.example.com", Labels: Labels{"service:smtp", "location:prague"}}
+	imap := Discovery{Hostname: "imap.example.com", Labels: Labels{"service:imap"}}
+
+	events := []Event{
+		newEvent(EventJoined, nil, &smtp),
+		newEvent(EventJoined, nil, &imap),
+		newEvent(EventUpdated, &smtp, &smtpUpdated),
+		newEvent(EventExpired, &smtpUpdated, nil),
+	}
+	events[0].Time = time.Now().Add(-time.Hour)
+
+	for _, event := range events {
+		assert.Nil(t, history.Add(event))
+	}
+
+	// The first event is over the limit
+	found := history.Find(HistoryFilter{})
+	assert.Equal(t, 3, len(found))
+	assert.Equal(t, EventJoined, found[0].Type)
+	assert.Equal(t, "imap.example.com", found[0].Hostname)
+
+	found = history.Find(HistoryFilter{Hostname: "smtp2.example.com"})
+	assert.Equal(t, 2, len(found))
+	assert.Equal(t, EventExpired, found[1].Type)
+	assert.Equal(t, Labels{"service:smtp", "location:prague"}, found[1].Old.Labels)
+
+	query, err := ParseQuery("location=prague")
+	assert.Nil(t, err)
+	found = history.Find(HistoryFilter{Query: query})
+	assert.Equal(t, 2, len(found))
+
+	found = history.Find(HistoryFilter{Until: time.Now().Add(-time.Minute)})
+	assert.Equal(t, 0, len(found))
+	found = history.Find(HistoryFilter{Since: time.Now().Add(-time.Minute)})
+	assert.Equal(t, 3, len(found))
+
+	assert.Nil(t, history.Close())
+
+	// Restore from the file
+	loaded := History{Size: 3, Filename: historyFile}
+	assert.Nil(t, loaded.Load())
+	found = loaded.Find(HistoryFilter{})
+	assert.Equal(t, 3, len(found))
+	assert.Equal(t, EventExpired, found[2].Type)
+
+	// Compaction keeps only the last events in the file
+	for i := 0; i < 4; i++ {
+		assert.Nil(t, loaded.Add(newEvent(EventJoined, nil, &imap)))
+	}
+	assert.Nil(t, loaded.Close())
+
+	compacted := History{Size: 10, Filename: historyFile}
+	assert.Nil(t, compacted.Load())
+	assert.True(t, len(compacted.Find(HistoryFilter{})) < 8)
+
+	// Memory only history
+	memory := History{Size: 1}
+	assert.Nil(t, memory.Load())
+	assert.Nil(t, memory.Add(events[0]))
+	assert.Equal(t, 1, len(memory.Find(HistoryFilter{})))
+
+	// Old events are dropped in batches but only the last Size events are ever visible
+	memory = History{Size: 3}
+	for i := 0; i < 10; i++ {
+		event := newEvent(EventJoined, nil, &imap)
+		event.Hostname = fmt.Sprintf("%d.example.com", i)
+		assert.Nil(t, memory.Add(event))
+		assert.True(t, len(memory.events) <= 6)
+	}
+	found = memory.Find(HistoryFilter{})
+	assert.Equal(t, 3, len(found))
+	assert.Equal(t, "7.example.com", found[0].Hostname)
+	assert.Equal(t, "9.example.com", found[2].Hostname)
+}
@@ -2,80 +2,52 @@ package server
 
 import (
 	"fmt"
-	"io/ioutil"
-	"os"
-	"path"
-	"strings"
+	"sync"
 
 	"github.com/shirou/gopsutil/v3/host"
 )
 
 type LocalHost struct {
-	LabelsPath            string // Where labels are stored
-	RuntimeLabelsFilename string // Filename under which are runtime labels saved in LabelsPath
-	InitialLabels         Labels // this usually coming from the config
-	HostnameOverride      string // if not empty string hostname in the discovery packet will be replaced by this
-}
-
-// saveRuntimeLabels stores labels in the runtime filesname
-func (l *LocalHost) saveRuntimeLabels(labels Labels) error {
-	stringLabels := []string{}
+	LabelsPath            string   // Where labels are stored
+	RuntimeLabelsFilename string   // Filename under which older versions saved runtime labels in LabelsPath, it's ignored when labels are loaded, see MigrateRuntimeLabels
+	StatePath             string   // Directory where runtime labels are stored, they can't be added if it's empty
+	LabelsFilesPatterns   []string // if not empty only files in LabelsPath matching one of these patterns are loaded, see IsLabelsFile
+	InitialLabels         Labels   // this usually coming from the config
+	HostnameOverride      string   // if not empty string hostname in the discovery packet will be replaced by this
+	Namespace             string   // namespace the local server belongs to, empty means server.DefaultNamespace
+	InstanceID            string   // persistent ID of this daemon instance, see LoadInstanceID
+	TTL                   uint     // TTL advertised in the discovery packet, other nodes consider this server dead after this amount of secs without a packet
+	KeepAlive             uint     // keep alive interval advertised in the discovery packet [secs]
 
-	for _, label := range labels {
-		stringLabels = append(stringLabels, label.String())
-	}
+	Providers []LabelProvider // additional sources of labels
+	Checks    []*HealthCheck  // health checks that withdraw labels while they fail
 
-	content := strings.Join(stringLabels, "\n")
+	LogChannel chan string // errors of labels that are left out of the discovery packet are sent here if it's set
 
-	err := os.WriteFile(path.Join(l.LabelsPath, l.RuntimeLabelsFilename), []byte(content), 0755)
-	return err
-}
+	errors errorReporter
 
-// getRuntimeLabels returns labels from the runtime filename
-func (l *LocalHost) getRuntimeLabels() (Labels, error) {
-	labels := Labels{}
-
-	content, err := os.ReadFile(path.Join(l.LabelsPath, l.RuntimeLabelsFilename))
-	if err != nil {
-		if strings.Contains(err.Error(), "no such file or directory") {
-			return labels, nil
-		}
-
-		return labels, err
-	}
+	runtimeLock sync.Mutex
+	runtime     *runtimeLabelsState // loaded from StatePath on the first use
 
-	for _, label := range strings.Split(string(content), "\n") {
-		labels = append(labels, Label(strings.TrimSpace(label)))
-	}
+	leasesLock sync.Mutex
+	leases     map[string]*lease // ephemeral runtime labels, see Lease
 
-	return labels, nil
+	cacheLock sync.Mutex
+	cache     *labelSourcesIndex // labels from the environment and LabelsPath, used only while LabelsPath is watched
+	watching  bool
 }
 
-// AddLabel adds runtime label into the LabelsPath directory
+// AddLabels adds runtime labels into the state in StatePath
 func (l *LocalHost) AddLabels(labels Labels) error {
-	runtimeLabels, err := l.getRuntimeLabels()
-	if err != nil {
-		return fmt.Errorf("error while loading stored labels: %v", err)
-	}
-
-	var found bool
-
 	for _, label := range labels {
-		found = false
-
-		for _, runtimeLabel := range runtimeLabels {
-			if label == runtimeLabel {
-				found = true
-				break
-			}
-		}
-
-		if !found {
-			runtimeLabels = append(runtimeLabels, label)
+		if err := label.ReservedPrefixError(); err != nil {
+			return fmt.Errorf("label %s can't be added, %v", label, err)
 		}
 	}
 
-	err = l.saveRuntimeLabels(runtimeLabels)
+	err := l.updateRuntimeLabels(func(runtimeLabels Labels) Labels {
+		return appendMissingLabels(runtimeLabels, labels)
+	})
 	if err != nil {
 		return fmt.Errorf("error while saving new set of labels: %v", err)
 	}
@@ -83,32 +55,30 @@ func (l *LocalHost) AddLabels(labels Labels) error {
 	return nil
 }
 
-// DeleteLabels removed labels from LabelsPath directory. Only labels added this way can be deleted.
+// DeleteLabels removes runtime labels from the state in StatePath and from all leases. Only labels added via the REST API
+// can be deleted, *NotRuntimeLabelsError is returned if there is a label from other source and nothing is deleted.
+// Labels that don't exist are ignored.
 func (l *LocalHost) DeleteLabels(labels Labels) error {
-	runtimeLabels, err := l.getRuntimeLabels()
+	index, err := l.labelSources()
 	if err != nil {
-		return fmt.Errorf("error while loading stored labels: %v", err)
+		return fmt.Errorf("error while loading labels: %v", err)
 	}
 
-	newSet := Labels{}
-	var found bool
-
-	for _, runtimeLabel := range runtimeLabels {
-		found = false
-
-		for _, label := range labels {
-			if label == runtimeLabel {
-				found = true
-				break
-			}
-		}
-
-		if !found {
-			newSet = append(newSet, runtimeLabel)
+	notRuntime := []SourcedLabel{}
+	for _, label := range labels {
+		if sourced, ok := index.index[label]; ok && !sourced.IsRuntime() {
+			notRuntime = append(notRuntime, *sourced)
 		}
 	}
+	if len(notRuntime) > 0 {
+		return &NotRuntimeLabelsError{Labels: notRuntime}
+	}
+
+	l.deleteLeaseLabels(labels)
 
-	err = l.saveRuntimeLabels(newSet)
+	err = l.updateRuntimeLabels(func(runtimeLabels Labels) Labels {
+		return append(Labels{}, labelsDifference(runtimeLabels, labels)...)
+	})
 	if err != nil {
 		return fmt.Errorf("error while saving new set of labels: %v", err)
 	}
@@ -116,70 +86,65 @@ func (l *LocalHost) DeleteLabels(labels Labels) error {
 	return nil
 }
 
+// hostname returns HostnameOverride or hostname of the system if it's empty
+func (l *LocalHost) hostname() (string, error) {
+	if len(l.HostnameOverride) > 0 {
+		return l.HostnameOverride, nil
+	}
+
+	info, err := host.Info()
+	if err != nil {
+		return "", err
+	}
+	return info.Hostname, nil
+}
+
 // GetIdentification assembles the discovery packet that contains hotname and set of labels describing a single server, in this case the local server.
 // Parameter initialLabels usually coming from configuration of the app.
 // If hostname is empty it will be discovered automatically.
 func (l *LocalHost) GetIdentification() (Discovery, error) {
 	discovery := Discovery{}
 
-	localLabels, err := l.loadLocalLabels()
+	index, err := l.labelSources()
 	if err != nil {
 		return discovery, err
 	}
 
-	if len(l.HostnameOverride) == 0 {
-		info, err := host.Info()
-		if err != nil {
-			return discovery, err
-		}
-		discovery.Hostname = info.Hostname
-	} else {
-		discovery.Hostname = l.HostnameOverride
+	discovery.Hostname, err = l.hostname()
+	if err != nil {
+		return discovery, err
 	}
 
-	discovery.Labels = append(l.InitialLabels, localLabels...)
+	discovery.Namespace = NormalizeNamespace(l.Namespace)
+	discovery.InstanceID = l.InstanceID
+	discovery.TTL = l.TTL
+	discovery.KeepAlive = l.KeepAlive
+	discovery.Labels = Labels{}
+	for _, label := range index.labels {
+		if label.IsPublished() {
+			discovery.Labels = append(discovery.Labels, label.Label)
+		}
+	}
 	discovery.SortLabels()
 
 	return discovery, nil
 }
 
-// loadLocalLabels scans local directory where labels are stored and adds them to the labels configured as environment variables.
+// loadLocalLabels scans local directory where labels are stored and returns labels that are not already configured as environment variables.
 // Filename in LabelsPath is not importent and each file can contain multiple labels, one per each line.
 func (l *LocalHost) loadLocalLabels() (Labels, error) {
 	labels := Labels{}
-	var found bool
 
-	if _, err := os.Stat(l.LabelsPath); !os.IsNotExist(err) {
-		files, err := ioutil.ReadDir(l.LabelsPath)
-		if err != nil {
-			return labels, err
-		}
+	index, err := l.labelSources()
+	if err != nil {
+		return labels, err
+	}
 
-		for _, filename := range files {
-			fullPath := path.Join(l.LabelsPath, filename.Name())
-
-			content, err := os.ReadFile(fullPath)
-			if err != nil {
-				return labels, fmt.Errorf("read file error: %v", err)
-
-			}
-
-			for _, line := range strings.Split(string(content), "\n") {
-				line = strings.TrimSpace(line)
-				if len(line) > 0 {
-					found = false
-					for _, skipLabel := range l.InitialLabels {
-						if skipLabel == Label(line) {
-							found = true
-							break
-						}
-					}
-					if !found {
-						labels = append(labels, Label(line))
-					}
-				}
-			}
+	for _, label := range index.labels {
+		if label.Sources[0].Type != LabelSourceEnv {
+			labels = append(labels, label.Label)
 		}
 	}
+
 	return labels, nil
 }
@@ -0,0 +1,207 @@
+package server
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strings"
+)
+
+// labelInterpolator replaces variables in labels from LABELS and label files:
+//
+//	${hostname}      hostname of the server as it's advertised in the discovery packet
+//	${namespace}     namespace of the server
+//	${env.NAME}      environment variable NAME
+//	${ip4.IFACE}     first IPv4 address of interface IFACE
+//	${ip6.IFACE}     first IPv6 address of interface IFACE that is not link-local
+//	${label.KEY}     value of the other label with key KEY, there has to be exactly one such label
+//
+// $${ is replaced by literal ${. Undefined variable is an error so broken labels are never published.
+type labelInterpolator struct {
+	localHost *LocalHost
+	labels    Labels // labels used for ${label.KEY} variables, before interpolation
+
+	hostname  string
+	resolved  map[Label]Label
+	resolving map[Label]bool
+}
+
+// UndefinedVariableError is returned when a label contains variable that can't be resolved
+type UndefinedVariableError struct {
+	Variable string
+	Reason   string
+}
+
+func (e *UndefinedVariableError) Error() string {
+	return fmt.Sprintf("undefined variable ${%s}: %s", e.Variable, e.Reason)
+}
+
+func newLabelInterpolator(localHost *LocalHost, labels Labels) *labelInterpolator {
+	return &labelInterpolator{
+		localHost: localHost,
+		labels:    labels,
+		resolved:  make(map[Label]Label),
+		resolving: make(map[Label]bool),
+	}
+}
+
+// hasVariables returns true if the label contains anything to interpolate
+func hasVariables(label Label) bool {
+	return strings.Contains(label.String(), "${")
+}
+
+// interpolate returns the label with all variables replaced by their values
+func (i *labelInterpolator) interpolate(label Label) (Label, error) {
+	if !hasVariables(label) {
+		return label, nil
+	}
+	if resolved, ok := i.resolved[label]; ok {
+		return resolved, nil
+	}
+	if i.resolving[label] {
+		return label, fmt.Errorf("label %s references itself", label)
+	}
+	i.resolving[label] = true
+	defer delete(i.resolving, label)
+
+	input := label.String()
+	output := &strings.Builder{}
+	for {
+		start := strings.Index(input, "${")
+		if start < 0 {
+			output.WriteString(input)
+			break
+		}
+
+		// $${ is an escaped ${
+		if start > 0 && input[start-1] == '$' {
+			output.WriteString(input[:start-1])
+			output.WriteString("${")
+			input = input[start+2:]
+			continue
+		}
+
+		end := strings.Index(input[start:], "}")
+		if end < 0 {
+			return label, fmt.Errorf("unterminated variable in %s", label)
+		}
+
+		value, err := i.variable(input[start+2 : start+end])
+		if err != nil {
+			return label, err
+		}
+
+		output.WriteString(input[:start])
+		output.WriteString(value)
+		input = input[start+end+1:]
+	}
+
+	resolved := Label(output.String())
+	err := resolved.Validate()
+	if err != nil {
+		return label, fmt.Errorf("interpolated label %s is not valid: %v", resolved, err)
+	}
+	if err := resolved.ReservedPrefixError(); err != nil {
+		return label, fmt.Errorf("interpolated label %s can't be used, %v", resolved, err)
+	}
+
+	i.resolved[label] = resolved
+	return resolved, nil
+}
+
+// variable returns value of a single variable
+func (i *labelInterpolator) variable(name string) (string, error) {
+	kind, argument := name, ""
+	if idx := strings.Index(name, "."); idx >= 0 {
+		kind, argument = name[:idx], name[idx+1:]
+	}
+
+	switch {
+	case name == "hostname":
+		if len(i.hostname) == 0 {
+			hostname, err := i.localHost.hostname()
+			if err != nil {
+				return "", &UndefinedVariableError{Variable: name, Reason: err.Error()}
+			}
+			i.hostname = hostname
+		}
+		return i.hostname, nil
+	case name == "namespace":
+		return NormalizeNamespace(i.localHost.Namespace), nil
+	case kind == "env" && len(argument) > 0:
+		value, ok := os.LookupEnv(argument)
+		if !ok {
+			return "", &UndefinedVariableError{Variable: name, Reason: "environment variable is not set"}
+		}
+		return value, nil
+	case (kind == "ip4" || kind == "ip6") && len(argument) > 0:
+		ip, err := interfaceAddress(argument, kind == "ip4")
+		if err != nil {
+			return "", &UndefinedVariableError{Variable: name, Reason: err.Error()}
+		}
+		return ip, nil
+	case kind == "label" && len(argument) > 0:
+		return i.labelValue(name, argument)
+	default:
+		return "", &UndefinedVariableError{Variable: name, Reason: "unknown variable"}
+	}
+}
+
+// labelValue returns value of the only label with given key
+func (i *labelInterpolator) labelValue(name, key string) (string, error) {
+	values := []string{}
+	for _, label := range i.labels {
+		if label.Key() != key {
+			continue
+		}
+
+		resolved, err := i.interpolate(label)
+		if err != nil {
+			return "", err
+		}
+		if resolved.HasValue() {
+			values = append(values, resolved.Value())
+		}
+	}
+
+	switch len(values) {
+	case 0:
+		return "", &UndefinedVariableError{Variable: name, Reason: "there is no label with this key"}
+	case 1:
+		return values[0], nil
+	default:
+		return "", &UndefinedVariableError{Variable: name, Reason: fmt.Sprintf("there are %d labels with this key", len(values))}
+	}
+}
+
+// interfaceAddress returns the first IPv4 or the first not link-local IPv6 address of the interface
+func interfaceAddress(name string, ip4 bool) (string, error) {
+	iface, err := net.InterfaceByName(name)
+	if err != nil {
+		return "", err
+	}
+
+	addrs, err := iface.Addrs()
+	if err != nil {
+		return "", err
+	}
+
+	for _, addr := range addrs {
+		ipNet, ok := addr.(*net.IPNet)
+		if !ok {
+			continue
+		}
+
+		if ip4 && ipNet.IP.To4() != nil {
+			return ipNet.IP.String(), nil
+		}
+		if !ip4 && ipNet.IP.To4() == nil && !ipNet.IP.IsLinkLocalUnicast() {
+			return ipNet.IP.String(), nil
+		}
+	}
+
+	if ip4 {
+		return "", fmt.Errorf("interface %s has no IPv4 address", name)
+	}
+	return "", fmt.Errorf("interface %s has no IPv6 address", name)
+}
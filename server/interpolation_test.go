@@ -0,0 +1,123 @@
+package server
+
+import (
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestInterpolation(t *testing.T) {
+	os.Setenv("LOBBY_TEST_DC", "prague")
+	defer os.Unsetenv("LOBBY_TEST_DC")
+
+	localHost := LocalHost{
+		LabelsPath:            testLabelPath,
+		RuntimeLabelsFilename: "_runtime",
+		StatePath:             testStatePath,
+		HostnameOverride:      "test.example.com",
+		Namespace:             "mail",
+		InitialLabels:         Labels{"dc:${env.LOBBY_TEST_DC}", "backup:dir:/srv/${hostname}"},
+	}
+
+	err := os.MkdirAll(testLabelPath, os.ModePerm)
+	assert.Nil(t, err)
+	defer os.RemoveAll(tmpPath)
+
+	err = os.WriteFile(testLabelPath+"/test", []byte("location:${label.dc}/${namespace}\nprometheus:nodeexporter:host:${ip4.lo}\nprice:$${literal}"), 0644)
+	assert.Nil(t, err)
+
+	// Runtime labels are not interpolated
+	err = localHost.AddLabels(Labels{"runtime:${hostname}"})
+	assert.Nil(t, err)
+
+	discovery, err := localHost.GetIdentification()
+	assert.Nil(t, err)
+	assert.Equal(t, Labels{
+		"backup:dir:/srv/test.example.com",
+		"dc:prague",
+		"location:prague/mail",
+		"price:${literal}",
+		"prometheus:nodeexporter:host:127.0.0.1",
+		"runtime:${hostname}",
+	}, discovery.Labels)
+
+	labels, err := localHost.LabelSources()
+	assert.Nil(t, err)
+	assert.Equal(t, []LabelSource{{Type: LabelSourceFile, File: "tmp/labels/test", Line: 1}}, labels[2].Sources)
+}
+
+func TestInterpolationErrors(t *testing.T) {
+	localHost := LocalHost{
+		LabelsPath:            testLabelPath,
+		RuntimeLabelsFilename: "_runtime",
+		StatePath:             testStatePath,
+		HostnameOverride:      "test.example.com",
+		LogChannel:            make(chan string, 10),
+	}
+
+	err := os.MkdirAll(testLabelPath, os.ModePerm)
+	assert.Nil(t, err)
+	defer os.RemoveAll(tmpPath)
+
+	for _, testCase := range []struct {
+		labels Labels
+		err    string
+	}{
+		{Labels{"dc:${env.LOBBY_TEST_MISSING}"}, "label dc:${env.LOBBY_TEST_MISSING} from env is not published: undefined variable ${env.LOBBY_TEST_MISSING}: environment variable is not set"},
+		{Labels{"ip:${ip4.lobby0}"}, "label ip:${ip4.lobby0} from env is not published: undefined variable ${ip4.lobby0}:"},
+		{Labels{"x:${label.y}"}, "undefined variable ${label.y}: there is no label with this key"},
+		{Labels{"x:${label.y}", "y:1", "y:2"}, "undefined variable ${label.y}: there are 2 labels with this key"},
+		{Labels{"x:${label.x}"}, "label x:${label.x} references itself"},
+		{Labels{"x:${hostname"}, "unterminated variable in x:${hostname"},
+		{Labels{"x:${unknown}"}, "undefined variable ${unknown}: unknown variable"},
+		{Labels{"${env.LOBBY_TEST_SYS}"}, "can't be used, prefix sys: is reserved for system facts"},
+	} {
+		os.Setenv("LOBBY_TEST_SYS", "sys:os:linux")
+		localHost.InitialLabels = testCase.labels
+		discovery, err := localHost.GetIdentification()
+		assert.Nil(t, err)
+		assert.NotContains(t, discovery.Labels, testCase.labels[0])
+		select {
+		case message := <-localHost.LogChannel:
+			assert.Contains(t, message, testCase.err)
+		default:
+			t.Errorf("error of %v not logged", testCase.labels)
+		}
+
+		labels, err := localHost.LabelSources()
+		assert.Nil(t, err)
+		for _, label := range labels {
+			if label.Label == testCase.labels[0] {
+				assert.NotEmpty(t, label.Error)
+				assert.False(t, label.IsPublished())
+			}
+		}
+	}
+	os.Unsetenv("LOBBY_TEST_SYS")
+
+	// Only the broken label is left out, errors in files contain file and line
+	localHost.InitialLabels = nil
+	err = os.WriteFile(testLabelPath+"/test", []byte("service:smtp\nbackup:${env.LOBBY_TEST_MISSING}"), 0644)
+	assert.Nil(t, err)
+	discovery, err := localHost.GetIdentification()
+	assert.Nil(t, err)
+	assert.Equal(t, Labels{"service:smtp"}, discovery.Labels)
+	assert.Contains(t, <-localHost.LogChannel, "label backup:${env.LOBBY_TEST_MISSING} from file tmp/labels/test:2 is not published")
+
+	labels, err := localHost.LabelSources()
+	assert.Nil(t, err)
+	assert.Equal(t, []SourcedLabel{
+		{
+			Label:   "backup:${env.LOBBY_TEST_MISSING}",
+			Sources: []LabelSource{{Type: LabelSourceFile, File: "tmp/labels/test", Line: 2}},
+			Error:   "undefined variable ${env.LOBBY_TEST_MISSING}: environment variable is not set",
+		},
+		{Label: "service:smtp", Sources: []LabelSource{{Type: LabelSourceFile, File: "tmp/labels/test", Line: 1}}},
+	}, labels)
+
+	// The same error is logged only once
+	_, err = localHost.GetIdentification()
+	assert.Nil(t, err)
+	assert.Equal(t, 0, len(localHost.LogChannel))
+}
@@ -0,0 +1,232 @@
+package server
+
+import (
+	"fmt"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// ignoredLabelsFileSuffixes are suffixes of editor, backup and package manager files in LabelsPath that are never loaded
+var ignoredLabelsFileSuffixes = []string{"~", ".swp", ".swo", ".bak", ".tmp", ".orig", ".rej", ".dpkg-old", ".dpkg-new", ".dpkg-dist", ".rpmnew", ".rpmsave"}
+
+// yamlErrorLine finds line number in errors of the yaml package
+var yamlErrorLine = regexp.MustCompile(`^line (\d+): (.*)$`)
+
+// fileLabel is a single label found in a labels file
+type fileLabel struct {
+	label Label
+	line  int
+}
+
+// IsLabelsFile returns true if the file in LabelsPath should be loaded. Dotfiles, backup files, editor swap files
+// and Emacs autosave files are always skipped. If patterns are not empty the filename has to match at least one
+// of them, e.g. "*.labels".
+func IsLabelsFile(name string, patterns []string) bool {
+	if strings.HasPrefix(name, ".") || (strings.HasPrefix(name, "#") && strings.HasSuffix(name, "#")) {
+		return false
+	}
+	for _, suffix := range ignoredLabelsFileSuffixes {
+		if strings.HasSuffix(name, suffix) {
+			return false
+		}
+	}
+
+	if len(patterns) == 0 {
+		return true
+	}
+	for _, pattern := range patterns {
+		if matched, _ := filepath.Match(pattern, name); matched {
+			return true
+		}
+	}
+	return false
+}
+
+// parseLabelsFile returns labels from content of a labels file. Files with .yaml, .yml or .json extension
+// are structured, everything else has one label per line and lines starting with # are comments.
+func parseLabelsFile(filename string, content []byte) ([]fileLabel, error) {
+	var labels []fileLabel
+	var err error
+
+	switch strings.ToLower(filepath.Ext(filename)) {
+	case ".yaml", ".yml", ".json":
+		labels, err = parseStructuredLabels(content)
+	default:
+		labels = parsePlainLabels(content, true)
+	}
+	if err != nil {
+		return labels, fmt.Errorf("%s:%v", filename, err)
+	}
+
+	for _, label := range labels {
+		err = label.label.Validate()
+		if err != nil {
+			return labels, fmt.Errorf("%s:%d: %v", filename, label.line, err)
+		}
+		if err := label.label.ReservedPrefixError(); err != nil {
+			return labels, fmt.Errorf("%s:%d: label %s can't be used, %v", filename, label.line, label.label, err)
+		}
+	}
+
+	return labels, nil
+}
+
+// parsePlainLabels returns every non-empty line as a label, optionally without comments
+func parsePlainLabels(content []byte, comments bool) []fileLabel {
+	labels := []fileLabel{}
+
+	for lineNumber, line := range strings.Split(string(content), "\n") {
+		line = strings.TrimSpace(line)
+		if len(line) == 0 || (comments && strings.HasPrefix(line, "#")) {
+			continue
+		}
+		labels = append(labels, fileLabel{label: Label(line), line: lineNumber + 1})
+	}
+
+	return labels
+}
+
+// parseStructuredLabels returns labels from YAML or JSON document that maps keys to values:
+//
+//	service: [smtp, imap]      -> service:smtp, service:imap
+//	location: prague           -> location:prague
+//	maintenance:               -> maintenance
+//	prometheus:
+//	  nodeexporter:
+//	    port: 9100             -> prometheus:nodeexporter:port:9100
+//
+// Errors start with the line number.
+func parseStructuredLabels(content []byte) ([]fileLabel, error) {
+	labels := []fileLabel{}
+
+	document := yaml.Node{}
+	err := yaml.Unmarshal(content, &document)
+	if err != nil {
+		// yaml errors look like "yaml: line 3: message"
+		message := strings.TrimPrefix(err.Error(), "yaml: ")
+		if match := yamlErrorLine.FindStringSubmatch(message); match != nil {
+			return labels, fmt.Errorf("%s: %s", match[1], match[2])
+		}
+		return labels, fmt.Errorf(" %s", message)
+	}
+
+	// Empty file
+	if len(document.Content) == 0 {
+		return labels, nil
+	}
+
+	root := document.Content[0]
+	if root.Kind != yaml.MappingNode {
+		return labels, fmt.Errorf("%d: labels have to be a mapping of keys to values", root.Line)
+	}
+
+	return appendStructuredLabels(labels, "", root)
+}
+
+// appendStructuredLabels adds labels from the mapping node with given prefix
+func appendStructuredLabels(labels []fileLabel, prefix string, mapping *yaml.Node) ([]fileLabel, error) {
+	var err error
+
+	for i := 0; i+1 < len(mapping.Content); i += 2 {
+		keyNode, valueNode := mapping.Content[i], mapping.Content[i+1]
+		if keyNode.Kind != yaml.ScalarNode || len(keyNode.Value) == 0 {
+			return labels, fmt.Errorf("%d: key has to be a non-empty string", keyNode.Line)
+		}
+		key := prefix + keyNode.Value
+
+		switch valueNode.Kind {
+		case yaml.ScalarNode:
+			labels = append(labels, structuredLabel(key, valueNode))
+		case yaml.SequenceNode:
+			for _, item := range valueNode.Content {
+				if item.Kind != yaml.ScalarNode {
+					return labels, fmt.Errorf("%d: values of %s have to be scalars", item.Line, key)
+				}
+				labels = append(labels, structuredLabel(key, item))
+			}
+		case yaml.MappingNode:
+			labels, err = appendStructuredLabels(labels, key+":", valueNode)
+			if err != nil {
+				return labels, err
+			}
+		default:
+			return labels, fmt.Errorf("%d: unsupported value of %s", valueNode.Line, key)
+		}
+	}
+
+	return labels, nil
+}
+
+// structuredLabel returns KEY:VALUE label or just KEY if the value is null
+func structuredLabel(key string, value *yaml.Node) fileLabel {
+	if value.Tag == "!!null" {
+		return fileLabel{label: Label(key), line: value.Line}
+	}
+	return fileLabel{label: Label(key + ":" + value.Value), line: value.Line}
+}
+
+// ParseLabelsList parses comma separated list of labels as it's used in LABELS environment variable.
+// A label can be enclosed in double quotes to contain commas, \" and \\ are escapes inside the quotes.
+// Outside of quotes a comma can be escaped by a backslash. Spaces around labels and empty items are ignored.
+//
+//	service:ns,"public_ip4:1,2,3,4",note:a\,b
+func ParseLabelsList(value string) (Labels, error) {
+	labels := Labels{}
+
+	current := &strings.Builder{}
+	quoted := false
+	wasQuoted := false
+	flush := func() {
+		label := current.String()
+		if !wasQuoted {
+			label = strings.TrimSpace(label)
+		}
+		if len(label) > 0 {
+			labels = append(labels, Label(label))
+		}
+		current.Reset()
+		wasQuoted = false
+	}
+
+	for i := 0; i < len(value); i++ {
+		c := value[i]
+		switch {
+		case c == '\\' && i+1 < len(value) && (value[i+1] == '\\' || value[i+1] == '"' || (!quoted && value[i+1] == ',')):
+			current.WriteByte(value[i+1])
+			i++
+		case c == '"' && quoted:
+			quoted = false
+		case c == '"' && strings.TrimSpace(current.String()) == "" && !wasQuoted:
+			current.Reset()
+			quoted = true
+			wasQuoted = true
+		case c == ',' && !quoted:
+			flush()
+		case wasQuoted && !quoted && c != ' ':
+			return labels, fmt.Errorf("unexpected character %q after quoted label at position %d", c, i+1)
+		case wasQuoted && !quoted:
+			// spaces after the closing quote
+		default:
+			current.WriteByte(c)
+		}
+	}
+	if quoted {
+		return labels, fmt.Errorf("unterminated quoted label")
+	}
+	flush()
+
+	return labels, nil
+}
+
+// Decode parses labels from LABELS environment variable, see ParseLabelsList. It's used by envconfig.
+func (l *Labels) Decode(value string) error {
+	labels, err := ParseLabelsList(value)
+	if err != nil {
+		return err
+	}
+	*l = labels
+	return nil
+}
@@ -0,0 +1,150 @@
+package server
+
+import (
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestIsLabelsFile(t *testing.T) {
+	assert.True(t, IsLabelsFile("mail", nil))
+	assert.True(t, IsLabelsFile("mail.yaml", nil))
+	assert.False(t, IsLabelsFile(".mail", nil))
+	assert.False(t, IsLabelsFile("mail~", nil))
+	assert.False(t, IsLabelsFile(".mail.swp", nil))
+	assert.False(t, IsLabelsFile("mail.bak", nil))
+	assert.False(t, IsLabelsFile("#mail#", nil))
+	assert.False(t, IsLabelsFile("mail.dpkg-old", nil))
+
+	patterns := []string{"*.labels", "*.yaml"}
+	assert.True(t, IsLabelsFile("mail.labels", patterns))
+	assert.True(t, IsLabelsFile("mail.yaml", patterns))
+	assert.False(t, IsLabelsFile("mail", patterns))
+	assert.False(t, IsLabelsFile("mail.labels~", patterns))
+}
+
+func TestParseLabelsFile(t *testing.T) {
+	labels, err := parseLabelsFile("mail.labels", []byte("# mail server\nservice:smtp\n\n  # indented comment\nservice:imap  \n"))
+	assert.Nil(t, err)
+	assert.Equal(t, []fileLabel{{"service:smtp", 2}, {"service:imap", 5}}, labels)
+
+	labels, err = parseLabelsFile("mail.yaml", []byte(`# mail server
+service: [smtp, imap]
+location: prague
+maintenance:
+port: 25
+prometheus:
+  nodeexporter:
+    port: 9100
+ips:
+  - 1.2.3.4
+  - "2a03::1"
+`))
+	assert.Nil(t, err)
+	assert.Equal(t, []fileLabel{
+		{"service:smtp", 2},
+		{"service:imap", 2},
+		{"location:prague", 3},
+		{"maintenance", 4},
+		{"port:25", 5},
+		{"prometheus:nodeexporter:port:9100", 8},
+		{"ips:1.2.3.4", 10},
+		{"ips:2a03::1", 11},
+	}, labels)
+
+	labels, err = parseLabelsFile("mail.json", []byte("{\n  \"service\": [\"smtp\", \"imap\"],\n  \"location\": \"prague\"\n}"))
+	assert.Nil(t, err)
+	assert.Equal(t, []fileLabel{{"service:smtp", 2}, {"service:imap", 2}, {"location:prague", 3}}, labels)
+
+	labels, err = parseLabelsFile("empty.yaml", []byte("# nothing here\n"))
+	assert.Nil(t, err)
+	assert.Equal(t, 0, len(labels))
+
+	for _, testCase := range []struct {
+		filename string
+		content  string
+		err      string
+	}{
+		{"mail.labels", "service:smtp\nbad\x01label", "mail.labels:2: label \"bad\\x01label\" contains control character"},
+		{"mail.yaml", "- service:smtp", "mail.yaml:1: labels have to be a mapping of keys to values"},
+		{"mail.yaml", "service: smtp\nlocation:\n\tprague", "mail.yaml:3: found character that cannot start any token"},
+		{"mail.yaml", "service:\n  - [smtp]", "mail.yaml:2: values of service have to be scalars"},
+		{"mail.json", "{\"service\": \"smtp\",\n\"\": \"x\"}", "mail.json:2: key has to be a non-empty string"},
+		{"os.labels", "service:smtp\nsys:os:linux", "os.labels:2: label sys:os:linux can't be used, prefix sys: is reserved for system facts"},
+		{"os.yaml", "service: smtp\nsys:\n  os: linux", "os.yaml:3: label sys:os:linux can't be used, prefix sys: is reserved for system facts"},
+		{"cloud.yaml", "cloud:\n  region: eu-west-1", "cloud.yaml:2: label cloud:region:eu-west-1 can't be used, prefix cloud: is reserved for cloud metadata"},
+	} {
+		_, err = parseLabelsFile(testCase.filename, []byte(testCase.content))
+		if assert.NotNil(t, err, testCase.content) {
+			assert.Equal(t, testCase.err, err.Error())
+		}
+	}
+}
+
+func TestParseLabelsList(t *testing.T) {
+	labels, err := ParseLabelsList(`service:ns, ns:primary,"public_ip4:1,2,3,4" ,note:a\,b,"quote:\"x\"",,path:c:\\d`)
+	assert.Nil(t, err)
+	assert.Equal(t, Labels{"service:ns", "ns:primary", "public_ip4:1,2,3,4", "note:a,b", `quote:"x"`, `path:c:\d`}, labels)
+
+	labels, err = ParseLabelsList("")
+	assert.Nil(t, err)
+	assert.Equal(t, Labels{}, labels)
+
+	_, err = ParseLabelsList(`a,"b`)
+	assert.Equal(t, "unterminated quoted label", err.Error())
+	_, err = ParseLabelsList(`"a"b,c`)
+	assert.NotNil(t, err)
+
+	var decoded Labels
+	err = decoded.Decode(`a,"b,c"`)
+	assert.Nil(t, err)
+	assert.Equal(t, Labels{"a", "b,c"}, decoded)
+}
+
+func TestLabelsFilesLoading(t *testing.T) {
+	localHost := LocalHost{
+		LabelsPath:            testLabelPath,
+		RuntimeLabelsFilename: "_runtime",
+		StatePath:             testStatePath,
+		HostnameOverride:      "test.example.com",
+	}
+
+	err := os.MkdirAll(testLabelPath, os.ModePerm)
+	assert.Nil(t, err)
+	defer os.RemoveAll(tmpPath)
+
+	err = os.WriteFile(testLabelPath+"/mail.labels", []byte("# comment\nservice:smtp"), 0644)
+	assert.Nil(t, err)
+	err = os.WriteFile(testLabelPath+"/mail.labels~", []byte("service:old"), 0644)
+	assert.Nil(t, err)
+	err = os.WriteFile(testLabelPath+"/.mail.labels.swp", []byte("garbage"), 0644)
+	assert.Nil(t, err)
+	err = os.WriteFile(testLabelPath+"/location.yaml", []byte("location: prague"), 0644)
+	assert.Nil(t, err)
+	err = os.WriteFile(testLabelPath+"/README", []byte("Labels of this server"), 0644)
+	assert.Nil(t, err)
+	err = localHost.AddLabels(Labels{"runtime:1"})
+	assert.Nil(t, err)
+
+	discovery, err := localHost.GetIdentification()
+	assert.Nil(t, err)
+	assert.Equal(t, Labels{"Labels of this server", "location:prague", "runtime:1", "service:smtp"}, discovery.Labels)
+
+	// Runtime labels are not affected by the patterns
+	localHost.LabelsFilesPatterns = []string{"*.labels", "*.yaml"}
+	discovery, err = localHost.GetIdentification()
+	assert.Nil(t, err)
+	assert.Equal(t, Labels{"location:prague", "runtime:1", "service:smtp"}, discovery.Labels)
+
+	err = os.WriteFile(testLabelPath+"/broken.yaml", []byte("service: smtp\nlocation:\n\tprague"), 0644)
+	assert.Nil(t, err)
+	err = localHost.CheckLabelsFiles()
+	assert.NotNil(t, err)
+	assert.Contains(t, err.Error(), "tmp/labels/broken.yaml:3:")
+
+	// Broken file is skipped, labels from the other files are still published
+	discovery, err = localHost.GetIdentification()
+	assert.Nil(t, err)
+	assert.Equal(t, Labels{"location:prague", "runtime:1", "service:smtp"}, discovery.Labels)
+}
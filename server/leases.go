@@ -0,0 +1,245 @@
+package server
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"sort"
+	"time"
+)
+
+// Lease is a group of ephemeral runtime labels. The labels are advertised only until the lease expires
+// or is revoked, the client has to keep the lease alive within its TTL. Leases live only in memory
+// so they don't survive restart of the daemon.
+type Lease struct {
+	ID      string `json:"id"`
+	TTL     uint   `json:"ttl"`     // secs after the last keep alive when the lease expires
+	Labels  Labels `json:"labels"`  // labels attached to the lease
+	Expires int64  `json:"expires"` // unix timestamp when the lease expires
+}
+
+// LeaseNotFoundError is returned when the lease doesn't exist, it has expired or it was revoked
+type LeaseNotFoundError struct {
+	ID string
+}
+
+func (e *LeaseNotFoundError) Error() string {
+	return fmt.Sprintf("lease %s not found", e.ID)
+}
+
+// lease is the internal state of a lease
+type lease struct {
+	id      string
+	ttl     time.Duration
+	labels  Labels
+	expires time.Time
+}
+
+func (l *lease) export() Lease {
+	return Lease{
+		ID:      l.id,
+		TTL:     uint(l.ttl / time.Second),
+		Labels:  append(Labels{}, l.labels...),
+		Expires: l.expires.Unix(),
+	}
+}
+
+func (l *lease) expired() bool {
+	return !time.Now().Before(l.expires)
+}
+
+// newLeaseID returns random ID of a new lease
+func newLeaseID() (string, error) {
+	id := make([]byte, 16)
+	_, err := rand.Read(id)
+	if err != nil {
+		return "", fmt.Errorf("generating lease ID error: %v", err)
+	}
+	return hex.EncodeToString(id), nil
+}
+
+// validateLeaseLabels checks labels that are going to be attached to a lease
+func validateLeaseLabels(labels Labels) error {
+	for _, label := range labels {
+		err := label.Validate()
+		if err != nil {
+			return err
+		}
+		if err := label.ReservedPrefixError(); err != nil {
+			return fmt.Errorf("label %s can't be added, %v", label, err)
+		}
+	}
+	return nil
+}
+
+// GrantLease creates a new lease with given TTL and labels. TTL is rounded to seconds and it has to be at least one second.
+func (l *LocalHost) GrantLease(ttl time.Duration, labels Labels) (Lease, error) {
+	ttl = ttl.Round(time.Second)
+	if ttl < time.Second {
+		return Lease{}, fmt.Errorf("lease TTL has to be at least one second")
+	}
+
+	err := validateLeaseLabels(labels)
+	if err != nil {
+		return Lease{}, err
+	}
+
+	id, err := newLeaseID()
+	if err != nil {
+		return Lease{}, err
+	}
+
+	newLease := &lease{
+		id:      id,
+		ttl:     ttl,
+		expires: time.Now().Add(ttl),
+	}
+	newLease.labels = appendMissingLabels(newLease.labels, labels)
+
+	l.leasesLock.Lock()
+	defer l.leasesLock.Unlock()
+
+	if l.leases == nil {
+		l.leases = make(map[string]*lease)
+	}
+	l.leases[id] = newLease
+
+	return newLease.export(), nil
+}
+
+// activeLease returns the lease if it exists and it's not expired, it has to be called with the lock held
+func (l *LocalHost) activeLease(id string) (*lease, error) {
+	found, ok := l.leases[id]
+	if !ok || found.expired() {
+		return nil, &LeaseNotFoundError{ID: id}
+	}
+	return found, nil
+}
+
+// KeepAliveLease extends the lease by its TTL
+func (l *LocalHost) KeepAliveLease(id string) (Lease, error) {
+	l.leasesLock.Lock()
+	defer l.leasesLock.Unlock()
+
+	found, err := l.activeLease(id)
+	if err != nil {
+		return Lease{}, err
+	}
+	found.expires = time.Now().Add(found.ttl)
+
+	return found.export(), nil
+}
+
+// AttachLabels adds labels to an existing lease, the lease is kept alive too
+func (l *LocalHost) AttachLabels(id string, labels Labels) (Lease, error) {
+	err := validateLeaseLabels(labels)
+	if err != nil {
+		return Lease{}, err
+	}
+
+	l.leasesLock.Lock()
+	defer l.leasesLock.Unlock()
+
+	found, err := l.activeLease(id)
+	if err != nil {
+		return Lease{}, err
+	}
+	found.labels = appendMissingLabels(found.labels, labels)
+	found.expires = time.Now().Add(found.ttl)
+
+	return found.export(), nil
+}
+
+// RevokeLease removes the lease with all its labels
+func (l *LocalHost) RevokeLease(id string) (Lease, error) {
+	l.leasesLock.Lock()
+	defer l.leasesLock.Unlock()
+
+	found, err := l.activeLease(id)
+	if err != nil {
+		return Lease{}, err
+	}
+	delete(l.leases, id)
+
+	return found.export(), nil
+}
+
+// Leases returns all active leases sorted by their IDs
+func (l *LocalHost) Leases() []Lease {
+	l.leasesLock.Lock()
+	defer l.leasesLock.Unlock()
+
+	leases := []Lease{}
+	for _, found := range l.leases {
+		if !found.expired() {
+			leases = append(leases, found.export())
+		}
+	}
+	sort.Slice(leases, func(i, j int) bool {
+		return leases[i].ID < leases[j].ID
+	})
+
+	return leases
+}
+
+// ExpireLeases removes expired leases and returns them. Labels of expired leases are not advertised
+// even before this is called, but the caller should send the discovery packet if something has expired.
+func (l *LocalHost) ExpireLeases() []Lease {
+	l.leasesLock.Lock()
+	defer l.leasesLock.Unlock()
+
+	expired := []Lease{}
+	for id, found := range l.leases {
+		if found.expired() {
+			expired = append(expired, found.export())
+			delete(l.leases, id)
+		}
+	}
+	sort.Slice(expired, func(i, j int) bool {
+		return expired[i].ID < expired[j].ID
+	})
+
+	return expired
+}
+
+// addLeaseLabels adds labels of active leases into the index
+func (l *LocalHost) addLeaseLabels(index *labelSourcesIndex) {
+	l.leasesLock.Lock()
+	defer l.leasesLock.Unlock()
+
+	ids := []string{}
+	for id := range l.leases {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+
+	for _, id := range ids {
+		found := l.leases[id]
+		if found.expired() {
+			continue
+		}
+		for _, label := range found.labels {
+			index.add(label, LabelSource{Type: LabelSourceLease, Lease: id})
+		}
+	}
+}
+
+// deleteLeaseLabels removes labels from all leases, the leases themselves are kept
+func (l *LocalHost) deleteLeaseLabels(labels Labels) {
+	l.leasesLock.Lock()
+	defer l.leasesLock.Unlock()
+
+	for _, found := range l.leases {
+		found.labels = append(Labels{}, labelsDifference(found.labels, labels)...)
+	}
+}
+
+// appendMissingLabels appends labels that are not in the list yet
+func appendMissingLabels(list Labels, labels Labels) Labels {
+	for _, label := range labels {
+		if labelsDifference(Labels{label}, list) != nil {
+			list = append(list, label)
+		}
+	}
+	return list
+}
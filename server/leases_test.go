@@ -0,0 +1,86 @@
+package server
+
+import (
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLeases(t *testing.T) {
+	localHost := LocalHost{
+		LabelsPath:            testLabelPath,
+		RuntimeLabelsFilename: "_runtime",
+		StatePath:             testStatePath,
+		HostnameOverride:      "test.example.com",
+		InitialLabels:         Labels{"service:test"},
+	}
+
+	err := os.MkdirAll(testLabelPath, os.ModePerm)
+	assert.Nil(t, err)
+	defer os.RemoveAll(tmpPath)
+
+	_, err = localHost.GrantLease(100*time.Millisecond, Labels{"service:worker"})
+	assert.NotNil(t, err)
+	_, err = localHost.GrantLease(time.Second, Labels{"sys:os:linux"})
+	assert.NotNil(t, err)
+
+	lease, err := localHost.GrantLease(time.Second, Labels{"service:worker", "service:worker"})
+	assert.Nil(t, err)
+	assert.Equal(t, 32, len(lease.ID))
+	assert.Equal(t, uint(1), lease.TTL)
+	assert.Equal(t, Labels{"service:worker"}, lease.Labels)
+
+	lease, err = localHost.AttachLabels(lease.ID, Labels{"queue:mail"})
+	assert.Nil(t, err)
+	assert.Equal(t, Labels{"service:worker", "queue:mail"}, lease.Labels)
+
+	discovery, err := localHost.GetIdentification()
+	assert.Nil(t, err)
+	assert.Equal(t, Labels{"queue:mail", "service:test", "service:worker"}, discovery.Labels)
+
+	labels, err := localHost.LabelSources()
+	assert.Nil(t, err)
+	assert.Equal(t, []LabelSource{{Type: LabelSourceLease, Lease: lease.ID}}, labels[0].Sources)
+	assert.True(t, labels[0].IsRuntime())
+
+	// Leased labels can be deleted like other runtime labels
+	err = localHost.DeleteLabels(Labels{"queue:mail"})
+	assert.Nil(t, err)
+	assert.Equal(t, Labels{"service:worker"}, localHost.Leases()[0].Labels)
+
+	// Keep alive extends the lease
+	time.Sleep(600 * time.Millisecond)
+	_, err = localHost.KeepAliveLease(lease.ID)
+	assert.Nil(t, err)
+	time.Sleep(600 * time.Millisecond)
+	assert.Equal(t, 0, len(localHost.ExpireLeases()))
+	assert.Equal(t, 1, len(localHost.Leases()))
+
+	// Labels of an expired lease are withdrawn before it's removed
+	time.Sleep(500 * time.Millisecond)
+	discovery, err = localHost.GetIdentification()
+	assert.Nil(t, err)
+	assert.Equal(t, Labels{"service:test"}, discovery.Labels)
+	assert.Equal(t, 0, len(localHost.Leases()))
+
+	_, err = localHost.KeepAliveLease(lease.ID)
+	assert.IsType(t, &LeaseNotFoundError{}, err)
+
+	expired := localHost.ExpireLeases()
+	assert.Equal(t, 1, len(expired))
+	assert.Equal(t, lease.ID, expired[0].ID)
+	assert.Equal(t, 0, len(localHost.ExpireLeases()))
+
+	// Revoked lease is removed right away
+	lease, err = localHost.GrantLease(time.Minute, Labels{"service:worker"})
+	assert.Nil(t, err)
+	revoked, err := localHost.RevokeLease(lease.ID)
+	assert.Nil(t, err)
+	assert.Equal(t, Labels{"service:worker"}, revoked.Labels)
+	_, err = localHost.RevokeLease(lease.ID)
+	assert.Equal(t, "lease "+lease.ID+" not found", err.Error())
+	_, err = localHost.AttachLabels(lease.ID, Labels{"queue:mail"})
+	assert.IsType(t, &LeaseNotFoundError{}, err)
+}
@@ -0,0 +1,369 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	DefaultProviderInterval = 60 * time.Second // how often provider commands run if not configured
+	DefaultProviderTimeout  = 10 * time.Second // how long provider commands can run if not configured
+
+	providerHeader = "lobby-provider:" // magic comment with provider options in providers.d scripts
+)
+
+// ProviderStatus describes result of the last runs of a label provider
+type ProviderStatus struct {
+	Name        string `json:"name"`
+	LastRun     int64  `json:"last_run,omitempty"`     // unix timestamp of the last run
+	LastSuccess int64  `json:"last_success,omitempty"` // unix timestamp of the last successful run
+	LastError   string `json:"last_error,omitempty"`   // error of the last run, empty if it was successful
+	Stale       bool   `json:"stale"`                  // true if the labels are withdrawn because there was no successful run for StaleAfter
+	Labels      Labels `json:"labels"`                 // labels currently provided
+}
+
+// ExecProvider is a label provider that runs a command regularly. Every non-empty line of its standard output
+// is a label, lines starting with # are ignored. Command that exits with non-zero status, times out or prints
+// an invalid label fails and the labels from the last successful run are kept until they become stale.
+// Stale labels are withdrawn.
+type ExecProvider struct {
+	ProviderName string        // name of the provider used as the source of its labels
+	Command      []string      // command and its arguments
+	Interval     time.Duration // how often the command runs, DefaultProviderInterval is used if it's zero
+	Timeout      time.Duration // the command is killed after this time, DefaultProviderTimeout is used if it's zero
+	StaleAfter   time.Duration // labels are withdrawn if there is no successful run for this time, default is three intervals
+	OnChange     func()        // called when the provided labels change, can be nil
+
+	lock        sync.RWMutex
+	labels      Labels
+	lastRun     time.Time
+	lastSuccess time.Time
+	lastError   error
+	stale       bool // staleness at the end of the last run, to detect the change
+}
+
+// ParseCommand splits command configured as a single string into the program and its arguments. The command
+// doesn't run through a shell, so there are no variables, globs or pipes, just quoting similar to ParseLabelsList.
+// Arguments are separated by spaces or tabs. An argument can be enclosed in double quotes where \" and \\ are
+// escapes, or in single quotes where nothing is escaped. Outside of quotes a backslash escapes the next character.
+//
+//	/usr/local/bin/check-disk --path "/srv/my data" 'a b' c\ d
+func ParseCommand(value string) ([]string, error) {
+	command := []string{}
+
+	current := &strings.Builder{}
+	inArgument := false
+	var quote byte
+	for i := 0; i < len(value); i++ {
+		c := value[i]
+		switch {
+		case quote == '\'' && c == '\'':
+			quote = 0
+		case quote == '\'':
+			current.WriteByte(c)
+		case c == '\\' && i+1 < len(value) && (quote == 0 || value[i+1] == '"' || value[i+1] == '\\'):
+			current.WriteByte(value[i+1])
+			inArgument = true
+			i++
+		case quote == '"' && c == '"':
+			quote = 0
+		case quote == '"':
+			current.WriteByte(c)
+		case c == '"' || c == '\'':
+			quote = c
+			inArgument = true
+		case c == ' ' || c == '\t':
+			if inArgument {
+				command = append(command, current.String())
+				current.Reset()
+				inArgument = false
+			}
+		default:
+			current.WriteByte(c)
+			inArgument = true
+		}
+	}
+	if quote != 0 {
+		return command, fmt.Errorf("unterminated quoted argument")
+	}
+	if inArgument {
+		command = append(command, current.String())
+	}
+
+	return command, nil
+}
+
+// Name returns name of the provider
+func (p *ExecProvider) Name() string {
+	return p.ProviderName
+}
+
+func (p *ExecProvider) interval() time.Duration {
+	if p.Interval <= 0 {
+		return DefaultProviderInterval
+	}
+	return p.Interval
+}
+
+func (p *ExecProvider) timeout() time.Duration {
+	if p.Timeout <= 0 {
+		return DefaultProviderTimeout
+	}
+	return p.Timeout
+}
+
+func (p *ExecProvider) staleAfter() time.Duration {
+	if p.StaleAfter <= 0 {
+		return 3 * p.interval()
+	}
+	return p.StaleAfter
+}
+
+// isStale returns true if the labels from the last successful run are too old, it has to be called with the lock held
+func (p *ExecProvider) isStale() bool {
+	return time.Since(p.lastSuccess) > p.staleAfter()
+}
+
+// Labels returns labels from the last successful run or no labels if they are stale. It never returns an error,
+// failures are reported by Status.
+func (p *ExecProvider) Labels() (Labels, error) {
+	p.lock.RLock()
+	defer p.lock.RUnlock()
+
+	if p.isStale() {
+		return Labels{}, nil
+	}
+	return append(Labels{}, p.labels...), nil
+}
+
+// Status returns result of the last runs
+func (p *ExecProvider) Status() ProviderStatus {
+	p.lock.RLock()
+	defer p.lock.RUnlock()
+
+	status := ProviderStatus{
+		Name:   p.ProviderName,
+		Stale:  p.isStale(),
+		Labels: Labels{},
+	}
+	if !p.lastRun.IsZero() {
+		status.LastRun = p.lastRun.Unix()
+	}
+	if !p.lastSuccess.IsZero() {
+		status.LastSuccess = p.lastSuccess.Unix()
+	}
+	if p.lastError != nil {
+		status.LastError = p.lastError.Error()
+	}
+	if !status.Stale {
+		status.Labels = append(status.Labels, p.labels...)
+	}
+
+	return status
+}
+
+// execute runs the command and returns labels from its output
+func (p *ExecProvider) execute() (Labels, error) {
+	if len(p.Command) == 0 {
+		return nil, fmt.Errorf("no command")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), p.timeout())
+	defer cancel()
+
+	stdout := &bytes.Buffer{}
+	stderr := &bytes.Buffer{}
+	cmd := exec.CommandContext(ctx, p.Command[0], p.Command[1:]...)
+	cmd.Stdout = stdout
+	cmd.Stderr = stderr
+
+	err := cmd.Run()
+	if ctx.Err() == context.DeadlineExceeded {
+		return nil, fmt.Errorf("timeout after %s", p.timeout())
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%v: %s", err, strings.TrimSpace(stderr.String()))
+	}
+
+	labels := Labels{}
+	for lineNumber, line := range strings.Split(stdout.String(), "\n") {
+		line = strings.TrimSpace(line)
+		if len(line) == 0 || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		label := Label(line)
+		err = label.Validate()
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %v", lineNumber+1, err)
+		}
+		if err := label.ReservedPrefixError(); err != nil {
+			return nil, fmt.Errorf("line %d: %v", lineNumber+1, err)
+		}
+		labels = append(labels, label)
+	}
+
+	return labels, nil
+}
+
+// Run runs the command once and updates the provided labels. OnChange is called if the labels have changed.
+func (p *ExecProvider) Run() error {
+	labels, err := p.execute()
+
+	p.lock.Lock()
+	previous := p.labels
+	wasStale := p.stale || p.lastRun.IsZero()
+	p.lastRun = time.Now()
+	p.lastError = err
+	if err == nil {
+		p.labels = labels
+		p.lastSuccess = p.lastRun
+	}
+	changed := wasStale != p.isStale() || labelsDifference(previous, p.labels) != nil || labelsDifference(p.labels, previous) != nil
+	p.stale = p.isStale()
+	p.lock.Unlock()
+
+	if changed && p.OnChange != nil {
+		p.OnChange()
+	}
+
+	if err != nil {
+		return fmt.Errorf("label provider %s error: %v", p.ProviderName, err)
+	}
+	return nil
+}
+
+// Start runs the command regularly in background until the returned function is called. Errors are sent
+// into errors channel if it's not nil.
+func (p *ExecProvider) Start(errors chan<- error) func() {
+	done := make(chan struct{})
+
+	go func() {
+		ticker := time.NewTicker(p.interval())
+		defer ticker.Stop()
+
+		for {
+			err := p.Run()
+			if err != nil && errors != nil {
+				errors <- err
+			}
+
+			select {
+			case <-ticker.C:
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			close(done)
+		})
+	}
+}
+
+// LoadExecProviders creates providers from executable files in the directory, name of the file is name of
+// the provider. Files starting with a dot and files that are not executable are skipped. Options of the provider
+// can be set by a comment in the first ten lines of the file:
+//
+//	# lobby-provider: interval=30s timeout=5s stale=2m
+//
+// Missing directory is not an error.
+func LoadExecProviders(directory string) ([]*ExecProvider, error) {
+	providers := []*ExecProvider{}
+
+	files, err := ioutil.ReadDir(directory)
+	if os.IsNotExist(err) {
+		return providers, nil
+	}
+	if err != nil {
+		return providers, fmt.Errorf("reading providers directory error: %v", err)
+	}
+
+	for _, file := range files {
+		if file.IsDir() || strings.HasPrefix(file.Name(), ".") || file.Mode().Perm()&0111 == 0 {
+			continue
+		}
+
+		provider := &ExecProvider{
+			ProviderName: file.Name(),
+			Command:      []string{path.Join(directory, file.Name())},
+		}
+
+		err = provider.readHeader()
+		if err != nil {
+			return providers, err
+		}
+
+		providers = append(providers, provider)
+	}
+
+	return providers, nil
+}
+
+// readHeader sets options of the provider from the magic comment in its executable
+func (p *ExecProvider) readHeader() error {
+	file, err := os.Open(p.Command[0])
+	if err != nil {
+		return fmt.Errorf("reading provider %s error: %v", p.ProviderName, err)
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for lineNumber := 1; lineNumber <= 10 && scanner.Scan(); lineNumber++ {
+		line := strings.TrimSpace(scanner.Text())
+		idx := strings.Index(line, providerHeader)
+		if !strings.HasPrefix(line, "#") || idx < 0 {
+			continue
+		}
+
+		err = p.SetOptions(line[idx+len(providerHeader):])
+		if err != nil {
+			return fmt.Errorf("%s:%d: %v", p.Command[0], lineNumber, err)
+		}
+		return nil
+	}
+
+	// Binary files may contain very long lines, that's not an error
+	return nil
+}
+
+// SetOptions sets interval, timeout and stale time of the provider from space separated key=value pairs,
+// e.g. "interval=30s timeout=5s stale=2m".
+func (p *ExecProvider) SetOptions(options string) error {
+	for _, option := range strings.Fields(options) {
+		parts := strings.SplitN(option, "=", 2)
+		if len(parts) != 2 {
+			return fmt.Errorf("invalid provider option %q", option)
+		}
+
+		value, err := time.ParseDuration(parts[1])
+		if err != nil || value <= 0 {
+			return fmt.Errorf("invalid duration in provider option %q", option)
+		}
+
+		switch parts[0] {
+		case "interval":
+			p.Interval = value
+		case "timeout":
+			p.Timeout = value
+		case "stale":
+			p.StaleAfter = value
+		default:
+			return fmt.Errorf("unknown provider option %q", parts[0])
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,138 @@
+package server
+
+import (
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const testProvidersPath = tmpPath + "/providers.d"
+
+func TestExecProvider(t *testing.T) {
+	changes := 0
+	provider := ExecProvider{
+		ProviderName: "test",
+		Command:      []string{"sh", "-c", "echo '# comment'; echo service:test; echo; echo role:primary"},
+		StaleAfter:   200 * time.Millisecond,
+		OnChange: func() {
+			changes++
+		},
+	}
+
+	labels, err := provider.Labels()
+	assert.Nil(t, err)
+	assert.Equal(t, Labels{}, labels)
+
+	err = provider.Run()
+	assert.Nil(t, err)
+	labels, _ = provider.Labels()
+	assert.Equal(t, Labels{"service:test", "role:primary"}, labels)
+	assert.Equal(t, 1, changes)
+
+	// Same output is not a change
+	err = provider.Run()
+	assert.Nil(t, err)
+	assert.Equal(t, 1, changes)
+
+	// Failure keeps the last labels until they are stale
+	provider.Command = []string{"sh", "-c", "echo role:primary; exit 1"}
+	err = provider.Run()
+	assert.NotNil(t, err)
+	labels, _ = provider.Labels()
+	assert.Equal(t, Labels{"service:test", "role:primary"}, labels)
+	assert.Equal(t, 1, changes)
+
+	status := provider.Status()
+	assert.Equal(t, "test", status.Name)
+	assert.False(t, status.Stale)
+	assert.Contains(t, status.LastError, "exit status 1")
+
+	time.Sleep(300 * time.Millisecond)
+	labels, _ = provider.Labels()
+	assert.Equal(t, Labels{}, labels)
+
+	err = provider.Run()
+	assert.NotNil(t, err)
+	assert.Equal(t, 2, changes)
+	status = provider.Status()
+	assert.True(t, status.Stale)
+	assert.Equal(t, Labels{}, status.Labels)
+
+	// Invalid label fails the run
+	provider.Command = []string{"sh", "-c", "printf 'ok\\nbad\\001label\\n'"}
+	err = provider.Run()
+	assert.NotNil(t, err)
+	assert.Contains(t, err.Error(), "line 2")
+
+	// Timeout
+	provider.Command = []string{"sleep", "5"}
+	provider.Timeout = 100 * time.Millisecond
+	err = provider.Run()
+	assert.NotNil(t, err)
+	assert.Contains(t, err.Error(), "timeout")
+}
+
+func TestParseCommand(t *testing.T) {
+	for _, testCase := range []struct {
+		value   string
+		command []string
+	}{
+		{"", []string{}},
+		{"  cat\t/srv/app/REVISION  ", []string{"cat", "/srv/app/REVISION"}},
+		{`check-disk --path "/srv/my data" 'a b' c\ d`, []string{"check-disk", "--path", "/srv/my data", "a b", "c d"}},
+		{`sh -c 'echo "$HOME"; exit 1'`, []string{"sh", "-c", `echo "$HOME"; exit 1`}},
+		{`echo "say \"hi\" \\ \n" '\n' ""`, []string{"echo", `say "hi" \ \n`, `\n`, ""}},
+		{`echo x"y z"`, []string{"echo", "xy z"}},
+	} {
+		command, err := ParseCommand(testCase.value)
+		assert.Nil(t, err, testCase.value)
+		assert.Equal(t, testCase.command, command, testCase.value)
+	}
+
+	_, err := ParseCommand(`echo "unterminated`)
+	assert.NotNil(t, err)
+	_, err = ParseCommand(`echo 'unterminated`)
+	assert.NotNil(t, err)
+}
+
+func TestLoadExecProviders(t *testing.T) {
+	err := os.MkdirAll(testProvidersPath, os.ModePerm)
+	assert.Nil(t, err)
+	defer os.RemoveAll(tmpPath)
+
+	err = os.WriteFile(testProvidersPath+"/deploy", []byte("#!/bin/sh\n# lobby-provider: interval=30s timeout=5s stale=2m\necho deploy:abcd\n"), 0755)
+	assert.Nil(t, err)
+	err = os.WriteFile(testProvidersPath+"/disk", []byte("#!/bin/sh\necho disk:ok\n"), 0755)
+	assert.Nil(t, err)
+	err = os.WriteFile(testProvidersPath+"/README", []byte("not executable"), 0644)
+	assert.Nil(t, err)
+	err = os.WriteFile(testProvidersPath+"/.hidden", []byte("#!/bin/sh\n"), 0755)
+	assert.Nil(t, err)
+
+	providers, err := LoadExecProviders(testProvidersPath)
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(providers))
+	assert.Equal(t, "deploy", providers[0].Name())
+	assert.Equal(t, 30*time.Second, providers[0].Interval)
+	assert.Equal(t, 5*time.Second, providers[0].Timeout)
+	assert.Equal(t, 2*time.Minute, providers[0].StaleAfter)
+	assert.Equal(t, "disk", providers[1].Name())
+	assert.Equal(t, time.Duration(0), providers[1].Interval)
+
+	err = providers[0].Run()
+	assert.Nil(t, err)
+	labels, _ := providers[0].Labels()
+	assert.Equal(t, Labels{"deploy:abcd"}, labels)
+
+	err = os.WriteFile(testProvidersPath+"/broken", []byte("#!/bin/sh\n# lobby-provider: every=30s\n"), 0755)
+	assert.Nil(t, err)
+	_, err = LoadExecProviders(testProvidersPath)
+	assert.NotNil(t, err)
+	assert.Contains(t, err.Error(), "broken:2")
+
+	providers, err = LoadExecProviders(tmpPath + "/missing")
+	assert.Nil(t, err)
+	assert.Equal(t, 0, len(providers))
+}
@@ -0,0 +1,478 @@
+package server
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// Query is a parsed label selector. It's used to filter discoveries by their labels.
+//
+// Supported syntax:
+//
+//	key                  label "key" or any label starting with "key:" exists
+//	key=value            label "key:value" exists, value can contain glob characters * and ?
+//	key!=value           label "key:value" doesn't exist
+//	key=~regexp          there is a label "key:VALUE" where VALUE matches the regular expression
+//	key!~regexp          there is no label "key:VALUE" where VALUE matches the regular expression
+//	key in (a, b, ...)   label "key:a" or "key:b" exists
+//	key notin (a, b)     neither "key:a" nor "key:b" exists
+//	NOT, AND, OR         logical operators in order of their precedence, keywords are case insensitive
+//	( ... )              grouping
+//
+// Key can contain colons so "prometheus:nodeexporter:host=1.2.3.4" is valid query too. Values
+// containing spaces or special characters can be quoted by double quotes, quoted values are
+// never treated as globs.
+//
+// Example: service=smtp AND location in (prague, brno) AND NOT maintenance
+type Query struct {
+	source string
+	root   queryNode
+}
+
+// ParseQuery parses selector in the query language described in Query
+func ParseQuery(query string) (*Query, error) {
+	tokens, err := tokenizeQuery(query)
+	if err != nil {
+		return nil, err
+	}
+
+	p := queryParser{tokens: tokens}
+
+	if p.peek().kind == tokenEOF {
+		return nil, fmt.Errorf("empty query")
+	}
+
+	root, err := p.parseOr()
+	if err != nil {
+		return nil, err
+	}
+
+	if token := p.peek(); token.kind != tokenEOF {
+		return nil, p.errorf(token, "unexpected %s", token)
+	}
+
+	return &Query{source: query, root: root}, nil
+}
+
+// String returns the original query
+func (q *Query) String() string {
+	return q.source
+}
+
+// Match returns true if labels of the discovery match the query
+func (q *Query) Match(discovery Discovery) bool {
+	return q.root.match(discovery.Labels)
+}
+
+// MatchLabels returns true if given labels match the query
+func (q *Query) MatchLabels(labels Labels) bool {
+	return q.root.match(labels)
+}
+
+// -----
+// Nodes
+// -----
+
+type queryNode interface {
+	match(labels Labels) bool
+}
+
+type andNode struct {
+	left, right queryNode
+}
+
+func (n *andNode) match(labels Labels) bool {
+	return n.left.match(labels) && n.right.match(labels)
+}
+
+type orNode struct {
+	left, right queryNode
+}
+
+func (n *orNode) match(labels Labels) bool {
+	return n.left.match(labels) || n.right.match(labels)
+}
+
+type notNode struct {
+	node queryNode
+}
+
+func (n *notNode) match(labels Labels) bool {
+	return !n.node.match(labels)
+}
+
+// existsNode matches label "key" or any label starting with "key:"
+type existsNode struct {
+	key string
+}
+
+func (n *existsNode) match(labels Labels) bool {
+	for _, label := range labels {
+		if label.String() == n.key || strings.HasPrefix(label.String(), n.key+":") {
+			return true
+		}
+	}
+	return false
+}
+
+// valueNode matches if there is at least one label "key:VALUE" where VALUE matches one of the matchers
+type valueNode struct {
+	key      string
+	matchers []valueMatcher
+}
+
+func (n *valueNode) match(labels Labels) bool {
+	prefix := n.key + ":"
+	for _, label := range labels {
+		if !strings.HasPrefix(label.String(), prefix) {
+			continue
+		}
+		value := strings.TrimPrefix(label.String(), prefix)
+		for _, matcher := range n.matchers {
+			if matcher(value) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+type valueMatcher func(value string) bool
+
+func exactMatcher(expected string) valueMatcher {
+	return func(value string) bool {
+		return value == expected
+	}
+}
+
+func regexpMatcher(re *regexp.Regexp) valueMatcher {
+	return func(value string) bool {
+		return re.MatchString(value)
+	}
+}
+
+// globToRegexp converts glob with * and ? wildcards into anchored regular expression
+func globToRegexp(glob string) (*regexp.Regexp, error) {
+	pattern := &strings.Builder{}
+	pattern.WriteString("^")
+	for _, c := range glob {
+		switch c {
+		case '*':
+			pattern.WriteString(".*")
+		case '?':
+			pattern.WriteString(".")
+		default:
+			pattern.WriteString(regexp.QuoteMeta(string(c)))
+		}
+	}
+	pattern.WriteString("$")
+	return regexp.Compile(pattern.String())
+}
+
+// ---------
+// Tokenizer
+// ---------
+
+type tokenKind int
+
+const (
+	tokenEOF tokenKind = iota
+	tokenWord
+	tokenLeftParen
+	tokenRightParen
+	tokenComma
+	tokenEqual
+	tokenNotEqual
+	tokenRegexp
+	tokenNotRegexp
+)
+
+type queryToken struct {
+	kind   tokenKind
+	value  string
+	quoted bool
+	pos    int
+}
+
+func (t queryToken) String() string {
+	switch t.kind {
+	case tokenEOF:
+		return "end of query"
+	case tokenWord:
+		return fmt.Sprintf("%q", t.value)
+	default:
+		return fmt.Sprintf("'%s'", t.value)
+	}
+}
+
+// isKeyword returns true if the token is unquoted word equal to the keyword (case insensitive)
+func (t queryToken) isKeyword(keyword string) bool {
+	return t.kind == tokenWord && !t.quoted && strings.EqualFold(t.value, keyword)
+}
+
+func tokenizeQuery(query string) ([]queryToken, error) {
+	tokens := []queryToken{}
+	runes := []rune(query)
+
+	for i := 0; i < len(runes); {
+		c := runes[i]
+
+		switch {
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r':
+			i++
+		case c == '(':
+			tokens = append(tokens, queryToken{kind: tokenLeftParen, value: "(", pos: i})
+			i++
+		case c == ')':
+			tokens = append(tokens, queryToken{kind: tokenRightParen, value: ")", pos: i})
+			i++
+		case c == ',':
+			tokens = append(tokens, queryToken{kind: tokenComma, value: ",", pos: i})
+			i++
+		case c == '=' && i+1 < len(runes) && runes[i+1] == '~':
+			tokens = append(tokens, queryToken{kind: tokenRegexp, value: "=~", pos: i})
+			i += 2
+		case c == '=':
+			tokens = append(tokens, queryToken{kind: tokenEqual, value: "=", pos: i})
+			i++
+		case c == '!' && i+1 < len(runes) && runes[i+1] == '=':
+			tokens = append(tokens, queryToken{kind: tokenNotEqual, value: "!=", pos: i})
+			i += 2
+		case c == '!' && i+1 < len(runes) && runes[i+1] == '~':
+			tokens = append(tokens, queryToken{kind: tokenNotRegexp, value: "!~", pos: i})
+			i += 2
+		case c == '"':
+			start := i
+			value := &strings.Builder{}
+			i++
+			for ; i < len(runes) && runes[i] != '"'; i++ {
+				if runes[i] == '\\' && i+1 < len(runes) {
+					i++
+				}
+				value.WriteRune(runes[i])
+			}
+			if i >= len(runes) {
+				return tokens, fmt.Errorf("unterminated quoted string at position %d", start)
+			}
+			i++
+			tokens = append(tokens, queryToken{kind: tokenWord, value: value.String(), quoted: true, pos: start})
+		default:
+			start := i
+			for ; i < len(runes) && !strings.ContainsRune(" \t\n\r(),=!\"", runes[i]); i++ {
+			}
+			if i == start {
+				return tokens, fmt.Errorf("unexpected character '%c' at position %d", c, i)
+			}
+			tokens = append(tokens, queryToken{kind: tokenWord, value: string(runes[start:i]), pos: start})
+		}
+	}
+
+	tokens = append(tokens, queryToken{kind: tokenEOF, pos: len(runes)})
+
+	return tokens, nil
+}
+
+// ------
+// Parser
+// ------
+
+// queryParser is recursive descent parser of the query language
+type queryParser struct {
+	tokens []queryToken
+	pos    int
+}
+
+func (p *queryParser) peek() queryToken {
+	return p.tokens[p.pos]
+}
+
+func (p *queryParser) next() queryToken {
+	token := p.tokens[p.pos]
+	if token.kind != tokenEOF {
+		p.pos++
+	}
+	return token
+}
+
+func (p *queryParser) errorf(token queryToken, format string, args ...interface{}) error {
+	return fmt.Errorf("%s at position %d", fmt.Sprintf(format, args...), token.pos)
+}
+
+// parseOr: and (OR and)*
+func (p *queryParser) parseOr() (queryNode, error) {
+	left, err := p.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+
+	for p.peek().isKeyword("or") {
+		p.next()
+		right, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		left = &orNode{left: left, right: right}
+	}
+
+	return left, nil
+}
+
+// parseAnd: not (AND not)*
+func (p *queryParser) parseAnd() (queryNode, error) {
+	left, err := p.parseNot()
+	if err != nil {
+		return nil, err
+	}
+
+	for p.peek().isKeyword("and") {
+		p.next()
+		right, err := p.parseNot()
+		if err != nil {
+			return nil, err
+		}
+		left = &andNode{left: left, right: right}
+	}
+
+	return left, nil
+}
+
+// parseNot: NOT not | primary
+func (p *queryParser) parseNot() (queryNode, error) {
+	if p.peek().isKeyword("not") {
+		p.next()
+		node, err := p.parseNot()
+		if err != nil {
+			return nil, err
+		}
+		return &notNode{node: node}, nil
+	}
+
+	return p.parsePrimary()
+}
+
+// parsePrimary: ( or ) | term
+func (p *queryParser) parsePrimary() (queryNode, error) {
+	token := p.peek()
+
+	if token.kind == tokenLeftParen {
+		p.next()
+		node, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		if closing := p.next(); closing.kind != tokenRightParen {
+			return nil, p.errorf(closing, "expected ')' but got %s", closing)
+		}
+		return node, nil
+	}
+
+	return p.parseTerm()
+}
+
+// parseTerm: key | key = value | key != value | key =~ re | key !~ re | key in (values) | key notin (values)
+func (p *queryParser) parseTerm() (queryNode, error) {
+	key := p.next()
+	if key.kind != tokenWord || key.isKeyword("and") || key.isKeyword("or") || key.isKeyword("in") || key.isKeyword("notin") {
+		return nil, p.errorf(key, "expected label key but got %s", key)
+	}
+
+	operator := p.peek()
+	switch {
+	case operator.kind == tokenEqual || operator.kind == tokenNotEqual:
+		p.next()
+		value, err := p.parseValue()
+		if err != nil {
+			return nil, err
+		}
+		matcher, err := valueTokenMatcher(value)
+		if err != nil {
+			return nil, err
+		}
+		node := queryNode(&valueNode{key: key.value, matchers: []valueMatcher{matcher}})
+		if operator.kind == tokenNotEqual {
+			node = &notNode{node: node}
+		}
+		return node, nil
+	case operator.kind == tokenRegexp || operator.kind == tokenNotRegexp:
+		p.next()
+		value, err := p.parseValue()
+		if err != nil {
+			return nil, err
+		}
+		re, err := regexp.Compile("^(?:" + value.value + ")$")
+		if err != nil {
+			return nil, p.errorf(value, "invalid regular expression: %v", err)
+		}
+		node := queryNode(&valueNode{key: key.value, matchers: []valueMatcher{regexpMatcher(re)}})
+		if operator.kind == tokenNotRegexp {
+			node = &notNode{node: node}
+		}
+		return node, nil
+	case operator.isKeyword("in") || operator.isKeyword("notin"):
+		p.next()
+		matchers, err := p.parseValueList()
+		if err != nil {
+			return nil, err
+		}
+		node := queryNode(&valueNode{key: key.value, matchers: matchers})
+		if operator.isKeyword("notin") {
+			node = &notNode{node: node}
+		}
+		return node, nil
+	}
+
+	return &existsNode{key: key.value}, nil
+}
+
+// parseValue returns next token if it's a value
+func (p *queryParser) parseValue() (queryToken, error) {
+	value := p.next()
+	if value.kind != tokenWord {
+		return value, p.errorf(value, "expected value but got %s", value)
+	}
+	return value, nil
+}
+
+// parseValueList: ( value (, value)* )
+func (p *queryParser) parseValueList() ([]valueMatcher, error) {
+	matchers := []valueMatcher{}
+
+	if token := p.next(); token.kind != tokenLeftParen {
+		return nil, p.errorf(token, "expected '(' but got %s", token)
+	}
+
+	for {
+		value, err := p.parseValue()
+		if err != nil {
+			return nil, err
+		}
+		matcher, err := valueTokenMatcher(value)
+		if err != nil {
+			return nil, err
+		}
+		matchers = append(matchers, matcher)
+
+		token := p.next()
+		if token.kind == tokenRightParen {
+			break
+		}
+		if token.kind != tokenComma {
+			return nil, p.errorf(token, "expected ',' or ')' but got %s", token)
+		}
+	}
+
+	return matchers, nil
+}
+
+// valueTokenMatcher returns glob matcher for unquoted values with wildcards and exact matcher for the rest
+func valueTokenMatcher(value queryToken) (valueMatcher, error) {
+	if !value.quoted && strings.ContainsAny(value.value, "*?") {
+		re, err := globToRegexp(value.value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid glob %q at position %d: %v", value.value, value.pos, err)
+		}
+		return regexpMatcher(re), nil
+	}
+	return exactMatcher(value.value), nil
+}
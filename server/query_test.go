@@ -0,0 +1,93 @@
+package server
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestQuery(t *testing.T) {
+	labels := Labels{
+		"service:smtp",
+		"service:imap",
+		"location:prague",
+		"public_ip6:2a03::1",
+		"prometheus:nodeexporter:host:1.2.3.4",
+		"maintenance",
+	}
+
+	tests := map[string]bool{
+		"service=smtp":                     true,
+		"service=pop3":                     false,
+		"service!=pop3":                    true,
+		"service!=smtp":                    false,
+		"service=smtp AND location=prague": true,
+		"service=smtp AND location=brno":   false,
+		"service=pop3 OR location=prague":  true,
+		"service=smtp AND location=prague AND NOT maintenance": false,
+		"service=smtp and not backup":                          true,
+		"location in (brno, prague)":                           true,
+		"location in (brno,ostrava)":                           false,
+		"location notin (brno, ostrava)":                       true,
+		"maintenance":                                          true,
+		"location":                                             true,
+		"backup":                                               false,
+		"service=sm*":                                          true,
+		"service=\"sm*\"":                                      false,
+		"service=?map":                                         true,
+		"service=~\"(smtp|pop3)\"":                             true,
+		"service=~sm":                                          false,
+		"service!~\"i.*\"":                                     false,
+		"public_ip6=2a03::1":                                   true,
+		"prometheus:nodeexporter:host=1.2.3.4":                 true,
+		"prometheus:nodeexporter":                              true,
+		"service:smtp":                                         true,
+		"(service=pop3 OR service=imap) AND location=prague": true,
+		"service=pop3 OR service=imap AND location=brno":     false,
+		"NOT (service=pop3 OR location=brno)":                true,
+	}
+
+	for query, expected := range tests {
+		parsed, err := ParseQuery(query)
+		assert.Nil(t, err, query)
+		if err == nil {
+			assert.Equal(t, expected, parsed.MatchLabels(labels), query)
+			assert.Equal(t, query, parsed.String())
+		}
+	}
+}
+
+func TestQueryErrors(t *testing.T) {
+	for _, query := range []string{
+		"",
+		"   ",
+		"service=",
+		"service=smtp AND",
+		"(service=smtp",
+		"service=smtp)",
+		"location in brno",
+		"location in (brno",
+		"location in (brno prague)",
+		"service=\"smtp",
+		"service=~\"(\"",
+		"AND service=smtp",
+		"service ! smtp",
+	} {
+		_, err := ParseQuery(query)
+		assert.NotNil(t, err, query)
+	}
+}
+
+func TestDiscoveriesFilterQuery(t *testing.T) {
+	discoveries := Discoveries{}
+	discoveries.Add(Discovery{Hostname: "a.example.com", Labels: Labels{"service:smtp", "location:prague"}})
+	discoveries.Add(Discovery{Hostname: "b.example.com", Labels: Labels{"service:smtp", "location:brno"}})
+
+	query, err := ParseQuery("service=smtp AND location=brno")
+	assert.Nil(t, err)
+
+	filtered := discoveries.FilterQuery(query)
+	assert.Equal(t, 1, len(filtered))
+	assert.Equal(t, "b.example.com", filtered[0].Hostname)
+	assert.Equal(t, 2, len(filtered[0].Labels))
+}
@@ -1,9 +1,177 @@
 package server
 
-func AddRuntimeLabel(label Label) error {
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path"
+)
+
+const (
+	RuntimeLabelsStateFilename = "runtime_labels.json" // file in StatePath where runtime labels are stored
+
+	runtimeStateVersion = 1
+)
+
+// runtimeLabelsState is format of the file where runtime labels are stored. Generation is increased
+// by every change so it's possible to tell which version of the labels is newer.
+type runtimeLabelsState struct {
+	Version    int    `json:"version"`
+	Generation uint64 `json:"generation"`
+	Labels     Labels `json:"labels"`
+}
+
+// runtimeStateFile returns path of the file with runtime labels
+func (l *LocalHost) runtimeStateFile() string {
+	return path.Join(l.StatePath, RuntimeLabelsStateFilename)
+}
+
+// loadRuntimeLabels reads the runtime labels from the state file if they are not loaded yet. It has to be
+// called with runtimeLock held. Missing state file means there are no runtime labels.
+func (l *LocalHost) loadRuntimeLabels() error {
+	if l.runtime != nil {
+		return nil
+	}
+
+	state := &runtimeLabelsState{Version: runtimeStateVersion, Labels: Labels{}}
+	if len(l.StatePath) == 0 {
+		l.runtime = state
+		return nil
+	}
+
+	data, err := os.ReadFile(l.runtimeStateFile())
+	if err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("reading runtime labels error: %v", err)
+	}
+
+	if len(bytes.TrimSpace(data)) > 0 {
+		err = json.Unmarshal(data, state)
+		if err != nil {
+			return fmt.Errorf("decoding runtime labels error: %v", err)
+		}
+		if state.Version != runtimeStateVersion {
+			return fmt.Errorf("unsupported runtime labels version %d", state.Version)
+		}
+	}
+
+	labels := Labels{}
+	for _, label := range state.Labels {
+		if len(label) > 0 {
+			labels = append(labels, label)
+		}
+	}
+	state.Labels = labels
+
+	l.runtime = state
 	return nil
 }
 
-func RemoveRuntimeLabel(label Label) error {
+// updateRuntimeLabels changes the runtime labels by update function and saves them with a new generation.
+// The whole read-modify-write cycle runs under the lock so concurrent changes are never lost. Nothing is
+// saved if the labels don't change.
+func (l *LocalHost) updateRuntimeLabels(update func(labels Labels) Labels) error {
+	if len(l.StatePath) == 0 {
+		return fmt.Errorf("runtime labels are not enabled, state path is not set")
+	}
+
+	l.runtimeLock.Lock()
+	defer l.runtimeLock.Unlock()
+
+	err := l.loadRuntimeLabels()
+	if err != nil {
+		return err
+	}
+
+	labels := update(append(Labels{}, l.runtime.Labels...))
+	if labelsDifference(labels, l.runtime.Labels) == nil && labelsDifference(l.runtime.Labels, labels) == nil {
+		return nil
+	}
+
+	state := &runtimeLabelsState{
+		Version:    runtimeStateVersion,
+		Generation: l.runtime.Generation + 1,
+		Labels:     labels,
+	}
+
+	data, err := json.Marshal(state)
+	if err != nil {
+		return fmt.Errorf("encoding runtime labels error: %v", err)
+	}
+
+	err = os.MkdirAll(l.StatePath, 0755)
+	if err != nil {
+		return fmt.Errorf("creating state directory error: %v", err)
+	}
+
+	err = writeFileAtomically(l.runtimeStateFile(), data, 0644)
+	if err != nil {
+		return fmt.Errorf("writing runtime labels error: %v", err)
+	}
+
+	l.runtime = state
+	return nil
+}
+
+// RuntimeLabels returns labels added via the REST API (without leases) and generation of their state
+func (l *LocalHost) RuntimeLabels() (Labels, uint64, error) {
+	l.runtimeLock.Lock()
+	defer l.runtimeLock.Unlock()
+
+	err := l.loadRuntimeLabels()
+	if err != nil {
+		return nil, 0, err
+	}
+
+	return append(Labels{}, l.runtime.Labels...), l.runtime.Generation, nil
+}
+
+// MigrateRuntimeLabels moves runtime labels from RuntimeLabelsFilename in LabelsPath, where older versions
+// stored them, into the state in StatePath. The old file is removed once the labels are saved. It returns
+// number of migrated labels, missing old file is not an error.
+func (l *LocalHost) MigrateRuntimeLabels() (int, error) {
+	if len(l.RuntimeLabelsFilename) == 0 {
+		return 0, nil
+	}
+
+	oldFile := path.Join(l.LabelsPath, l.RuntimeLabelsFilename)
+	content, err := os.ReadFile(oldFile)
+	if os.IsNotExist(err) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, fmt.Errorf("reading %s error: %v", oldFile, err)
+	}
+
+	migrated := Labels{}
+	for _, label := range parsePlainLabels(content, false) {
+		migrated = append(migrated, label.label)
+	}
+
+	err = l.updateRuntimeLabels(func(labels Labels) Labels {
+		return appendMissingLabels(labels, migrated)
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	err = os.Remove(oldFile)
+	if err != nil {
+		return len(migrated), fmt.Errorf("removing %s error: %v", oldFile, err)
+	}
+
+	return len(migrated), nil
+}
+
+// addRuntimeLabels adds runtime labels into the index
+func (l *LocalHost) addRuntimeLabels(index *labelSourcesIndex) error {
+	labels, _, err := l.RuntimeLabels()
+	if err != nil {
+		return err
+	}
+
+	for _, label := range labels {
+		index.add(label, LabelSource{Type: LabelSourceRuntime})
+	}
 	return nil
 }
@@ -0,0 +1,123 @@
+package server
+
+import (
+	"os"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const testStatePath = tmpPath + "/state"
+
+func TestRuntimeLabels(t *testing.T) {
+	localHost := LocalHost{
+		LabelsPath:            testLabelPath,
+		RuntimeLabelsFilename: "_runtime",
+		StatePath:             testStatePath,
+		HostnameOverride:      "test.example.com",
+	}
+	defer os.RemoveAll(tmpPath)
+
+	labels, generation, err := localHost.RuntimeLabels()
+	assert.Nil(t, err)
+	assert.Equal(t, Labels{}, labels)
+	assert.Equal(t, uint64(0), generation)
+
+	err = localHost.AddLabels(Labels{"runtime:1", "runtime:2"})
+	assert.Nil(t, err)
+	err = localHost.AddLabels(Labels{"runtime:2"})
+	assert.Nil(t, err)
+	labels, generation, err = localHost.RuntimeLabels()
+	assert.Nil(t, err)
+	assert.Equal(t, Labels{"runtime:1", "runtime:2"}, labels)
+	assert.Equal(t, uint64(1), generation)
+
+	info, err := os.Stat(testStatePath + "/" + RuntimeLabelsStateFilename)
+	assert.Nil(t, err)
+	assert.Equal(t, os.FileMode(0644), info.Mode().Perm())
+
+	// New instance reads the state from the disk
+	restarted := LocalHost{StatePath: testStatePath}
+	labels, generation, err = restarted.RuntimeLabels()
+	assert.Nil(t, err)
+	assert.Equal(t, Labels{"runtime:1", "runtime:2"}, labels)
+	assert.Equal(t, uint64(1), generation)
+
+	// Empty state file has no labels
+	err = os.WriteFile(testStatePath+"/"+RuntimeLabelsStateFilename, []byte(""), 0644)
+	assert.Nil(t, err)
+	empty := LocalHost{StatePath: testStatePath}
+	labels, _, err = empty.RuntimeLabels()
+	assert.Nil(t, err)
+	assert.Equal(t, Labels{}, labels)
+
+	// Runtime labels need the state path
+	err = (&LocalHost{}).AddLabels(Labels{"runtime:1"})
+	assert.NotNil(t, err)
+}
+
+func TestRuntimeLabelsConcurrency(t *testing.T) {
+	localHost := LocalHost{StatePath: testStatePath}
+	defer os.RemoveAll(tmpPath)
+
+	wg := sync.WaitGroup{}
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			err := localHost.AddLabels(Labels{Label("runtime:" + string(rune('a'+i)))})
+			assert.Nil(t, err)
+		}(i)
+	}
+	wg.Wait()
+
+	labels, generation, err := localHost.RuntimeLabels()
+	assert.Nil(t, err)
+	assert.Equal(t, 20, len(labels))
+	assert.Equal(t, uint64(20), generation)
+
+	restarted := LocalHost{StatePath: testStatePath}
+	labels, _, err = restarted.RuntimeLabels()
+	assert.Nil(t, err)
+	assert.Equal(t, 20, len(labels))
+}
+
+func TestMigrateRuntimeLabels(t *testing.T) {
+	localHost := LocalHost{
+		LabelsPath:            testLabelPath,
+		RuntimeLabelsFilename: "_runtime",
+		StatePath:             testStatePath,
+		HostnameOverride:      "test.example.com",
+	}
+
+	err := os.MkdirAll(testLabelPath, os.ModePerm)
+	assert.Nil(t, err)
+	defer os.RemoveAll(tmpPath)
+
+	migrated, err := localHost.MigrateRuntimeLabels()
+	assert.Nil(t, err)
+	assert.Equal(t, 0, migrated)
+
+	err = localHost.AddLabels(Labels{"runtime:new"})
+	assert.Nil(t, err)
+	err = os.WriteFile(testLabelPath+"/_runtime", []byte("runtime:old\n\nruntime:new\n"), 0755)
+	assert.Nil(t, err)
+
+	// The old file is ignored until it's migrated
+	discovery, err := localHost.GetIdentification()
+	assert.Nil(t, err)
+	assert.Equal(t, Labels{"runtime:new"}, discovery.Labels)
+
+	migrated, err = localHost.MigrateRuntimeLabels()
+	assert.Nil(t, err)
+	assert.Equal(t, 2, migrated)
+
+	_, err = os.Stat(testLabelPath + "/_runtime")
+	assert.True(t, os.IsNotExist(err))
+
+	labels, generation, err := localHost.RuntimeLabels()
+	assert.Nil(t, err)
+	assert.Equal(t, Labels{"runtime:new", "runtime:old"}, labels)
+	assert.Equal(t, uint64(2), generation)
+}
@@ -0,0 +1,253 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"sort"
+	"strings"
+)
+
+// LabelSourceType says where a local label comes from
+type LabelSourceType string
+
+const (
+	LabelSourceEnv      LabelSourceType = "env"      // LABELS environment variable (InitialLabels)
+	LabelSourceFile     LabelSourceType = "file"     // file in LabelsPath
+	LabelSourceRuntime  LabelSourceType = "runtime"  // added via the REST API
+	LabelSourceLease    LabelSourceType = "lease"    // added via the REST API with a lease, see Lease
+	LabelSourceProvider LabelSourceType = "provider" // one of LocalHost.Providers
+)
+
+// LabelSource describes a single origin of a local label
+type LabelSource struct {
+	Type     LabelSourceType `json:"type"`
+	File     string          `json:"file,omitempty"`     // only for file source
+	Line     int             `json:"line,omitempty"`     // only for file source
+	Provider string          `json:"provider,omitempty"` // only for provider source
+	Lease    string          `json:"lease,omitempty"`    // only for lease source
+}
+
+func (s LabelSource) String() string {
+	switch s.Type {
+	case LabelSourceFile:
+		return fmt.Sprintf("file %s:%d", s.File, s.Line)
+	case LabelSourceProvider:
+		return fmt.Sprintf("provider %s", s.Provider)
+	case LabelSourceLease:
+		return fmt.Sprintf("lease %s", s.Lease)
+	default:
+		return string(s.Type)
+	}
+}
+
+// SourcedLabel is a local label with all places where it's defined
+type SourcedLabel struct {
+	Label       Label         `json:"label"`
+	Sources     []LabelSource `json:"sources"`
+	WithdrawnBy []string      `json:"withdrawn_by,omitempty"` // failing health checks that withdrew the label from the discovery packet
+	Error       string        `json:"error,omitempty"`        // why the label can't be published, e.g. undefined variable, Label is then the label before interpolation
+}
+
+// IsPublished returns true if the label is part of the discovery packet
+func (s *SourcedLabel) IsPublished() bool {
+	return len(s.WithdrawnBy) == 0 && len(s.Error) == 0
+}
+
+// IsRuntime returns true if the label was added via the REST API, with or without a lease
+func (s *SourcedLabel) IsRuntime() bool {
+	for _, source := range s.Sources {
+		if source.Type == LabelSourceRuntime || source.Type == LabelSourceLease {
+			return true
+		}
+	}
+	return false
+}
+
+// SourcesString returns comma separated list of the label's sources
+func (s *SourcedLabel) SourcesString() string {
+	sources := []string{}
+	for _, source := range s.Sources {
+		sources = append(sources, source.String())
+	}
+	return strings.Join(sources, ", ")
+}
+
+// LabelProvider is a source of local labels other than environment, files in LabelsPath and runtime labels
+type LabelProvider interface {
+	Name() string            // name of the provider used as the label source
+	Labels() (Labels, error) // current labels of the provider
+}
+
+// NotRuntimeLabelsError is returned by DeleteLabels when some of the labels can't be deleted because they don't come from the REST API
+type NotRuntimeLabelsError struct {
+	Labels []SourcedLabel
+}
+
+func (e *NotRuntimeLabelsError) Error() string {
+	messages := []string{}
+	for _, label := range e.Labels {
+		messages = append(messages, fmt.Sprintf("label %s is not a runtime label, it comes from %s", label.Label, label.SourcesString()))
+	}
+	return strings.Join(messages, "; ")
+}
+
+// labelSourcesIndex collects labels and their sources in the order they were found
+type labelSourcesIndex struct {
+	labels []*SourcedLabel
+	index  map[Label]*SourcedLabel
+	errors []string // files in LabelsPath that were skipped because they can't be read or parsed
+}
+
+func (i *labelSourcesIndex) add(label Label, source LabelSource) *SourcedLabel {
+	if i.index == nil {
+		i.index = make(map[Label]*SourcedLabel)
+	}
+
+	sourced, ok := i.index[label]
+	if !ok {
+		sourced = &SourcedLabel{Label: label}
+		i.index[label] = sourced
+		i.labels = append(i.labels, sourced)
+	}
+	sourced.Sources = append(sourced.Sources, source)
+	return sourced
+}
+
+// LabelSources returns all local labels sorted alphabetically with information where they come from
+func (l *LocalHost) LabelSources() ([]SourcedLabel, error) {
+	index, err := l.labelSources()
+	if err != nil {
+		return nil, err
+	}
+
+	labels := []SourcedLabel{}
+	for _, label := range index.labels {
+		labels = append(labels, *label)
+	}
+	sort.Slice(labels, func(i, j int) bool {
+		return labels[i].Label < labels[j].Label
+	})
+
+	return labels, nil
+}
+
+// labelSources gathers labels from the environment, LabelsPath, runtime state, leases and providers
+func (l *LocalHost) labelSources() (*labelSourcesIndex, error) {
+	fileIndex, err := l.cachedFileLabels()
+	if err != nil {
+		return fileIndex, err
+	}
+
+	// The file labels can be cached so they are copied before other labels are added. Variables
+	// are interpolated here so the values are always current, runtime labels are taken literally.
+	rawLabels := Labels{}
+	for _, label := range fileIndex.labels {
+		rawLabels = append(rawLabels, label.Label)
+	}
+	interpolator := newLabelInterpolator(l, rawLabels)
+
+	// Label that can't be interpolated is left out of the discovery packet, the other labels are still published
+	index := &labelSourcesIndex{}
+	labelErrors := append([]string{}, fileIndex.errors...)
+	for _, label := range fileIndex.labels {
+		interpolated, err := interpolator.interpolate(label.Label)
+		if err != nil {
+			for _, source := range label.Sources {
+				index.add(label.Label, source).Error = err.Error()
+			}
+			labelErrors = append(labelErrors, fmt.Sprintf("label %s from %s is not published: %v", label.Label, label.SourcesString(), err))
+			continue
+		}
+		for _, source := range label.Sources {
+			index.add(interpolated, source)
+		}
+	}
+	l.errors.report(l.LogChannel, labelErrors)
+
+	err = l.addRuntimeLabels(index)
+	if err != nil {
+		return index, err
+	}
+	l.addLeaseLabels(index)
+
+	for _, provider := range l.Providers {
+		labels, err := provider.Labels()
+		if err != nil {
+			return index, fmt.Errorf("label provider %s error: %v", provider.Name(), err)
+		}
+		for _, label := range labels {
+			index.add(label, LabelSource{Type: LabelSourceProvider, Provider: provider.Name()})
+		}
+	}
+
+	for _, check := range l.Checks {
+		if check.Healthy() {
+			continue
+		}
+		for _, label := range index.labels {
+			if check.Gates(*label) {
+				label.WithdrawnBy = append(label.WithdrawnBy, check.Name)
+			}
+		}
+	}
+
+	return index, nil
+}
+
+// CheckLabelsFiles returns error if any of the files in LabelsPath can't be read or parsed. Such files
+// are skipped when the labels are loaded, so this is meant to be called during start to fail early.
+func (l *LocalHost) CheckLabelsFiles() error {
+	index, err := l.fileLabelSources()
+	if err != nil {
+		return err
+	}
+	if len(index.errors) > 0 {
+		return errors.New(strings.Join(index.errors, "; "))
+	}
+	return nil
+}
+
+// fileLabelSources reads labels from the environment and LabelsPath. File that can't be read or parsed
+// is skipped and the error is kept in the index, so a bad edit of one file doesn't withdraw all labels.
+func (l *LocalHost) fileLabelSources() (*labelSourcesIndex, error) {
+	index := &labelSourcesIndex{}
+
+	for _, label := range l.InitialLabels {
+		index.add(label, LabelSource{Type: LabelSourceEnv})
+	}
+
+	if _, err := os.Stat(l.LabelsPath); !os.IsNotExist(err) {
+		files, err := ioutil.ReadDir(l.LabelsPath)
+		if err != nil {
+			return index, err
+		}
+
+		for _, file := range files {
+			if file.IsDir() || file.Name() == l.RuntimeLabelsFilename || !IsLabelsFile(file.Name(), l.LabelsFilesPatterns) {
+				continue
+			}
+
+			fullPath := path.Join(l.LabelsPath, file.Name())
+
+			content, err := os.ReadFile(fullPath)
+			if err != nil {
+				index.errors = append(index.errors, fmt.Sprintf("read file error, labels file skipped: %v", err))
+				continue
+			}
+
+			labels, err := parseLabelsFile(fullPath, content)
+			if err != nil {
+				index.errors = append(index.errors, fmt.Sprintf("labels file error, file skipped: %v", err))
+				continue
+			}
+			for _, label := range labels {
+				index.add(label.label, LabelSource{Type: LabelSourceFile, File: fullPath, Line: label.line})
+			}
+		}
+	}
+
+	return index, nil
+}
@@ -0,0 +1,72 @@
+package server
+
+import (
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type testLabelProvider struct {
+	labels Labels
+}
+
+func (p *testLabelProvider) Name() string {
+	return "test"
+}
+
+func (p *testLabelProvider) Labels() (Labels, error) {
+	return p.labels, nil
+}
+
+func TestLabelSources(t *testing.T) {
+	localHost := LocalHost{
+		LabelsPath:            testLabelPath,
+		RuntimeLabelsFilename: "_runtime",
+		StatePath:             testStatePath,
+		HostnameOverride:      "test.example.com",
+		InitialLabels:         Labels{Label("service:test"), Label("test:1")},
+		Providers:             []LabelProvider{&testLabelProvider{labels: Labels{"provided"}}},
+	}
+
+	err := os.MkdirAll(testLabelPath, os.ModePerm)
+	assert.Nil(t, err)
+	defer os.RemoveAll(tmpPath)
+
+	err = os.WriteFile(testLabelPath+"/test", []byte("service:test\n\npublic_ip:1.2.3.4"), 0644)
+	assert.Nil(t, err)
+
+	err = localHost.AddLabels(Labels{"runtime:1"})
+	assert.Nil(t, err)
+
+	labels, err := localHost.LabelSources()
+	assert.Nil(t, err)
+	assert.Equal(t, []SourcedLabel{
+		{Label: "provided", Sources: []LabelSource{{Type: LabelSourceProvider, Provider: "test"}}},
+		{Label: "public_ip:1.2.3.4", Sources: []LabelSource{{Type: LabelSourceFile, File: "tmp/labels/test", Line: 3}}},
+		{Label: "runtime:1", Sources: []LabelSource{{Type: LabelSourceRuntime}}},
+		{Label: "service:test", Sources: []LabelSource{{Type: LabelSourceEnv}, {Type: LabelSourceFile, File: "tmp/labels/test", Line: 1}}},
+		{Label: "test:1", Sources: []LabelSource{{Type: LabelSourceEnv}}},
+	}, labels)
+	assert.Equal(t, "env, file tmp/labels/test:1", labels[3].SourcesString())
+
+	discovery, err := localHost.GetIdentification()
+	assert.Nil(t, err)
+	assert.Equal(t, Labels{"provided", "public_ip:1.2.3.4", "runtime:1", "service:test", "test:1"}, discovery.Labels)
+
+	// Labels from other sources can't be deleted and nothing is deleted then
+	err = localHost.DeleteLabels(Labels{"runtime:1", "public_ip:1.2.3.4"})
+	assert.IsType(t, &NotRuntimeLabelsError{}, err)
+	assert.Equal(t, "label public_ip:1.2.3.4 is not a runtime label, it comes from file tmp/labels/test:3", err.Error())
+
+	discovery, err = localHost.GetIdentification()
+	assert.Nil(t, err)
+	assert.Contains(t, discovery.Labels, Label("runtime:1"))
+
+	err = localHost.DeleteLabels(Labels{"runtime:1", "unknown"})
+	assert.Nil(t, err)
+
+	discovery, err = localHost.GetIdentification()
+	assert.Nil(t, err)
+	assert.NotContains(t, discovery.Labels, Label("runtime:1"))
+}
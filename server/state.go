@@ -0,0 +1,145 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path"
+	"strings"
+	"time"
+)
+
+const stateVersion = 1
+
+// discoveriesState is format of the file where Discoveries are saved between restarts
+type discoveriesState struct {
+	Version     int         `json:"version"`
+	SavedAt     int64       `json:"saved_at"`
+	Discoveries []Discovery `json:"discoveries"`
+}
+
+// Restore adds discoveries into the storage but unlike Add it keeps their LastCheck values. The servers didn't
+// join, they were known before the restart, so no joined events are published. Their instances are tracked
+// as in Add so hostname conflicts are detected right away.
+// Discoveries that are not alive anymore, invalid, already known or from not watched namespaces are skipped. It returns number
+// of restored discoveries.
+func (d *Discoveries) Restore(discoveries []Discovery) int {
+	restored := []string{}
+	conflicts := []string{}
+
+	d.lock.Lock()
+	d.init()
+	for _, discovery := range discoveries {
+		discovery = copyDiscovery(discovery)
+		discovery.Namespace = NormalizeNamespace(discovery.Namespace)
+		key := discoveryKey(discovery.Namespace, discovery.Hostname)
+
+		if discovery.Validate() != nil || !d.isAlive(discovery) || !d.Watches(discovery.Namespace) {
+			continue
+		}
+
+		conflict := d.trackInstance(discovery)
+		if conflict != nil {
+			d.publish(newConflictEvent(discovery, *conflict))
+			conflicts = append(conflicts, fmt.Sprintf("hostname conflict: %s is announced by instances %s", discovery.Name(), strings.Join(conflict.InstanceIDs, ", ")))
+		}
+
+		if _, exists := d.activeServers[key]; exists {
+			continue
+		}
+
+		d.activeServers[key] = discovery
+		restored = append(restored, discovery.Name())
+	}
+	d.lock.Unlock()
+
+	for _, hostname := range restored {
+		d.log(fmt.Sprintf("%s restored", hostname))
+	}
+	d.log(conflicts...)
+
+	return len(restored)
+}
+
+// SaveState writes all discoveries into the file. The file is replaced atomically so it's never
+// left half written.
+func (d *Discoveries) SaveState(filename string) error {
+	state := discoveriesState{
+		Version:     stateVersion,
+		SavedAt:     time.Now().Unix(),
+		Discoveries: d.GetAll(),
+	}
+
+	data, err := json.Marshal(state)
+	if err != nil {
+		return fmt.Errorf("encoding state error: %v", err)
+	}
+
+	err = writeFileAtomically(filename, data, 0644)
+	if err != nil {
+		return fmt.Errorf("writing state file error: %v", err)
+	}
+
+	return nil
+}
+
+// writeFileAtomically writes data into a temporary file in the same directory, syncs it and renames it
+// over filename so the file is never left half written.
+func writeFileAtomically(filename string, data []byte, perm os.FileMode) error {
+	tmpFile, err := os.CreateTemp(path.Dir(filename), "."+path.Base(filename)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmpFile.Name())
+
+	_, err = tmpFile.Write(data)
+	if err == nil {
+		err = tmpFile.Chmod(perm)
+	}
+	if err == nil {
+		err = tmpFile.Sync()
+	}
+	if closeErr := tmpFile.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+
+	err = os.Rename(tmpFile.Name(), filename)
+	if err != nil {
+		return err
+	}
+
+	// The rename itself is durable only after the directory is synced
+	dir, err := os.Open(path.Dir(filename))
+	if err != nil {
+		return err
+	}
+	defer dir.Close()
+
+	return dir.Sync()
+}
+
+// LoadState restores discoveries saved by SaveState, see Restore. Missing file is not an error.
+func (d *Discoveries) LoadState(filename string) (int, error) {
+	data, err := os.ReadFile(filename)
+	if os.IsNotExist(err) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, fmt.Errorf("reading state file error: %v", err)
+	}
+
+	state := discoveriesState{}
+	err = json.Unmarshal(data, &state)
+	if err != nil {
+		return 0, fmt.Errorf("decoding state file error: %v", err)
+	}
+
+	if state.Version != stateVersion {
+		return 0, fmt.Errorf("unsupported state file version %d", state.Version)
+	}
+
+	return d.Restore(state.Discoveries), nil
+}
@@ -0,0 +1,86 @@
+package server
+
+import (
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDiscoveriesState(t *testing.T) {
+	err := os.MkdirAll(tmpPath, os.ModePerm)
+	assert.Nil(t, err)
+	defer os.RemoveAll(tmpPath)
+
+	stateFile := tmpPath + "/state.json"
+
+	discoveries := Discoveries{TTL: 30}
+	discoveries.Add(Discovery{Hostname: "a.example.com", Labels: Labels{"service:smtp"}})
+	discoveries.Add(Discovery{Hostname: "b.example.com", Labels: Labels{"service:imap"}})
+
+	// Make b.example.com older, it should still be alive after restore
+	discoveries.lock.Lock()
+	old := discoveries.activeServers[discoveryKey(DefaultNamespace, "b.example.com")]
+	old.LastCheck = time.Now().Unix() - 20
+	discoveries.activeServers[discoveryKey(DefaultNamespace, "b.example.com")] = old
+	discoveries.lock.Unlock()
+
+	err = discoveries.SaveState(stateFile)
+	assert.Nil(t, err)
+
+	restored := Discoveries{TTL: 30}
+	count, err := restored.LoadState(stateFile)
+	assert.Nil(t, err)
+	assert.Equal(t, 2, count)
+	assert.Equal(t, old.LastCheck, restored.Get(DefaultNamespace, "b.example.com").LastCheck)
+	assert.Equal(t, Labels{"service:smtp"}, restored.Get(DefaultNamespace, "a.example.com").Labels)
+
+	// Shorter TTL drops the older record
+	restored = Discoveries{TTL: 10}
+	count, err = restored.LoadState(stateFile)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, count)
+	assert.False(t, restored.Exist(DefaultNamespace, "b.example.com"))
+
+	// Known servers are not overwritten
+	restored = Discoveries{TTL: 30}
+	restored.Add(Discovery{Hostname: "a.example.com", Labels: Labels{"service:pop3"}})
+	count, err = restored.LoadState(stateFile)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, count)
+	assert.Equal(t, Labels{"service:pop3"}, restored.Get(DefaultNamespace, "a.example.com").Labels)
+
+	// Restored servers don't join again, conflicts between their instances are detected
+	restored = Discoveries{TTL: 30}
+	events, cancel := restored.Subscribe()
+	defer cancel()
+	now := time.Now().Unix()
+	count = restored.Restore([]Discovery{
+		{Hostname: "c.example.com", InstanceID: "aaaa", LastCheck: now},
+		{Hostname: "c.example.com", InstanceID: "bbbb", LastCheck: now},
+	})
+	assert.Equal(t, 1, count)
+	assert.Equal(t, []Conflict{{Namespace: DefaultNamespace, Hostname: "c.example.com", InstanceIDs: []string{"aaaa", "bbbb"}, Since: now}}, restored.Conflicts())
+	select {
+	case event := <-events:
+		assert.Equal(t, EventConflict, event.Type)
+	case <-time.After(time.Second):
+		t.Fatal("conflict event not published")
+	}
+	select {
+	case event := <-events:
+		t.Fatalf("unexpected %s event", event.Type)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	// Missing file is fine
+	count, err = restored.LoadState(tmpPath + "/missing.json")
+	assert.Nil(t, err)
+	assert.Equal(t, 0, count)
+
+	err = os.WriteFile(stateFile, []byte("{"), 0644)
+	assert.Nil(t, err)
+	_, err = restored.LoadState(stateFile)
+	assert.NotNil(t, err)
+}
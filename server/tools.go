@@ -1,12 +1,39 @@
 package server
 
-import "github.com/google/go-cmp/cmp"
+import "sync"
 
-// Compare compares discovery A and B and returns true if those two are different.
+// Compare compares discovery A and B and returns true if those two are different. Last check, TTL, keep alive interval and instance ID are ignored.
+// Use DiffDiscoveries to find out what has changed.
 func Compare(discoveryA, discoveryB Discovery) bool {
-	discoveryA.LastCheck = 0
-	discoveryB.LastCheck = 0
-	discoveryA.TTL = 0
-	discoveryB.TTL = 0
-	return !cmp.Equal(discoveryA, discoveryB)
+	diff := DiffDiscoveries(discoveryA, discoveryB)
+	return !diff.Empty()
+}
+
+// errorReporter sends errors to a log channel, each only once while it lasts. Labels are assembled
+// on every keep alive so the same error would be logged over and over again otherwise.
+type errorReporter struct {
+	lock     sync.Mutex
+	reported map[string]bool // errors of the last report
+}
+
+// report sends errors that were not in the last report to the channel, nil channel is ignored
+func (r *errorReporter) report(channel chan string, errors []string) {
+	r.lock.Lock()
+	current := make(map[string]bool)
+	newErrors := []string{}
+	for _, message := range errors {
+		current[message] = true
+		if !r.reported[message] {
+			newErrors = append(newErrors, message)
+		}
+	}
+	r.reported = current
+	r.lock.Unlock()
+
+	if channel == nil {
+		return
+	}
+	for _, message := range newErrors {
+		channel <- message
+	}
 }
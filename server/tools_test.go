@@ -43,3 +43,10 @@ func TestCompare(t *testing.T) {
 	assert.False(t, Compare(discoveryB, discoveryB))
 	assert.False(t, Compare(discoveryA, discoveryAB)) // Test that last check is zeroed
 }
+
+func TestCompareIgnoresTiming(t *testing.T) {
+	discoveryA := Discovery{Hostname: "abcd.com", TTL: 30, KeepAlive: 5}
+	discoveryB := Discovery{Hostname: "abcd.com", TTL: 90, KeepAlive: 30}
+
+	assert.False(t, Compare(discoveryA, discoveryB))
+}
@@ -1,8 +1,18 @@
 package server
 
-import "strings"
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
 
-// Label keeps one piece of information about a single server
+// Label keeps one piece of information about a single server.
+//
+// Labels are usually in KEY:VALUE format where the key is the part before the first colon
+// and the value is everything after it, so "public_ip6:2a03::1" has key "public_ip6" and
+// value "2a03::1". Label without colon has only key and empty value.
 type Label string
 
 func (l Label) String() string {
@@ -16,7 +26,7 @@ func (l Label) GetPart(idx int) string {
 	if idx < 0 {
 		return ""
 	}
-	if len(parts) >= idx {
+	if idx >= len(parts) {
 		return ""
 	}
 
@@ -30,13 +40,80 @@ func (l Label) GetPart1(idx int) string {
 	if idx < 0 {
 		return ""
 	}
-	if len(parts) >= idx {
+	if idx >= len(parts) {
 		return ""
 	}
 
 	return parts[idx]
 }
 
+// Key returns part of the label before the first colon or the whole label if there is no colon
+func (l Label) Key() string {
+	return l.GetPart1(0)
+}
+
+// Value returns part of the label after the first colon or empty string if there is no colon
+func (l Label) Value() string {
+	return l.GetPart1(1)
+}
+
+// HasValue returns true if the label contains a colon
+func (l Label) HasValue() bool {
+	return strings.Contains(l.String(), ":")
+}
+
+// Path returns all colon separated segments of the label
+func (l Label) Path() []string {
+	return strings.Split(l.String(), ":")
+}
+
+// Int returns value of the label as an integer
+func (l Label) Int() (int, error) {
+	value, err := strconv.Atoi(l.Value())
+	if err != nil {
+		return 0, fmt.Errorf("label %s: value is not an integer", l)
+	}
+	return value, nil
+}
+
+// Bool returns value of the label as a boolean, it accepts everything strconv.ParseBool does plus yes/no and on/off
+func (l Label) Bool() (bool, error) {
+	switch strings.ToLower(l.Value()) {
+	case "yes", "on":
+		return true, nil
+	case "no", "off":
+		return false, nil
+	}
+
+	value, err := strconv.ParseBool(l.Value())
+	if err != nil {
+		return false, fmt.Errorf("label %s: value is not a boolean", l)
+	}
+	return value, nil
+}
+
+// IP returns value of the label as an IPv4 or IPv6 address
+func (l Label) IP() (net.IP, error) {
+	ip := net.ParseIP(l.Value())
+	if ip == nil {
+		return nil, fmt.Errorf("label %s: value is not an IP address", l)
+	}
+	return ip, nil
+}
+
+// Duration returns value of the label as a duration, it can be in time.ParseDuration format or number of seconds
+func (l Label) Duration() (time.Duration, error) {
+	if seconds, err := strconv.Atoi(l.Value()); err == nil {
+		return time.Duration(seconds) * time.Second, nil
+	}
+
+	value, err := time.ParseDuration(l.Value())
+	if err != nil {
+		return 0, fmt.Errorf("label %s: value is not a duration", l)
+	}
+	return value, nil
+}
+
 // Labels stores multiple Label records
 type Labels []Label
 
@@ -50,3 +127,47 @@ func (l *Labels) StringSlice() []string {
 
 	return labelsString
 }
+
+// Map returns labels grouped by their keys. Labels without value are represented by a key with empty list of values.
+func (l Labels) Map() map[string][]string {
+	labelsMap := map[string][]string{}
+
+	for _, label := range l {
+		if _, ok := labelsMap[label.Key()]; !ok {
+			labelsMap[label.Key()] = []string{}
+		}
+		if label.HasValue() {
+			labelsMap[label.Key()] = append(labelsMap[label.Key()], label.Value())
+		}
+	}
+
+	return labelsMap
+}
+
+// Values returns values of all labels with given key
+func (l Labels) Values(key string) []string {
+	values := []string{}
+
+	for _, label := range l {
+		if label.HasValue() && label.Key() == key {
+			values = append(values, label.Value())
+		}
+	}
+
+	return values
+}
+
+// Sub returns labels under given colon separated prefix with the prefix removed. For example
+// Sub("prometheus:nodeexporter") returns "host:1.2.3.4" for label "prometheus:nodeexporter:host:1.2.3.4".
+func (l Labels) Sub(prefix string) Labels {
+	labels := Labels{}
+
+	prefix = strings.TrimSuffix(prefix, ":") + ":"
+	for _, label := range l {
+		if strings.HasPrefix(label.String(), prefix) {
+			labels = append(labels, Label(strings.TrimPrefix(label.String(), prefix)))
+		}
+	}
+
+	return labels
+}
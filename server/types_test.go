@@ -0,0 +1,81 @@
+package server
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLabelParts(t *testing.T) {
+	label := Label("public_ip6:2a03::1")
+
+	assert.Equal(t, "public_ip6", label.GetPart(0))
+	assert.Equal(t, "2a03", label.GetPart(1))
+	assert.Equal(t, "1", label.GetPart(3))
+	assert.Equal(t, "", label.GetPart(4))
+	assert.Equal(t, "", label.GetPart(-1))
+	assert.Equal(t, "2a03::1", label.GetPart1(1))
+	assert.Equal(t, "", label.GetPart1(2))
+
+	assert.Equal(t, "public_ip6", label.Key())
+	assert.Equal(t, "2a03::1", label.Value())
+	assert.True(t, label.HasValue())
+	assert.Equal(t, []string{"public_ip6", "2a03", "", "1"}, label.Path())
+
+	label = Label("maintenance")
+	assert.Equal(t, "maintenance", label.Key())
+	assert.Equal(t, "", label.Value())
+	assert.False(t, label.HasValue())
+}
+
+func TestLabelTypedValues(t *testing.T) {
+	number, err := Label("port:9100").Int()
+	assert.Nil(t, err)
+	assert.Equal(t, 9100, number)
+	_, err = Label("port:abc").Int()
+	assert.NotNil(t, err)
+
+	for _, value := range []string{"true", "1", "yes", "on"} {
+		b, err := Label("primary:" + value).Bool()
+		assert.Nil(t, err)
+		assert.True(t, b)
+	}
+	b, err := Label("primary:off").Bool()
+	assert.Nil(t, err)
+	assert.False(t, b)
+	_, err = Label("primary:maybe").Bool()
+	assert.NotNil(t, err)
+
+	ip, err := Label("public_ip6:2a03::1").IP()
+	assert.Nil(t, err)
+	assert.Equal(t, net.ParseIP("2a03::1"), ip)
+	_, err = Label("public_ip4:1,2,3,4").IP()
+	assert.NotNil(t, err)
+
+	duration, err := Label("interval:90").Duration()
+	assert.Nil(t, err)
+	assert.Equal(t, 90*time.Second, duration)
+	duration, err = Label("interval:1m30s").Duration()
+	assert.Nil(t, err)
+	assert.Equal(t, 90*time.Second, duration)
+	_, err = Label("interval:soon").Duration()
+	assert.NotNil(t, err)
+}
+
+func TestLabelsMap(t *testing.T) {
+	labels := Labels{"service:smtp", "service:imap", "public_ip6:2a03::1", "maintenance", "prometheus:ne:host:1.2.3.4"}
+
+	assert.Equal(t, map[string][]string{
+		"service":     {"smtp", "imap"},
+		"public_ip6":  {"2a03::1"},
+		"maintenance": {},
+		"prometheus":  {"ne:host:1.2.3.4"},
+	}, labels.Map())
+
+	assert.Equal(t, []string{"smtp", "imap"}, labels.Values("service"))
+	assert.Equal(t, []string{}, labels.Values("maintenance"))
+	assert.Equal(t, Labels{"host:1.2.3.4"}, labels.Sub("prometheus:ne"))
+	assert.Equal(t, Labels{"host:1.2.3.4"}, labels.Sub("prometheus:ne:"))
+}
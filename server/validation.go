@@ -0,0 +1,134 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+const (
+	MaxHostnameLength = 253  // maximum length of the whole hostname (RFC 1123)
+	MaxHostnamePart   = 63   // maximum length of one dot separated part of the hostname
+	MaxLabelLength    = 1024 // maximum length of a single label
+	MaxClockSkew      = 300  // how many seconds in future LastCheck can be before it's considered invalid
+)
+
+// Reasons why discovery packet can be considered invalid
+const (
+	ValidationReasonHostname   = "hostname"
+	ValidationReasonNamespace  = "namespace"
+	ValidationReasonInstanceID = "instance_id"
+	ValidationReasonLabel      = "label"
+	ValidationReasonLastCheck  = "last_check"
+)
+
+// ValidationError is returned by Validate methods, Reason is short machine readable description of the problem.
+type ValidationError struct {
+	Reason  string
+	Message string
+}
+
+func (e *ValidationError) Error() string {
+	return e.Message
+}
+
+// ValidationReason returns reason of the validation error or "unknown" if err is not *ValidationError.
+func ValidationReason(err error) string {
+	var validationError *ValidationError
+	if errors.As(err, &validationError) {
+		return validationError.Reason
+	}
+	return "unknown"
+}
+
+// IsValidHostname returns true if hostname follows RFC 1123, trailing dot is not allowed.
+func IsValidHostname(hostname string) bool {
+	if len(hostname) == 0 || len(hostname) > MaxHostnameLength {
+		return false
+	}
+
+	for _, part := range strings.Split(hostname, ".") {
+		if len(part) == 0 || len(part) > MaxHostnamePart {
+			return false
+		}
+		if part[0] == '-' || part[len(part)-1] == '-' {
+			return false
+		}
+		for _, c := range part {
+			if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '-') {
+				return false
+			}
+		}
+	}
+
+	return true
+}
+
+// IsValidNamespace returns true if namespace is not empty, it's not longer than 63 characters and contains
+// only lowercase letters, digits, dashes and underscores.
+func IsValidNamespace(namespace string) bool {
+	if len(namespace) == 0 || len(namespace) > MaxHostnamePart {
+		return false
+	}
+
+	for _, c := range namespace {
+		if !(c >= 'a' && c <= 'z' || c >= '0' && c <= '9' || c == '-' || c == '_') {
+			return false
+		}
+	}
+
+	return true
+}
+
+// IsValidInstanceID returns true if instance ID is not empty, not longer than 64 characters and
+// contains only letters, digits, dashes and underscores.
+func IsValidInstanceID(instanceID string) bool {
+	if len(instanceID) == 0 || len(instanceID) > 64 {
+		return false
+	}
+
+	for _, c := range instanceID {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '-' || c == '_') {
+			return false
+		}
+	}
+
+	return true
+}
+
+// Validate returns error if the label is empty, too long or it contains control characters like new lines.
+func (l Label) Validate() error {
+	if len(l) == 0 {
+		return &ValidationError{
+			Reason:  ValidationReasonLabel,
+			Message: "empty label",
+		}
+	}
+
+	if len(l) > MaxLabelLength {
+		return &ValidationError{
+			Reason:  ValidationReasonLabel,
+			Message: fmt.Sprintf("label %q... is longer than %d characters", l[:32], MaxLabelLength),
+		}
+	}
+
+	if !utf8.ValidString(l.String()) {
+		return &ValidationError{
+			Reason:  ValidationReasonLabel,
+			Message: fmt.Sprintf("label %q is not valid UTF-8", l),
+		}
+	}
+
+	for _, c := range l.String() {
+		if unicode.IsControl(c) {
+			return &ValidationError{
+				Reason:  ValidationReasonLabel,
+				Message: fmt.Sprintf("label %q contains control character", l),
+			}
+		}
+	}
+
+	return nil
+}
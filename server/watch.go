@@ -0,0 +1,114 @@
+package server
+
+import (
+	"fmt"
+	"path"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// DefaultLabelsDebounce is how long WatchLabels waits for more changes before it reports them
+const DefaultLabelsDebounce = 200 * time.Millisecond
+
+// cachedFileLabels returns labels from the environment and LabelsPath. They are read from the disk
+// only when the directory is not watched or when something has changed in it since the last read.
+func (l *LocalHost) cachedFileLabels() (*labelSourcesIndex, error) {
+	l.cacheLock.Lock()
+	defer l.cacheLock.Unlock()
+
+	if l.watching && l.cache != nil {
+		return l.cache, nil
+	}
+
+	index, err := l.fileLabelSources()
+	if err != nil {
+		return index, err
+	}
+
+	if l.watching {
+		l.cache = index
+	}
+
+	return index, nil
+}
+
+// invalidateCache makes the next GetIdentification read the labels from the disk again
+func (l *LocalHost) invalidateCache() {
+	l.cacheLock.Lock()
+	defer l.cacheLock.Unlock()
+
+	l.cache = nil
+}
+
+// setWatching switches caching of the labels from LabelsPath
+func (l *LocalHost) setWatching(watching bool) {
+	l.cacheLock.Lock()
+	defer l.cacheLock.Unlock()
+
+	l.watching = watching
+	l.cache = nil
+}
+
+// WatchLabels watches LabelsPath for changes via inotify. While the directory is watched, labels are
+// read from the disk only after a change. Changes coming in bursts are merged together and onChange
+// is called once there is no other change for the debounce period. It returns function that stops
+// the watching. If the directory is removed, watching stops and labels are read on every call again.
+func (l *LocalHost) WatchLabels(debounce time.Duration, onChange func()) (func(), error) {
+	if debounce <= 0 {
+		debounce = DefaultLabelsDebounce
+	}
+
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return nil, fmt.Errorf("creating labels watcher error: %v", err)
+	}
+
+	err = watcher.Add(l.LabelsPath)
+	if err != nil {
+		watcher.Close()
+		return nil, fmt.Errorf("watching %s error: %v", l.LabelsPath, err)
+	}
+
+	l.setWatching(true)
+
+	done := make(chan struct{})
+	go func() {
+		timer := time.NewTimer(debounce)
+		timer.Stop()
+
+		for {
+			select {
+			case event, ok := <-watcher.Events:
+				if !ok {
+					return
+				}
+				l.invalidateCache()
+				if path.Clean(event.Name) == path.Clean(l.LabelsPath) && event.Op&(fsnotify.Remove|fsnotify.Rename) != 0 {
+					l.setWatching(false)
+				}
+				timer.Reset(debounce)
+			case _, ok := <-watcher.Errors:
+				if !ok {
+					return
+				}
+				// Some events may be lost (queue overflow), let's read everything again
+				l.invalidateCache()
+				timer.Reset(debounce)
+			case <-timer.C:
+				onChange()
+			case <-done:
+				timer.Stop()
+				return
+			}
+		}
+	}()
+
+	stop := func() {
+		l.setWatching(false)
+		close(done)
+		watcher.Close()
+	}
+
+	return stop, nil
+}
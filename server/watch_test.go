@@ -0,0 +1,132 @@
+package server
+
+import (
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWatchLabels(t *testing.T) {
+	localHost := LocalHost{
+		LabelsPath:       testLabelPath,
+		HostnameOverride: "test.example.com",
+	}
+
+	err := os.MkdirAll(testLabelPath, os.ModePerm)
+	assert.Nil(t, err)
+	defer os.RemoveAll(tmpPath)
+
+	changes := make(chan bool, 10)
+	stop, err := localHost.WatchLabels(50*time.Millisecond, func() {
+		changes <- true
+	})
+	assert.Nil(t, err)
+	defer stop()
+
+	discovery, err := localHost.GetIdentification()
+	assert.Nil(t, err)
+	assert.Equal(t, 0, len(discovery.Labels))
+
+	// Burst of changes is reported once
+	for _, content := range []string{"service:test", "service:test\nservice:test2", "service:test2"} {
+		err = os.WriteFile(testLabelPath+"/test", []byte(content), 0644)
+		assert.Nil(t, err)
+	}
+
+	select {
+	case <-changes:
+	case <-time.After(5 * time.Second):
+		t.Fatal("change in the labels directory wasn't detected")
+	}
+	select {
+	case <-changes:
+		t.Fatal("burst of changes was reported more than once")
+	case <-time.After(200 * time.Millisecond):
+	}
+
+	discovery, err = localHost.GetIdentification()
+	assert.Nil(t, err)
+	assert.Equal(t, Labels{"service:test2"}, discovery.Labels)
+
+	err = os.Remove(testLabelPath + "/test")
+	assert.Nil(t, err)
+
+	select {
+	case <-changes:
+	case <-time.After(5 * time.Second):
+		t.Fatal("removed file wasn't detected")
+	}
+
+	discovery, err = localHost.GetIdentification()
+	assert.Nil(t, err)
+	assert.Equal(t, 0, len(discovery.Labels))
+}
+
+func TestWatchLabelsBrokenFile(t *testing.T) {
+	localHost := LocalHost{
+		LabelsPath:       testLabelPath,
+		HostnameOverride: "test.example.com",
+		LogChannel:       make(chan string, 10),
+	}
+
+	err := os.MkdirAll(testLabelPath, os.ModePerm)
+	assert.Nil(t, err)
+	defer os.RemoveAll(tmpPath)
+
+	err = os.WriteFile(testLabelPath+"/mail.yaml", []byte("service: smtp"), 0644)
+	assert.Nil(t, err)
+	err = os.WriteFile(testLabelPath+"/location.yaml", []byte("location: prague"), 0644)
+	assert.Nil(t, err)
+
+	changes := make(chan bool, 10)
+	stop, err := localHost.WatchLabels(50*time.Millisecond, func() {
+		changes <- true
+	})
+	assert.Nil(t, err)
+	defer stop()
+
+	discovery, err := localHost.GetIdentification()
+	assert.Nil(t, err)
+	assert.Equal(t, Labels{"location:prague", "service:smtp"}, discovery.Labels)
+
+	// Bad edit of one file withdraws only its labels and the error is logged
+	err = os.WriteFile(testLabelPath+"/mail.yaml", []byte("service: [smtp"), 0644)
+	assert.Nil(t, err)
+	select {
+	case <-changes:
+	case <-time.After(5 * time.Second):
+		t.Fatal("change in the labels directory wasn't detected")
+	}
+
+	discovery, err = localHost.GetIdentification()
+	assert.Nil(t, err)
+	assert.Equal(t, Labels{"location:prague"}, discovery.Labels)
+	select {
+	case message := <-localHost.LogChannel:
+		assert.Contains(t, message, "tmp/labels/mail.yaml:")
+	default:
+		t.Error("error of the broken file wasn't logged")
+	}
+
+	// Fixed file is loaded again
+	err = os.WriteFile(testLabelPath+"/mail.yaml", []byte("service: [smtp, imap]"), 0644)
+	assert.Nil(t, err)
+	select {
+	case <-changes:
+	case <-time.After(5 * time.Second):
+		t.Fatal("change in the labels directory wasn't detected")
+	}
+
+	discovery, err = localHost.GetIdentification()
+	assert.Nil(t, err)
+	assert.Equal(t, Labels{"location:prague", "service:imap", "service:smtp"}, discovery.Labels)
+}
+
+func TestWatchLabelsMissingDirectory(t *testing.T) {
+	localHost := LocalHost{LabelsPath: tmpPath + "/missing"}
+
+	_, err := localHost.WatchLabels(0, func() {})
+	assert.NotNil(t, err)
+}